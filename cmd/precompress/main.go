@@ -0,0 +1,109 @@
+// Command precompress writes .gz and .br siblings next to compressible static
+// assets, so that the server can send them as is instead of compressing on
+// every request. Siblings that are newer than their source are left alone.
+//
+// Usage:
+//
+//	precompress <dir>...
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	// Files smaller than that are not worth compressing, the server won't
+	// compress such responses either.
+	minSize = 1024
+)
+
+var compressibleExts = map[string]bool{
+	".css":  true,
+	".html": true,
+	".js":   true,
+	".json": true,
+	".svg":  true,
+	".txt":  true,
+	".xml":  true,
+}
+
+type encoder struct {
+	ext string
+	new func(w io.Writer) io.WriteCloser
+}
+
+var encoders = []encoder{
+	{".gz", func(w io.Writer) io.WriteCloser {
+		zw, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+		return zw
+	}},
+	{".br", func(w io.Writer) io.WriteCloser {
+		return brotli.NewWriterLevel(w, brotli.BestCompression)
+	}},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: precompress <dir>...")
+		os.Exit(2)
+	}
+	for _, dir := range os.Args[1:] {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !compressibleExts[filepath.Ext(path)] {
+				return nil
+			}
+			return precompress(path)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+func precompress(path string) error {
+	src, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if src.Size() < minSize {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for _, enc := range encoders {
+		dst := path + enc.ext
+		if st, err := os.Stat(dst); err == nil && !st.ModTime().Before(src.ModTime()) {
+			continue
+		}
+		var buf bytes.Buffer
+		w := enc.new(&buf)
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		// Don't bother shipping a sibling that did not get any smaller
+		if buf.Len() >= len(data) {
+			continue
+		}
+		if err := os.WriteFile(dst, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
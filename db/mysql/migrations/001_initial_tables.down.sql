@@ -0,0 +1,6 @@
+drop table comment;
+drop table tagmap;
+drop table tag;
+drop table post;
+drop table author;
+drop table commenter;
@@ -0,0 +1,46 @@
+create table tag (
+    id integer not null auto_increment primary key,
+    name text,
+    url text
+) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_bin;
+create table author (
+    id integer not null auto_increment primary key,
+    disp_name text,
+    salt text,
+    passwd text,
+    full_name text,
+    email text,
+    www text
+) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_bin;
+create table post (
+    id integer not null auto_increment primary key,
+    author_id integer not null,
+    title text,
+    date bigint,
+    url text,
+    body longtext,
+    foreign key (author_id) references author(id) on delete cascade on update cascade
+) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_bin;
+create table tagmap (
+    id integer not null auto_increment primary key,
+    tag_id integer not null,
+    post_id integer not null,
+    foreign key (tag_id) references tag(id) on delete cascade on update cascade,
+    foreign key (post_id) references post(id) on delete cascade on update cascade
+) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_bin;
+create table commenter (
+    id integer not null auto_increment primary key,
+    name text,
+    email text,
+    www text,
+    ip text
+) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_bin;
+create table comment (
+    id integer not null auto_increment primary key,
+    commenter_id integer not null,
+    post_id integer not null,
+    timestamp bigint,
+    body longtext,
+    foreign key (commenter_id) references commenter(id) on delete cascade on update cascade,
+    foreign key (post_id) references post(id) on delete cascade on update cascade
+) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_bin;
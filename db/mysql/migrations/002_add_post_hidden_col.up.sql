@@ -0,0 +1,3 @@
+alter table post add column hidden boolean not null default false;
+
+alter table post alter column hidden drop default;
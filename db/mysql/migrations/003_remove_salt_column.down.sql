@@ -0,0 +1 @@
+alter table author add column salt text;
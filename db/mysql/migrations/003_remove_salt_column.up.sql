@@ -0,0 +1 @@
+alter table author drop column salt;
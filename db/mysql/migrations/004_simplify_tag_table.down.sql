@@ -0,0 +1,2 @@
+alter table tag add column name text;
+alter table tag change column tag url text;
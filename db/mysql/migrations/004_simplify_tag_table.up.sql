@@ -0,0 +1,2 @@
+alter table tag drop column name;
+alter table tag change column url tag text;
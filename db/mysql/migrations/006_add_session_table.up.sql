@@ -0,0 +1,10 @@
+create table session (
+    id varchar(64) not null primary key,
+    data text,
+    admin boolean not null default false,
+    ip text,
+    user_agent text,
+    created bigint not null,
+    last_seen bigint not null,
+    index session_last_seen (last_seen)
+) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_bin;
@@ -0,0 +1,2 @@
+alter table author drop column recovery_codes;
+alter table author drop column totp_secret;
@@ -0,0 +1,10 @@
+create table session (
+    id text primary key,
+    data text,
+    admin boolean not null default false,
+    ip text,
+    user_agent text,
+    created bigint not null,
+    last_seen bigint not null
+);
+create index session_last_seen on session(last_seen);
@@ -0,0 +1,2 @@
+alter table author add column totp_secret text;
+alter table author add column recovery_codes text;
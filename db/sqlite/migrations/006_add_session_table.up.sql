@@ -0,0 +1,10 @@
+create table session (
+    id text primary key not null,
+    data text,
+    admin integer not null default 0,
+    ip text,
+    user_agent text,
+    created bigint not null,
+    last_seen bigint not null
+);
+create index session_last_seen on session(last_seen);
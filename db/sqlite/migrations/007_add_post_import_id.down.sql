@@ -0,0 +1 @@
+alter table post drop column import_id;
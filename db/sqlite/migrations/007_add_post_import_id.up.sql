@@ -0,0 +1 @@
+alter table post add column import_id text;
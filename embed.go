@@ -5,5 +5,11 @@ import "embed"
 //go:embed build/default.db build/static l10n tmpl
 var Assets embed.FS
 
+// Migrations holds the SQL migrations of all supported dialects, the server
+// applies them itself.
+//
+//go:embed db/mysql/migrations db/pg/migrations db/sqlite/migrations
+var Migrations embed.FS
+
 //go:embed build/version
 var Version string
@@ -1,9 +1,12 @@
 module github.com/rtfb/rtfblog
 
 require (
+	github.com/andybalholm/brotli v1.2.6
 	github.com/docopt/docopt-go v0.0.0-20160216232012-784ddc588536
+	github.com/go-sql-driver/mysql v1.7.1
 	github.com/gorilla/feeds v1.1.2
 	github.com/gorilla/pat v1.0.3-0.20231207044425-b1685f4ea6bd
+	github.com/gorilla/securecookie v1.1.2
 	github.com/gorilla/sessions v1.2.2
 	github.com/jinzhu/gorm v1.9.16
 	github.com/lib/pq v1.10.7
@@ -18,6 +21,7 @@ require (
 	github.com/rtfb/httpbuf v0.0.0-20120503183857-5709e9bb814c
 	github.com/rtfb/httputil v0.0.0-20150217190924-9649b2ef6634
 	github.com/russross/blackfriday v0.0.0-20161003162722-5f33e7b78783
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/stretchr/testify v1.8.2
 	golang.org/x/crypto v0.45.0
 	golang.org/x/net v0.47.0
@@ -30,12 +34,10 @@ require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/denisenkom/go-mssqldb v0.12.3 // indirect
-	github.com/go-sql-driver/mysql v1.7.1 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/gorilla/context v1.1.2 // indirect
 	github.com/gorilla/css v1.0.0 // indirect
 	github.com/gorilla/mux v1.8.1 // indirect
-	github.com/gorilla/securecookie v1.1.2 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
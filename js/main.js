@@ -150,6 +150,7 @@ function uploadProgress() {
     }
     try {
         xhr.open("POST", "upload_images", true);
+        xhr.setRequestHeader("X-CSRF-Token", csrfToken());
         xhr.send(formData);
     } catch (err) {
         alert("exc: " + err);
@@ -157,6 +158,29 @@ function uploadProgress() {
     uploadNo += 1;
 }
 
+function csrfToken() {
+    var meta = document.querySelector('meta[name="csrf-token"]');
+    return meta ? meta.content : "";
+}
+
+// postWithCSRF submits a form with params to url, along with the CSRF token
+// admin actions need.
+function postWithCSRF(url, params) {
+    var form = document.createElement("form");
+    form.method = "post";
+    form.action = url;
+    params.csrf_token = csrfToken();
+    for (var name in params) {
+        var input = document.createElement("input");
+        input.type = "hidden";
+        input.name = name;
+        input.value = params[name];
+        form.appendChild(input);
+    }
+    document.body.appendChild(form);
+    form.submit();
+}
+
 function removeElt(id) {
     var elem = document.getElementById(id);
     if (elem) {
@@ -170,3 +194,4 @@ window.submitComment = submitComment;
 window.validatePostForm = validatePostForm;
 window.validateAuthorForm = validateAuthorForm;
 window.removeElt = removeElt;
+window.postWithCSRF = postWithCSRF;
@@ -0,0 +1,38 @@
+#!/bin/bash
+
+MYSQLD=`which mysqld || echo /usr/sbin/mysqld`
+
+# Start MySQL (or MariaDB) process for tests
+MYSQL_DATA=`mktemp -d /tmp/MYSQL-XXXXX`
+if $MYSQLD --version | grep -q MariaDB; then
+	mysql_install_db --no-defaults --auth-root-authentication-method=normal \
+		--datadir=${MYSQL_DATA}/data > /dev/null
+else
+	$MYSQLD --no-defaults --initialize-insecure --datadir=${MYSQL_DATA}/data
+fi
+$MYSQLD --no-defaults --datadir=${MYSQL_DATA}/data --skip-networking \
+	--socket=${MYSQL_DATA}/mysql.sock --pid-file=${MYSQL_DATA}/mysqld.pid \
+	&> ${MYSQL_DATA}/out &
+
+# Wait for MySQL to start listening to connections
+until mysqladmin --socket=${MYSQL_DATA}/mysql.sock -u root ping &> /dev/null
+do
+	sleep 0.2
+done
+mysql --socket=${MYSQL_DATA}/mysql.sock -u root -e "create database rtfblog_test"
+
+export RTFBLOG_DB_DRIVER=mysql
+export RTFBLOG_DB_TEST_URL="root@unix(${MYSQL_DATA}/mysql.sock)/rtfblog_test"
+
+echo "MYSQL_DATA = ${MYSQL_DATA}"
+echo "RTFBLOG_DB_TEST_URL = ${RTFBLOG_DB_TEST_URL}"
+
+# No need to run migrate up, the tests start by migrating the empty DB
+echo "Running tests on $RTFBLOG_DB_DRIVER..."
+go test -covermode=count -coverprofile=profile.cov -v ./src/...
+exit_status=$?
+
+mysqladmin --socket=${MYSQL_DATA}/mysql.sock -u root shutdown
+rm -r ${MYSQL_DATA}
+
+exit $exit_status
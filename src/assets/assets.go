@@ -2,18 +2,34 @@ package assets
 
 import (
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"time"
 
 	"github.com/rtfb/cachedir"
 	embedded "github.com/rtfb/rtfblog"
 )
 
-// Bin wraps around all assets, both the baked-in, and on-disk.
+const (
+	// staticDir is where uploaded files get mounted in the asset namespace,
+	// they're served along with other static files.
+	staticDir = "static"
+)
+
+// Bin wraps around all assets, both the baked-in, and on-disk. It presents
+// them as a single read-only file system with three layers, topmost first:
+//
+//   - the writable directory, mounted at static/, so that uploads are served
+//     next to the rest of static files;
+//   - the read-only directory;
+//   - the embedded assets.
+//
+// Paths are the same as in the source tree, e.g. static/css/main.css,
+// tmpl/base.html or l10n/en-US.all.json.
 type Bin struct {
 	// root path of physical assets in filesystem. These files will only be read
 	roDir string
@@ -23,8 +39,7 @@ type Bin struct {
 	// up files.
 	wrDir string
 
-	// only consider FS files, don't fallback to baked
-	fsOnly bool
+	fs fs.FS
 }
 
 // NewBin creates a new Bin.
@@ -34,50 +49,66 @@ func NewBin(roDir, wrDir string, log *slog.Logger) (*Bin, error) {
 	return &Bin{
 		roDir: roDir,
 		wrDir: wrDir,
+		fs:    overlayFS{diskLayers(roDir, wrDir), embeddedLayer()},
 	}, err
 }
 
+// FSOnly returns a Bin that only considers files on disk and doesn't
+// fall back to baked-in assets.
 func (a *Bin) FSOnly() *Bin {
 	return &Bin{
-		roDir:  a.roDir,
-		wrDir:  a.wrDir,
-		fsOnly: true,
+		roDir: a.roDir,
+		wrDir: a.wrDir,
+		fs:    diskLayers(a.roDir, a.wrDir),
 	}
 }
 
-func (a *Bin) WriteRoot() string {
-	return a.wrDir
+func diskLayers(roDir, wrDir string) overlayFS {
+	return overlayFS{
+		mountFS{dir: staticDir, fsys: os.DirFS(wrDir)},
+		os.DirFS(roDir),
+	}
 }
 
-func (a *Bin) Load(path string) ([]byte, error) {
-	fullPath, wrExists, err := fileExistsAt(path, a.wrDir)
+// embeddedLayer maps embedded.Assets to the same paths as files have on disk.
+// The build puts some of them under build/, but that's not where they get
+// looked up.
+func embeddedLayer() fs.FS {
+	build, err := fs.Sub(embedded.Assets, "build")
 	if err != nil {
-		return nil, err
+		panic("fs.Sub(embedded.Assets): " + err.Error())
 	}
-	// Physical writable file takes highest precedence
-	if wrExists {
-		return ioutil.ReadFile(fullPath)
+	return modTimeFS{
+		fsys:    overlayFS{build, embedded.Assets},
+		modTime: executableModTime(),
 	}
-	fullPath, roExists, err := fileExistsAt(path, a.roDir)
+}
+
+// executableModTime is the best approximation of when the embedded assets
+// were last modified.
+func executableModTime() time.Time {
+	exe, err := os.Executable()
 	if err != nil {
-		return nil, err
+		return time.Now()
 	}
-	// Physical read-only file takes lower precedence, and it's the last thing
-	// to try if fsOnly is set to true
-	if roExists || a.fsOnly {
-		return ioutil.ReadFile(fullPath)
+	stat, err := os.Stat(exe)
+	if err != nil {
+		return time.Now()
 	}
-	// Fall back to baked asset
-	return embedded.Assets.ReadFile(path)
+	return stat.ModTime()
 }
 
-func fileExistsAt(filePath, root string) (string, bool, error) {
-	path := filePath
-	if !strings.HasPrefix(path, "/") {
-		path = filepath.Join(root, filePath)
-	}
-	ok, err := FileExists(path)
-	return path, ok, err
+// FS returns the layered file system of all assets.
+func (a *Bin) FS() fs.FS {
+	return a.fs
+}
+
+func (a *Bin) WriteRoot() string {
+	return a.wrDir
+}
+
+func (a *Bin) Load(path string) ([]byte, error) {
+	return fs.ReadFile(a.fs, cleanName(path))
 }
 
 func (a *Bin) MustLoad(path string) []byte {
@@ -96,7 +127,7 @@ func MustExtractDBAsset(defaultDB string) string {
 	dbPath := filepath.Join(path, defaultDB)
 	// Extract it only in case there isn't one already from the last time
 	if !FileExistsNoErr(dbPath) {
-		data, err := embedded.Assets.ReadFile(defaultDB)
+		data, err := fs.ReadFile(embeddedLayer(), defaultDB)
 		if err != nil {
 			panic(fmt.Sprintf("Failed to ReadFile(%q): %v", defaultDB, err))
 		}
@@ -108,101 +139,9 @@ func MustExtractDBAsset(defaultDB string) string {
 	return dbPath
 }
 
+// Open implements http.FileSystem on top of FS.
 func (a *Bin) Open(name string) (http.File, error) {
-	f, err := http.Dir(a.wrDir).Open(filepath.Base(name))
-	if err == nil {
-		return f, nil
-	}
-	f, err = http.Dir(a.roDir).Open(name)
-	if err == nil {
-		return f, nil
-	}
-	if name[0] == '/' {
-		name = name[1:]
-	}
-	data, err := embedded.Assets.ReadFile(name)
-	return &AssetFile{
-		name: name,
-		data: data,
-	}, err
-}
-
-// Implements http.File
-type AssetFile struct {
-	name      string
-	seekIndex int64
-	data      []byte // slice into an Asset
-}
-
-func (af *AssetFile) Close() error {
-	af.seekIndex = 0
-	af.data = nil
-	return nil
-}
-
-func min(a, b int64) int64 {
-	if a < b {
-		return a
-	}
-	return b
-}
-
-func len64(b []byte) int64 {
-	return int64(len(b))
-}
-
-func (af *AssetFile) Read(p []byte) (n int, err error) {
-	if af.data == nil {
-		af.data, err = embedded.Assets.ReadFile(af.name)
-	}
-	n64 := min(len64(p), len64(af.data)-af.seekIndex)
-	copy(p, af.data[af.seekIndex:af.seekIndex+n64])
-	return int(n64), err
-}
-
-func (af *AssetFile) Seek(offset int64, whence int) (int64, error) {
-	switch whence {
-	case os.SEEK_SET:
-		af.seekIndex = offset
-	case os.SEEK_CUR:
-		af.seekIndex += offset
-	case os.SEEK_END:
-		af.seekIndex = len64(af.data) - offset
-	default:
-		return 0, fmt.Errorf("Unknown seek mode %d", whence)
-	}
-	af.seekIndex = min(af.seekIndex, len64(af.data))
-	if af.seekIndex < 0 {
-		af.seekIndex = 0
-	}
-	return af.seekIndex, nil
-}
-
-func (af *AssetFile) Readdir(n int) (fi []os.FileInfo, err error) {
-	dir, err := embedded.Assets.ReadDir(af.name)
-	if err != nil {
-		return nil, err
-	}
-	for i, d := range dir {
-		if i == n {
-			break
-		}
-		df := &AssetFile{name: d.Name()}
-		stat, err2 := df.Stat()
-		if err2 != nil {
-			return nil, err
-		}
-		fi = append(fi, stat)
-	}
-	return
-}
-
-func (af *AssetFile) Stat() (os.FileInfo, error) {
-	f, err := embedded.Assets.Open(af.name)
-	if err != nil {
-		return nil, err
-	}
-	return f.Stat()
+	return http.FS(a.fs).Open("/" + cleanName(name))
 }
 
 func FileExistsNoErr(path string) bool {
@@ -0,0 +1,206 @@
+package assets
+
+import (
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	embedded "github.com/rtfb/rtfblog"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0750))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func mkTestBin(t *testing.T) *Bin {
+	roDir := t.TempDir()
+	wrDir := t.TempDir()
+	writeFiles(t, roDir, map[string]string{
+		"static/css/main.css":  "ro css",
+		"static/shadowed.txt":  "ro",
+		"tmpl/base.html":       "ro base",
+		"static/sub/ro.txt":    "ro sub",
+		"static/not-a-dir.txt": "ro file",
+	})
+	writeFiles(t, wrDir, map[string]string{
+		"shadowed.txt":   "wr",
+		"upload.png":     "wr png",
+		"sub/nested.txt": "wr nested",
+	})
+	bin, err := NewBin(roDir, wrDir, slog.Default())
+	require.NoError(t, err)
+	return bin
+}
+
+func mustReadEmbedded(t *testing.T, name string) string {
+	b, err := embedded.Assets.ReadFile(name)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestBinLayers(t *testing.T) {
+	bin := mkTestBin(t)
+	var tests = []struct {
+		name, layer, expected string
+	}{
+		{"static/shadowed.txt", "writable over read-only", "wr"},
+		{"static/upload.png", "writable", "wr png"},
+		{"static/sub/nested.txt", "writable, nested", "wr nested"},
+		{"/static/sub/nested.txt", "writable, http style name", "wr nested"},
+		{"static/sub/ro.txt", "read-only, dir shared with writable", "ro sub"},
+		{"static/css/main.css", "read-only", "ro css"},
+		{"tmpl/base.html", "read-only over embedded", "ro base"},
+		{"tmpl/login.html", "embedded", mustReadEmbedded(t, "tmpl/login.html")},
+		{"l10n/en-US.all.json", "embedded", mustReadEmbedded(t, "l10n/en-US.all.json")},
+		{"default.db", "embedded, under build/", mustReadEmbedded(t, "build/default.db")},
+	}
+	for _, test := range tests {
+		b, err := bin.Load(test.name)
+		require.NoError(t, err, test.layer)
+		require.Equal(t, test.expected, string(b), test.layer)
+
+		f, err := bin.Open(test.name)
+		require.NoError(t, err, test.layer)
+		stat, err := f.Stat()
+		require.NoError(t, err, test.layer)
+		require.Equal(t, int64(len(test.expected)), stat.Size(), test.layer)
+		require.False(t, stat.ModTime().IsZero(), test.layer)
+		b, err = io.ReadAll(f)
+		require.NoError(t, err, test.layer)
+		require.Equal(t, test.expected, string(b), test.layer)
+		require.NoError(t, f.Close())
+	}
+}
+
+func TestBinMissingFiles(t *testing.T) {
+	bin := mkTestBin(t)
+	for _, name := range []string{
+		"shadowed.txt", // writable dir is only mounted at static/
+		"static/nope.txt",
+		"tmpl/nope.html",
+	} {
+		_, err := bin.Load(name)
+		require.ErrorIs(t, err, fs.ErrNotExist, name)
+		_, err = bin.Open(name)
+		require.ErrorIs(t, err, fs.ErrNotExist, name)
+	}
+	_, err := bin.FSOnly().Load("tmpl/login.html")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	b, err := bin.FSOnly().Load("static/shadowed.txt")
+	require.NoError(t, err)
+	require.Equal(t, "wr", string(b))
+}
+
+func TestBinReadDirMergesLayers(t *testing.T) {
+	bin := mkTestBin(t)
+	entries, err := fs.ReadDir(bin.FS(), "static")
+	require.NoError(t, err)
+	names := map[string]bool{}
+	for _, e := range entries {
+		require.False(t, names[e.Name()], "duplicate entry %q", e.Name())
+		names[e.Name()] = true
+		// Every entry has to be stat-able by its name in the directory
+		info, err := e.Info()
+		require.NoError(t, err, e.Name())
+		stat, err := fs.Stat(bin.FS(), "static/"+e.Name())
+		require.NoError(t, err, e.Name())
+		require.Equal(t, stat.IsDir(), info.IsDir(), e.Name())
+	}
+	for _, name := range []string{"css", "shadowed.txt", "upload.png", "sub", "not-a-dir.txt"} {
+		require.True(t, names[name], name)
+	}
+
+	entries, err = fs.ReadDir(bin.FS(), "static/sub")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "nested.txt", entries[0].Name())
+	require.Equal(t, "ro.txt", entries[1].Name())
+}
+
+func TestBinServesRanges(t *testing.T) {
+	bin := mkTestBin(t)
+	login := mustReadEmbedded(t, "tmpl/login.html")
+	var tests = []struct {
+		name, rng, expected string
+	}{
+		{"/static/shadowed.txt", "bytes=1-", "r"},
+		{"/static/css/main.css", "bytes=-3", "css"},
+		{"/tmpl/login.html", "bytes=-10", login[len(login)-10:]},
+		{"/tmpl/login.html", "bytes=5-9", login[5:10]},
+	}
+	srv := http.FileServer(bin)
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.name, nil)
+		req.Header.Set("Range", test.rng)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusPartialContent, rec.Code, test.name)
+		require.Equal(t, test.expected, rec.Body.String(), test.name)
+	}
+}
+
+func TestBinServesLastModified(t *testing.T) {
+	bin := mkTestBin(t)
+	srv := http.FileServer(bin)
+	for _, name := range []string{"/static/css/main.css", "/tmpl/login.html"} {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest("GET", name, nil))
+		require.Equal(t, http.StatusOK, rec.Code, name)
+		lastModified := rec.Header().Get("Last-Modified")
+		require.NotEmpty(t, lastModified, name)
+
+		req := httptest.NewRequest("GET", name, nil)
+		req.Header.Set("If-Modified-Since", lastModified)
+		rec = httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusNotModified, rec.Code, name)
+	}
+}
+
+func TestBinListsDirectories(t *testing.T) {
+	bin := mkTestBin(t)
+	rec := httptest.NewRecorder()
+	http.FileServer(bin).ServeHTTP(rec, httptest.NewRequest("GET", "/static/sub/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "nested.txt")
+	require.Contains(t, rec.Body.String(), "ro.txt")
+}
+
+func TestOverlayFS(t *testing.T) {
+	upper := fstest.MapFS{
+		"a.txt":     {Data: []byte("upper a")},
+		"dir/b.txt": {Data: []byte("upper b")},
+	}
+	lower := fstest.MapFS{
+		"a.txt":     {Data: []byte("lower a")},
+		"c.txt":     {Data: []byte("lower c")},
+		"dir/d.txt": {Data: []byte("lower d")},
+	}
+	o := overlayFS{upper, lower}
+	require.NoError(t, fstest.TestFS(o, "a.txt", "c.txt", "dir/b.txt", "dir/d.txt"))
+	b, err := fs.ReadFile(o, "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, "upper a", string(b))
+}
+
+func TestMountFS(t *testing.T) {
+	m := mountFS{dir: "static", fsys: fstest.MapFS{
+		"x.png":     {Data: []byte("x")},
+		"sub/y.png": {Data: []byte("y")},
+	}}
+	require.NoError(t, fstest.TestFS(overlayFS{m, fstest.MapFS{"static": {Mode: fs.ModeDir | 0555}}},
+		"static/x.png", "static/sub/y.png"))
+	_, err := m.Open("x.png")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
@@ -0,0 +1,275 @@
+package assets
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// overlayFS is a read-only union of file systems. Files are looked up in each
+// layer in turn and the first layer that has the file wins. Directories that
+// exist in several layers are merged, with entries of upper layers shadowing
+// the entries of the same name in lower ones.
+type overlayFS []fs.FS
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	for i, layer := range o {
+		f, err := layer.Open(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if !stat.IsDir() {
+			return f, nil
+		}
+		entries, err := o[i:].readDir(name)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &overlayDir{File: f, entries: entries}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return o.readDir(name)
+}
+
+// readDir merges the listings of all layers that have a directory by that
+// name. Layers where name is a file are skipped, the file would be shadowed
+// by the directory anyway.
+func (o overlayFS) readDir(name string) ([]fs.DirEntry, error) {
+	found := false
+	seen := map[string]bool{}
+	var merged []fs.DirEntry
+	for _, layer := range o {
+		stat, err := fs.Stat(layer, name)
+		if errors.Is(err, fs.ErrNotExist) || err == nil && !stat.IsDir() {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries, err := fs.ReadDir(layer, name)
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, e := range entries {
+			if seen[e.Name()] {
+				continue
+			}
+			seen[e.Name()] = true
+			merged = append(merged, e)
+		}
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Name() < merged[j].Name()
+	})
+	return merged, nil
+}
+
+// overlayDir is a directory opened from overlayFS. Stat comes from the
+// topmost layer that has the directory, while listing is merged from all of
+// them.
+type overlayDir struct {
+	fs.File
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *overlayDir) Read([]byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *overlayDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	d.offset += n
+	return rest[:n], nil
+}
+
+// mountFS makes fsys appear under the dir directory. Names outside of dir
+// don't exist in it.
+type mountFS struct {
+	dir  string
+	fsys fs.FS
+}
+
+func (m mountFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == m.dir {
+		f, err := m.fsys.Open(".")
+		if err != nil {
+			return nil, err
+		}
+		return &mountRoot{File: f, name: path.Base(m.dir)}, nil
+	}
+	rest, ok := strings.CutPrefix(name, m.dir+"/")
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return m.fsys.Open(rest)
+}
+
+// mountRoot is the root of a mounted file system. It has to be reported by
+// the name of the mount point rather than ".".
+type mountRoot struct {
+	fs.File
+	name string
+}
+
+func (r *mountRoot) Stat() (fs.FileInfo, error) {
+	stat, err := r.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return renamedFileInfo{FileInfo: stat, name: r.name}, nil
+}
+
+func (r *mountRoot) ReadDir(n int) ([]fs.DirEntry, error) {
+	dir, ok := r.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, errors.New("not a directory")
+	}
+	return dir.ReadDir(n)
+}
+
+type renamedFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi renamedFileInfo) Name() string {
+	return fi.name
+}
+
+// modTimeFS reports modTime for all files that don't know their own
+// modification time, which is the case for everything in embed.FS. Without
+// it, http.ServeContent can't do Last-Modified and If-Modified-Since for
+// embedded files.
+type modTimeFS struct {
+	fsys    fs.FS
+	modTime time.Time
+}
+
+func (m modTimeFS) Open(name string) (fs.File, error) {
+	f, err := m.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &modTimeFile{File: f, modTime: m.modTime}, nil
+}
+
+// modTimeFile passes through everything that embed's files can do, so that
+// http.FS can still seek in them to serve range requests.
+type modTimeFile struct {
+	fs.File
+	modTime time.Time
+}
+
+func (f *modTimeFile) Stat() (fs.FileInfo, error) {
+	stat, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return fixModTime(stat, f.modTime), nil
+}
+
+func (f *modTimeFile) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := f.File.(io.Seeker)
+	if !ok {
+		return 0, errors.New("file does not support seeking")
+	}
+	return seeker.Seek(offset, whence)
+}
+
+func (f *modTimeFile) ReadAt(p []byte, off int64) (int, error) {
+	readerAt, ok := f.File.(io.ReaderAt)
+	if !ok {
+		return 0, errors.New("file does not support ReadAt")
+	}
+	return readerAt.ReadAt(p, off)
+}
+
+func (f *modTimeFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	dir, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, errors.New("not a directory")
+	}
+	entries, err := dir.ReadDir(n)
+	for i, e := range entries {
+		entries[i] = modTimeDirEntry{DirEntry: e, modTime: f.modTime}
+	}
+	return entries, err
+}
+
+type modTimeDirEntry struct {
+	fs.DirEntry
+	modTime time.Time
+}
+
+func (e modTimeDirEntry) Info() (fs.FileInfo, error) {
+	info, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return fixModTime(info, e.modTime), nil
+}
+
+type modTimeFileInfo struct {
+	fs.FileInfo
+	modTime time.Time
+}
+
+func (fi modTimeFileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func fixModTime(fi fs.FileInfo, modTime time.Time) fs.FileInfo {
+	if !fi.ModTime().IsZero() {
+		return fi
+	}
+	return modTimeFileInfo{FileInfo: fi, modTime: modTime}
+}
+
+// cleanName turns an http.FileSystem or filepath style name into an io/fs
+// one.
+func cleanName(name string) string {
+	name = path.Clean("/" + filepath.ToSlash(name))
+	if name == "/" {
+		return "."
+	}
+	return name[1:]
+}
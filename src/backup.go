@@ -0,0 +1,461 @@
+package rtfblog
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// backupFormat is the version of the archive layout. Bump it when the
+	// layout changes in a way older versions can't read.
+	backupFormat = 1
+
+	backupManifestName = "manifest.json"
+	backupTablesName   = "tables.json"
+	backupUploadsDir   = "uploads/"
+
+	backupFilePrefix = "rtfblog-"
+	backupFileSuffix = ".tar.gz"
+	backupTimeLayout = "20060102-150405"
+)
+
+// backupManifest is the first file in a backup archive. It tells what's
+// inside, so that a backup can be checked before anything gets overwritten.
+type backupManifest struct {
+	Format        int            `json:"format"`
+	SchemaVersion int            `json:"schema_version"`
+	Version       string         `json:"rtfblog_version"`
+	Created       time.Time      `json:"created"`
+	Rows          map[string]int `json:"rows"`
+	Uploads       int            `json:"uploads"`
+}
+
+// tables maps table names to their rows.
+func (d *tableDump) tables() map[string]interface{} {
+	return map[string]interface{}{
+		"author":    d.Authors,
+		"post":      d.Posts,
+		"tag":       d.Tags,
+		"tagmap":    d.TagMap,
+		"commenter": d.Commenters,
+		"comment":   d.Comments,
+	}
+}
+
+func (d *tableDump) rowCounts() map[string]int {
+	counts := map[string]int{}
+	for table, rows := range d.tables() {
+		counts[table] = reflect.ValueOf(rows).Len()
+	}
+	return counts
+}
+
+// checksums returns a hash of every table's rows. Rows are kept in the order
+// of IDs, so equal tables have equal hashes, whatever DB they come from.
+func (d *tableDump) checksums() (map[string]string, error) {
+	sums := map[string]string{}
+	for table, rows := range d.tables() {
+		data, err := json.Marshal(rows)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		sums[table] = hex.EncodeToString(sum[:])
+	}
+	return sums, nil
+}
+
+// listUploads returns the paths of all uploaded files, relative to dir. A
+// missing dir means nothing was uploaded yet.
+func listUploads(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == dir {
+			return fs.SkipAll
+		}
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files = append(files, filepath.ToSlash(rel))
+		return err
+	})
+	return files, err
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, mtime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: mtime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func writeTarUpload(tw *tar.Writer, dir, name string) error {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    backupUploadsDir + name,
+		Mode:    0644,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// writeBackup writes a gzipped tarball with the manifest, a dump of all
+// tables and all files from uploadsDir, in that order.
+func writeBackup(w io.Writer, db Data, uploadsDir string) (backupManifest, error) {
+	dump, err := db.dump()
+	if err != nil {
+		return backupManifest{}, fmt.Errorf("dump tables: %w", err)
+	}
+	uploads, err := listUploads(uploadsDir)
+	if err != nil {
+		return backupManifest{}, fmt.Errorf("list uploads: %w", err)
+	}
+	m := backupManifest{
+		Format:        backupFormat,
+		SchemaVersion: schemaVersion,
+		Version:       versionString(),
+		Created:       time.Now().UTC().Truncate(time.Second),
+		Rows:          dump.rowCounts(),
+		Uploads:       len(uploads),
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return m, err
+	}
+	tables, err := json.Marshal(dump)
+	if err != nil {
+		return m, err
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := writeTarFile(tw, backupManifestName, manifest, m.Created); err != nil {
+		return m, err
+	}
+	if err := writeTarFile(tw, backupTablesName, tables, m.Created); err != nil {
+		return m, err
+	}
+	for _, name := range uploads {
+		if err := writeTarUpload(tw, uploadsDir, name); err != nil {
+			return m, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return m, err
+	}
+	return m, gz.Close()
+}
+
+// writeBackupFile writes a backup to a temporary file next to fileName and
+// renames it into place when done, so that fileName is never half written.
+func writeBackupFile(fileName string, db Data, uploadsDir string) (backupManifest, error) {
+	f, err := os.CreateTemp(filepath.Dir(fileName), ".backup-*")
+	if err != nil {
+		return backupManifest{}, err
+	}
+	defer os.Remove(f.Name())
+	m, err := writeBackup(f, db, uploadsDir)
+	if err != nil {
+		f.Close()
+		return m, err
+	}
+	if err := f.Close(); err != nil {
+		return m, err
+	}
+	return m, os.Rename(f.Name(), fileName)
+}
+
+func nextTarFile(tr *tar.Reader, name string) error {
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("read %s: %w", name, err)
+	}
+	if hdr.Name != name {
+		return fmt.Errorf("expected %s, found %s", name, hdr.Name)
+	}
+	return nil
+}
+
+func readManifest(tr *tar.Reader) (backupManifest, error) {
+	var m backupManifest
+	if err := nextTarFile(tr, backupManifestName); err != nil {
+		return m, err
+	}
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return m, fmt.Errorf("read %s: %w", backupManifestName, err)
+	}
+	if m.Format != backupFormat {
+		return m, fmt.Errorf("unsupported backup format %d, expected %d", m.Format, backupFormat)
+	}
+	if m.SchemaVersion < 1 || m.SchemaVersion > schemaVersion {
+		msg := "the backup has schema version %d, this version of rtfblog knows of 1 to %d"
+		return m, fmt.Errorf(msg, m.SchemaVersion, schemaVersion)
+	}
+	return m, nil
+}
+
+func readTables(tr *tar.Reader, m backupManifest) (*tableDump, error) {
+	var dump tableDump
+	if err := nextTarFile(tr, backupTablesName); err != nil {
+		return nil, err
+	}
+	if err := json.NewDecoder(tr).Decode(&dump); err != nil {
+		return nil, fmt.Errorf("read %s: %w", backupTablesName, err)
+	}
+	for table, n := range dump.rowCounts() {
+		if m.Rows[table] != n {
+			msg := "table %s has %d rows, but the manifest says %d"
+			return nil, fmt.Errorf(msg, table, n, m.Rows[table])
+		}
+	}
+	return &dump, nil
+}
+
+// extractUploads writes the rest of the archive to uploadsDir, returns the
+// number of files written.
+func extractUploads(tr *tar.Reader, uploadsDir string) (int, error) {
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		name, ok := strings.CutPrefix(hdr.Name, backupUploadsDir)
+		if !ok || !fs.ValidPath(name) || hdr.Typeflag != tar.TypeReg {
+			return n, fmt.Errorf("unexpected file in backup: %s", hdr.Name)
+		}
+		fileName := filepath.Join(uploadsDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			return n, err
+		}
+		f, err := os.Create(fileName)
+		if err != nil {
+			return n, err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return n, err
+		}
+		os.Chtimes(fileName, hdr.ModTime, hdr.ModTime)
+		n++
+	}
+}
+
+func isEmptyDB(db Data) (bool, error) {
+	n, err := db.numPosts(true)
+	if err != nil {
+		return false, err
+	}
+	_, err = db.author()
+	if errors.Is(err, ErrNotFound) {
+		return n == 0, nil
+	}
+	return false, err
+}
+
+// restoreBackup replaces the contents of db and adds the uploaded files to
+// uploadsDir. The tables are restored in a single transaction. A blog that
+// has an author or posts is only overwritten with force, so that a typo in
+// the config does not wipe out the wrong DB.
+func restoreBackup(r io.Reader, db Data, uploadsDir string, force bool) (backupManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return backupManifest{}, err
+	}
+	tr := tar.NewReader(gz)
+	m, err := readManifest(tr)
+	if err != nil {
+		return m, err
+	}
+	dump, err := readTables(tr, m)
+	if err != nil {
+		return m, err
+	}
+	if !force {
+		empty, err := isEmptyDB(db)
+		if err != nil {
+			return m, err
+		}
+		if !empty {
+			return m, errors.New("the database is not empty, use --force to overwrite it")
+		}
+	}
+	if err := restoreTables(db, dump, m.SchemaVersion); err != nil {
+		return m, fmt.Errorf("restore tables: %w", err)
+	}
+	n, err := extractUploads(tr, uploadsDir)
+	if err != nil {
+		return m, fmt.Errorf("restore uploads: %w", err)
+	}
+	if n != m.Uploads {
+		return m, fmt.Errorf("restored %d uploaded files, but the manifest says %d", n, m.Uploads)
+	}
+	return m, nil
+}
+
+// restoreTables restores dump, which comes from a schema at version. A
+// backup of an older schema is restored into the schema it was made of, and
+// brought up to date by the migrations, just like the DB it came from would
+// be. The in-memory DB has no schema to migrate.
+//
+// Migrating down drops what the older schema lacks, so the current contents
+// are put back if the dump does not go in.
+func restoreTables(db Data, dump *tableDump, version int) error {
+	restore := func(dump *tableDump) error {
+		return withTransaction(db, func(db Data) error {
+			return db.restore(dump)
+		})
+	}
+	dd, ok := db.(*DbData)
+	if !ok || version == schemaVersion {
+		return restore(dump)
+	}
+	mig, err := newMigrator(dd.db)
+	if err != nil {
+		return err
+	}
+	current, err := dd.dump()
+	if err != nil {
+		return err
+	}
+	if _, _, err = mig.downTo(version); err == nil {
+		err = restore(dump)
+	}
+	// Up again even if the restore failed, the blog needs the latest schema:
+	if _, _, upErr := mig.up(); upErr != nil {
+		return errors.Join(err, upErr)
+	}
+	if err != nil {
+		if putErr := restore(current); putErr != nil {
+			return errors.Join(err, fmt.Errorf("put back the current contents: %w", putErr))
+		}
+	}
+	return err
+}
+
+func listBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.Type().IsRegular() && strings.HasPrefix(name, backupFilePrefix) &&
+			strings.HasSuffix(name, backupFileSuffix) {
+			names = append(names, name)
+		}
+	}
+	// The timestamp in the name sorts chronologically:
+	slices.Sort(names)
+	return names, nil
+}
+
+func backupTime(name string) (time.Time, error) {
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, backupFilePrefix), backupFileSuffix)
+	return time.Parse(backupTimeLayout, stamp)
+}
+
+// pruneBackups removes all but the keep latest backups from dir. Zero keep
+// keeps them all.
+func pruneBackups(dir string, keep int) error {
+	names, err := listBackups(dir)
+	if err != nil || keep <= 0 || len(names) <= keep {
+		return err
+	}
+	for _, name := range names[:len(names)-keep] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scheduledBackup writes a backup named after the time to dir and prunes the
+// old ones. Returns the file name of the new backup.
+func scheduledBackup(db Data, uploadsDir, dir string, keep int, now time.Time) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, backupFilePrefix+now.UTC().Format(backupTimeLayout)+backupFileSuffix)
+	if _, err := writeBackupFile(name, db, uploadsDir); err != nil {
+		return "", err
+	}
+	return name, pruneBackups(dir, keep)
+}
+
+// nextBackupIn tells how long to wait for the next scheduled backup. It's
+// counted from the latest backup in dir, so that restarting the server does
+// not postpone backups forever.
+func nextBackupIn(dir string, interval time.Duration, now time.Time) time.Duration {
+	names, err := listBackups(dir)
+	if err != nil || len(names) == 0 {
+		return 0
+	}
+	last, err := backupTime(names[len(names)-1])
+	if err != nil {
+		return 0
+	}
+	return max(0, last.Add(interval).Sub(now))
+}
+
+// backupOnSchedule writes a backup to BackupDir every BackupInterval, keeping
+// BackupKeep latest ones, until stop is closed.
+func (s *server) backupOnSchedule(stop <-chan struct{}) {
+	conf := s.config().Server
+	log := s.gctx.Log.With(slog.String("dir", conf.BackupDir))
+	log.Info("Scheduled backups enabled", slog.Duration("interval", conf.BackupInterval))
+	for sleep(nextBackupIn(conf.BackupDir, conf.BackupInterval, time.Now()), stop) {
+		name, err := scheduledBackup(s.gctx.Db, s.gctx.assets.WriteRoot(),
+			conf.BackupDir, conf.BackupKeep, time.Now())
+		if err != nil {
+			log.Error("Scheduled backup failed", E(err))
+			// Don't retry in a tight loop if the latest backup is old:
+			if !sleep(conf.BackupInterval, stop) {
+				return
+			}
+			continue
+		}
+		log.Info("Scheduled backup written", slog.String("file", name))
+	}
+}
@@ -0,0 +1,268 @@
+package rtfblog
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	embedded "github.com/rtfb/rtfblog"
+	"github.com/stretchr/testify/require"
+)
+
+// copyDefaultDB makes a fresh copy of the default DB, returns its path.
+func copyDefaultDB(t *testing.T) string {
+	data, err := fs.ReadFile(embedded.Assets, "build/default.db")
+	require.NoError(t, err)
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	require.NoError(t, os.WriteFile(fileName, data, 0644))
+	return fileName
+}
+
+// openTestSQLite opens a fresh copy of the default DB.
+func openTestSQLite(t *testing.T) *DbData {
+	db, err := gorm.Open("sqlite3", copyDefaultDB(t))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		db.Close()
+	})
+	db.SingularTable(true)
+	return &DbData{db: db, log: slog.Default()}
+}
+
+func fillTestDB(t *testing.T, db Data) {
+	err := withTransaction(db, func(db Data) error {
+		_, err := db.insertAuthor(&Author{UserName: "testuser", FullName: "Test User"})
+		return err
+	})
+	require.NoError(t, err)
+	err = withTransaction(db, func(db Data) error {
+		for _, url := range []string{"first", "second"} {
+			postID, err := InsertOrUpdatePost(db, &EntryTable{
+				EntryLink: EntryLink{Title: "Post " + url, URL: url},
+				RawBody:   "Body of " + url,
+			})
+			if err != nil {
+				return err
+			}
+			if err := db.updateTags([]*Tag{{Name: "go"}, {Name: url}}, postID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	_, err = PublishCommentAndCommenter(db, 1, &Commenter{Name: "N", Email: "n@example.com"}, "Hi")
+	require.NoError(t, err)
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	src := openTestSQLite(t)
+	fillTestDB(t, src)
+	uploads := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(uploads, "2024"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(uploads, "2024", "pic.png"), []byte("png"), 0644))
+	var buf bytes.Buffer
+	m, err := writeBackup(&buf, src, uploads)
+	require.NoError(t, err)
+	require.Equal(t, 2, m.Rows["post"])
+	require.Equal(t, 3, m.Rows["tag"])
+	require.Equal(t, 1, m.Uploads)
+
+	dst := openTestSQLite(t)
+	restored := t.TempDir()
+	_, err = restoreBackup(bytes.NewReader(buf.Bytes()), dst, restored, false)
+	require.NoError(t, err)
+	want, err := src.dump()
+	require.NoError(t, err)
+	got, err := dst.dump()
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	data, err := os.ReadFile(filepath.Join(restored, "2024", "pic.png"))
+	require.NoError(t, err)
+	require.Equal(t, "png", string(data))
+
+	// IDs keep counting after the restored ones:
+	err = withTransaction(dst, func(db Data) error {
+		id, err := db.insertPost(&EntryTable{EntryLink: EntryLink{URL: "third"}, AuthorID: 1})
+		require.Equal(t, int64(3), id)
+		return err
+	})
+	require.NoError(t, err)
+
+	// Restoring over a blog needs to be forced:
+	_, err = restoreBackup(bytes.NewReader(buf.Bytes()), dst, restored, false)
+	require.ErrorContains(t, err, "not empty")
+	_, err = restoreBackup(bytes.NewReader(buf.Bytes()), dst, restored, true)
+	require.NoError(t, err)
+	num, err := dst.numPosts(true)
+	require.NoError(t, err)
+	require.Equal(t, 2, num)
+}
+
+// editBackup rewrites the manifest and the tables of a backup archive with
+// edit.
+func editBackup(t *testing.T, archive []byte, edit func(m *backupManifest, d *tableDump)) []byte {
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	require.NoError(t, err)
+	tr := tar.NewReader(gr)
+	var m backupManifest
+	require.NoError(t, nextTarFile(tr, backupManifestName))
+	require.NoError(t, json.NewDecoder(tr).Decode(&m))
+	var d tableDump
+	require.NoError(t, nextTarFile(tr, backupTablesName))
+	require.NoError(t, json.NewDecoder(tr).Decode(&d))
+	edit(&m, &d)
+	m.Rows = d.rowCounts()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, f := range []struct {
+		name string
+		v    any
+	}{{backupManifestName, m}, {backupTablesName, d}} {
+		data, err := json.Marshal(f.v)
+		require.NoError(t, err)
+		require.NoError(t, writeTarFile(tw, f.name, data, m.Created))
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		require.NoError(t, writeTarFile(tw, hdr.Name, data, hdr.ModTime))
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+// withSchemaVersion rewrites the manifest of a backup archive to say it was
+// made at version.
+func withSchemaVersion(t *testing.T, archive []byte, version int) []byte {
+	return editBackup(t, archive, func(m *backupManifest, d *tableDump) {
+		m.SchemaVersion = version
+	})
+}
+
+func TestRestoreOlderSchema(t *testing.T) {
+	src := openTestSQLite(t)
+	fillTestDB(t, src)
+	var buf bytes.Buffer
+	_, err := writeBackup(&buf, src, t.TempDir())
+	require.NoError(t, err)
+	// Version 4 had no TOTP columns in the author table:
+	archive := withSchemaVersion(t, buf.Bytes(), 4)
+
+	dst := openTestSQLite(t)
+	m, err := restoreBackup(bytes.NewReader(archive), dst, t.TempDir(), false)
+	require.NoError(t, err)
+	require.Equal(t, 4, m.SchemaVersion)
+	mig, err := newMigrator(dst.db)
+	require.NoError(t, err)
+	version, err := mig.version()
+	require.NoError(t, err)
+	require.Equal(t, schemaVersion, version)
+	want, err := src.dump()
+	require.NoError(t, err)
+	got, err := dst.dump()
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	// The migrated up schema is the whole one:
+	err = withTransaction(dst, func(db Data) error {
+		a, err := db.author()
+		require.NoError(t, err)
+		a.TOTPSecret = rfcSecret
+		return db.updateAuthor(a)
+	})
+	require.NoError(t, err)
+	require.NoError(t, dst.insertSession(&SessionTable{ID: "s"}))
+}
+
+func TestRestoreChecksManifest(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	manifest, err := json.Marshal(backupManifest{Format: backupFormat, SchemaVersion: schemaVersion + 1})
+	require.NoError(t, err)
+	require.NoError(t, writeTarFile(tw, backupManifestName, manifest, time.Now()))
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	_, err = restoreBackup(&buf, &testData, t.TempDir(), true)
+	require.ErrorContains(t, err, "schema version")
+}
+
+func TestScheduledBackups(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		name := backupFilePrefix + start.Add(time.Duration(i)*time.Hour).Format(backupTimeLayout) + backupFileSuffix
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "unrelated.tar.gz"), nil, 0600))
+	require.NoError(t, pruneBackups(dir, 2))
+	names, err := listBackups(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"rtfblog-20240301-140000.tar.gz",
+		"rtfblog-20240301-150000.tar.gz",
+	}, names)
+	require.FileExists(t, filepath.Join(dir, "unrelated.tar.gz"))
+
+	last := start.Add(3 * time.Hour)
+	require.Equal(t, 30*time.Minute, nextBackupIn(dir, time.Hour, last.Add(30*time.Minute)))
+	require.Equal(t, time.Duration(0), nextBackupIn(dir, time.Hour, last.Add(2*time.Hour)))
+	require.Equal(t, time.Duration(0), nextBackupIn(t.TempDir(), time.Hour, last))
+}
+
+func TestRestoreOlderSchemaFails(t *testing.T) {
+	src := openTestSQLite(t)
+	fillTestDB(t, src)
+	var buf bytes.Buffer
+	_, err := writeBackup(&buf, src, t.TempDir())
+	require.NoError(t, err)
+	// Two posts with the same ID don't go in:
+	archive := editBackup(t, buf.Bytes(), func(m *backupManifest, d *tableDump) {
+		m.SchemaVersion = 4
+		d.Posts = append(d.Posts, d.Posts[0])
+	})
+
+	dst := openTestSQLite(t)
+	fillTestDB(t, dst)
+	err = withTransaction(dst, func(db Data) error {
+		a, err := db.author()
+		require.NoError(t, err)
+		a.TOTPSecret = rfcSecret
+		return db.updateAuthor(a)
+	})
+	require.NoError(t, err)
+	want, err := dst.dump()
+	require.NoError(t, err)
+	_, err = restoreBackup(bytes.NewReader(archive), dst, t.TempDir(), true)
+	require.ErrorContains(t, err, "restore tables")
+
+	mig, err := newMigrator(dst.db)
+	require.NoError(t, err)
+	version, err := mig.version()
+	require.NoError(t, err)
+	require.Equal(t, schemaVersion, version)
+	got, err := dst.dump()
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	a, err := dst.author()
+	require.NoError(t, err)
+	require.Equal(t, rfcSecret, a.TOTPSecret)
+}
@@ -0,0 +1,315 @@
+package rtfblog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+var (
+	// supportedEncodings lists content codings we can produce, in the order
+	// of our preference. It is also the order in which precompressed siblings
+	// of static files are looked up.
+	supportedEncodings = []string{encodingBrotli, encodingGzip}
+
+	encodingExts = map[string]string{
+		encodingBrotli: ".br",
+		encodingGzip:   ".gz",
+	}
+)
+
+// acceptableEncodings returns those of supportedEncodings that are
+// acceptable according to an Accept-Encoding header, best first.
+func acceptableEncodings(acceptEncoding string) []string {
+	qvalues := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.TrimSpace(name) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+			if err == nil {
+				q = parsed
+			}
+		}
+		qvalues[coding] = q
+	}
+	var encs []string
+	for _, enc := range supportedEncodings {
+		q, ok := qvalues[enc]
+		if !ok {
+			q, ok = qvalues["*"]
+		}
+		if ok && q > 0 {
+			encs = append(encs, enc)
+		}
+	}
+	// Stable sort keeps our own preference among equal q-values:
+	sort.SliceStable(encs, func(i, j int) bool {
+		return qvalue(qvalues, encs[i]) > qvalue(qvalues, encs[j])
+	})
+	return encs
+}
+
+func qvalue(qvalues map[string]float64, enc string) float64 {
+	if q, ok := qvalues[enc]; ok {
+		return q
+	}
+	return qvalues["*"]
+}
+
+// negotiateEncoding picks the best encoding for a response. Returns an empty
+// string if the response should be sent as is.
+func negotiateEncoding(acceptEncoding string) string {
+	encs := acceptableEncodings(acceptEncoding)
+	if len(encs) == 0 {
+		return ""
+	}
+	return encs[0]
+}
+
+func addVaryAcceptEncoding(header http.Header) {
+	for _, v := range header.Values("Vary") {
+		if strings.EqualFold(v, "Accept-Encoding") {
+			return
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
+
+// compressingHandler compresses responses of next with gzip or brotli,
+// whichever is preferred by the client. Responses smaller than minSize bytes,
+// those with content types not in types and those that are already encoded
+// are passed through untouched.
+type compressingHandler struct {
+	next    http.Handler
+	minSize int
+	types   map[string]bool
+}
+
+func newCompressingHandler(next http.Handler, minSize int, types []string) http.Handler {
+	typeSet := make(map[string]bool, len(types))
+	for _, t := range types {
+		typeSet[strings.ToLower(t)] = true
+	}
+	return &compressingHandler{
+		next:    next,
+		minSize: minSize,
+		types:   typeSet,
+	}
+}
+
+func (h *compressingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	enc := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+	if req.Method == "HEAD" || req.Header.Get("Range") != "" {
+		enc = ""
+	}
+	cw := &compressWriter{
+		ResponseWriter: w,
+		h:              h,
+		encoding:       enc,
+	}
+	defer cw.Close()
+	h.next.ServeHTTP(cw, req)
+}
+
+func (h *compressingHandler) compressible(header http.Header, status int) bool {
+	if status != http.StatusOK {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return h.types[mediaType]
+}
+
+// compressWriter holds back the first minSize bytes of the response to
+// decide whether it's worth compressing, and then either streams everything
+// through an encoder, or writes it out as is. Only a 200 with a body varies
+// by Accept-Encoding, the rest go out untouched.
+type compressWriter struct {
+	http.ResponseWriter
+	h        *compressingHandler
+	encoding string
+	status   int
+	buf      bytes.Buffer
+	decided  bool
+	encoder  encoder
+}
+
+// encoder is what both gzip.Writer and brotli.Writer are.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.decided {
+		return cw.writeThrough(b)
+	}
+	cw.buf.Write(b)
+	if cw.encoding == "" || cw.status != http.StatusOK || cw.buf.Len() >= cw.h.minSize {
+		if err := cw.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide sends the headers and flushes the held back bytes. It's called
+// either when enough data has been written, or when the handler is done.
+func (cw *compressWriter) decide() error {
+	cw.decided = true
+	header := cw.ResponseWriter.Header()
+	if cw.buf.Len() > 0 && header.Get("Content-Type") == "" {
+		// Do what net/http would do on the first write, we need to know the
+		// type before that:
+		header.Set("Content-Type", http.DetectContentType(cw.buf.Bytes()))
+	}
+	if cw.status == http.StatusOK && cw.buf.Len() > 0 {
+		addVaryAcceptEncoding(header)
+		if cw.encoding != "" && cw.buf.Len() >= cw.h.minSize && cw.h.compressible(header, cw.status) {
+			header.Set("Content-Encoding", cw.encoding)
+			header.Del("Content-Length")
+			header.Del("Accept-Ranges")
+			switch cw.encoding {
+			case encodingBrotli:
+				cw.encoder = brotli.NewWriter(cw.ResponseWriter)
+			case encodingGzip:
+				cw.encoder = gzip.NewWriter(cw.ResponseWriter)
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	_, err := cw.writeThrough(cw.buf.Bytes())
+	cw.buf.Reset()
+	return err
+}
+
+func (cw *compressWriter) writeThrough(b []byte) (int, error) {
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush sends what's been written so far, deciding on the encoding with
+// whatever is held back by then.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		if cw.decide() != nil {
+			return
+		}
+	}
+	if cw.encoder != nil && cw.encoder.Flush() != nil {
+		return
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Close() error {
+	if cw.status == 0 {
+		// Nothing was written at all, let the server produce an empty 200
+		return nil
+	}
+	if !cw.decided {
+		if err := cw.decide(); err != nil {
+			return err
+		}
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Close()
+	}
+	return nil
+}
+
+// precompressedFileServer serves a precompressed sibling (e.g. foo.css.br) of
+// the requested file if there is one and the client accepts its encoding.
+// Everything else is delegated to next. A sibling older than the file is
+// stale, like the embedded one of a file overridden on disk, and is left
+// alone.
+func precompressedFileServer(fs http.FileSystem, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		addVaryAcceptEncoding(w.Header())
+		if !strings.HasSuffix(req.URL.Path, "/") {
+			name := path.Clean("/" + req.URL.Path)
+			for _, enc := range acceptableEncodings(req.Header.Get("Accept-Encoding")) {
+				if servePrecompressed(w, req, fs, name, enc) {
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func servePrecompressed(w http.ResponseWriter, req *http.Request, fs http.FileSystem, name, enc string) bool {
+	f, err := fs.Open(name + encodingExts[enc])
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		return false
+	}
+	if orig, err := statFile(fs, name); err == nil && stat.ModTime().Before(orig.ModTime()) {
+		return false
+	}
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Encoding", enc)
+	http.ServeContent(w, req, name, stat.ModTime(), f)
+	return true
+}
+
+func statFile(fs http.FileSystem, name string) (os.FileInfo, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
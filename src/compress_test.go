@@ -0,0 +1,202 @@
+package rtfblog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	var tests = []struct {
+		header, expected string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"*;q=0.1, gzip;q=0.2", "gzip"},
+		{"GZIP", "gzip"},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.expected, negotiateEncoding(test.header), test.header)
+	}
+}
+
+func serveCompressed(h http.Handler, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func decompress(t *testing.T, enc string, body []byte) string {
+	var r io.Reader
+	switch enc {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		r = zr
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	default:
+		return string(body)
+	}
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestCompressingHandler(t *testing.T) {
+	bigPage := "<!doctype html><html>" + strings.Repeat("blog ", 500) + "</html>"
+	var tests = []struct {
+		body, ctype, acceptEncoding, expectedEncoding string
+	}{
+		{bigPage, "", "gzip", "gzip"},
+		{bigPage, "", "gzip, br", "br"},
+		{bigPage, "", "", ""},
+		{"<p>tiny</p>", "", "gzip", ""},
+		{bigPage, "image/png", "gzip", ""},
+		{bigPage, "text/css; charset=utf-8", "br", "br"},
+	}
+	for _, test := range tests {
+		h := newCompressingHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if test.ctype != "" {
+				w.Header().Set("Content-Type", test.ctype)
+			}
+			// Write in small pieces to exercise the threshold logic:
+			for i := 0; i < len(test.body); i += 100 {
+				end := min(i+100, len(test.body))
+				w.Write([]byte(test.body[i:end]))
+			}
+		}), 1024, hardcodedConf().Server.CompressTypes)
+		rec := serveCompressed(h, test.acceptEncoding)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, test.expectedEncoding, rec.Header().Get("Content-Encoding"))
+		require.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+		require.Equal(t, test.body, decompress(t, test.expectedEncoding, rec.Body.Bytes()))
+	}
+}
+
+func TestCompressingHandlerKeepsErrorStatus(t *testing.T) {
+	h := newCompressingHandler(http.NotFoundHandler(), 0, []string{"text/plain"})
+	rec := serveCompressed(h, "gzip")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Empty(t, rec.Header().Get("Content-Encoding"))
+	mustContain(t, rec.Body.String(), "404 page not found")
+}
+
+func TestCompressingHandlerLeavesBodylessAlone(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"204": func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		},
+		"304": func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusNotModified)
+		},
+		"redirect": func(w http.ResponseWriter, req *http.Request) {
+			http.Redirect(w, req, "/elsewhere", http.StatusSeeOther)
+		},
+		"empty 200": func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusOK)
+		},
+	}
+	for name, f := range handlers {
+		h := newCompressingHandler(f, 0, []string{"text/html"})
+		rec := serveCompressed(h, "gzip")
+		require.Empty(t, rec.Header().Get("Content-Encoding"), name)
+		require.Empty(t, rec.Header().Get("Vary"), name)
+	}
+}
+
+func TestCompressingHandlerFlush(t *testing.T) {
+	chunk := strings.Repeat("blog ", 300)
+	flushed := make(chan string)
+	h := newCompressingHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(chunk))
+		w.(http.Flusher).Flush()
+		<-flushed
+		w.Write([]byte(chunk))
+	}), 1024, []string{"text/plain"})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	// The first chunk arrives before the handler is done:
+	zr, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	first := make([]byte, len(chunk))
+	_, err = io.ReadFull(zr, first)
+	require.NoError(t, err)
+	require.Equal(t, chunk, string(first))
+	close(flushed)
+	rest, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, chunk, string(rest))
+}
+
+func TestPrecompressedFileServer(t *testing.T) {
+	dir := t.TempDir()
+	css := strings.Repeat("body { color: red; }\n", 100)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.css"), []byte(css), 0644))
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(css))
+	zw.Close()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.css.gz"), gz.Bytes(), 0644))
+	fs := http.Dir(dir)
+	h := newCompressingHandler(precompressedFileServer(fs, http.FileServer(fs)), 10, []string{"text/css"})
+
+	var tests = []struct {
+		acceptEncoding, expectedEncoding string
+	}{
+		{"gzip", "gzip"},
+		{"br, gzip", "gzip"}, // no .br sibling, but gzip is acceptable too
+		{"br", "br"},         // compressed on the fly
+		{"", ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/main.css", nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, test.expectedEncoding, rec.Header().Get("Content-Encoding"), test.acceptEncoding)
+		mustContain(t, rec.Header().Get("Content-Type"), "text/css")
+		require.Equal(t, []string{"Accept-Encoding"}, rec.Header().Values("Vary"))
+		require.Equal(t, css, decompress(t, test.expectedEncoding, rec.Body.Bytes()))
+	}
+
+	// A sibling older than the file is not served:
+	newCSS := strings.Repeat("body { color: blue; }\n", 100)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.css"), []byte(newCSS), 0644))
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "main.css.gz"), old, old))
+	req := httptest.NewRequest("GET", "/main.css", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, newCSS, decompress(t, "gzip", rec.Body.Bytes()))
+}
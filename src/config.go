@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -28,6 +29,100 @@ type Server struct {
 	Log          string
 	LogSQL       bool   `yaml:"log_sql"`
 	UploadsRoot  string `yaml:"uploads_root"`
+
+	// CookieKeys sign and encrypt the session cookie. The first pair is
+	// used for new cookies, the rest only to read the old ones, so that the
+	// keys can be rotated without logging anyone out. CookieSecret is the
+	// signing key of the configs from before CookieKeys, it's read with as
+	// the last one, unless it's the default.
+	CookieKeys []CookieKey `yaml:"cookie_keys"`
+
+	// Production refuses to start with the settings that are only good for
+	// trying the blog out, like the default cookie secret.
+	Production bool
+
+	// PageCacheSize is the max number of rendered pages kept in memory for
+	// anonymous readers. Zero disables the page cache.
+	PageCacheSize int `yaml:"page_cache_size"`
+
+	// Compress enables gzip/brotli compression of responses that are at least
+	// CompressMinSize bytes long and have one of CompressTypes content types.
+	Compress        bool     `yaml:"compress"`
+	CompressMinSize int      `yaml:"compress_min_size"`
+	CompressTypes   []string `yaml:"compress_types"`
+
+	// BackupDir enables scheduled backups: every BackupInterval a backup is
+	// written there, and all but the BackupKeep latest ones get removed. Zero
+	// BackupKeep keeps them all.
+	BackupDir      string        `yaml:"backup_dir"`
+	BackupInterval time.Duration `yaml:"backup_interval"`
+	BackupKeep     int           `yaml:"backup_keep"`
+
+	// SQLite tuning, only used when the DB is an SQLite file.
+	// SQLiteMaintenanceInterval is how often to run PRAGMA optimize and
+	// VACUUM, zero disables that.
+	SQLiteJournalMode         string        `yaml:"sqlite_journal_mode"`
+	SQLiteBusyTimeout         time.Duration `yaml:"sqlite_busy_timeout"`
+	SQLiteMaintenanceInterval time.Duration `yaml:"sqlite_maintenance_interval"`
+
+	// Connection pool of Postgres and MySQL. Zero DBMaxOpenConns and
+	// DBConnMaxLifetime mean no limit.
+	DBMaxOpenConns    int           `yaml:"db_max_open_conns"`
+	DBMaxIdleConns    int           `yaml:"db_max_idle_conns"`
+	DBConnMaxLifetime time.Duration `yaml:"db_conn_max_lifetime"`
+
+	// SocketMode is the permissions of the unix sockets, when Port or
+	// TLSPort is one, like unix:/run/rtfblog.sock.
+	SocketMode os.FileMode `yaml:"socket_mode"`
+
+	// BaseURL is the absolute URL the blog is reached at, like
+	// https://blog.example.com. It's used in feeds, emails and redirects,
+	// when empty the URL is taken from the request. The forwarding headers
+	// are only believed when the request comes from TrustedProxies, which
+	// are IP addresses or CIDR ranges.
+	BaseURL        string   `yaml:"base_url"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// Limits of the HTTP servers. Zero timeouts mean no limit.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+
+	// TLS policy of the HTTPS server. TLSMinVersion is "1.2" or "1.3", and
+	// TLSCiphers names the suites to allow for TLS 1.2, empty means Go's
+	// defaults. RedirectHTTPS makes plain HTTP redirect to HTTPS, and sends
+	// HSTS with HSTSMaxAge, unless it's zero.
+	TLSMinVersion string        `yaml:"tls_min_version"`
+	TLSCiphers    []string      `yaml:"tls_ciphers"`
+	RedirectHTTPS bool          `yaml:"redirect_https"`
+	HSTSMaxAge    time.Duration `yaml:"hsts_max_age"`
+
+	// ShutdownTimeout is how long to wait for the requests in flight and the
+	// queued notifications when stopping on SIGTERM or SIGINT.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// Login throttling. After a few free attempts, each failed login from an
+	// IP address, or for a user name, doubles the wait before the next one.
+	// Every LoginMaxFailures failures lock the login out for LoginLockout.
+	// The failures are kept in LoginThrottleFile over restarts, if it's set.
+	LoginMaxFailures  int           `yaml:"login_max_failures"`
+	LoginLockout      time.Duration `yaml:"login_lockout"`
+	LoginThrottleFile string        `yaml:"login_throttle_file"`
+
+	// Sessions expire once not seen for SessionIdleTimeout, or once
+	// SessionMaxAge old, whichever comes first. Zero means no limit.
+	SessionIdleTimeout time.Duration `yaml:"session_idle_timeout"`
+	SessionMaxAge      time.Duration `yaml:"session_max_age"`
+}
+
+// CookieKey is a pair of base64 encoded keys, generated with
+// --gen-cookie-key. HashKey signs the cookie, BlockKey encrypts it with AES,
+// so it's 16, 24 or 32 bytes long.
+type CookieKey struct {
+	HashKey  string `yaml:"hash_key"`
+	BlockKey string `yaml:"block_key"`
 }
 
 type Notifications struct {
@@ -58,9 +153,55 @@ func hardcodedConf() Config {
 			StaticDir:    "static",
 			UploadsRoot:  "build/uploads",
 			Port:         ":8080",
+			SocketMode:   0660,
 			CookieSecret: defaultCookieSecret,
 			Log:          "server.log",
 			Favicon:      "rtfb.png",
+
+			PageCacheSize: 512,
+
+			Compress:        true,
+			CompressMinSize: 1024,
+			CompressTypes: []string{
+				"text/html",
+				"text/css",
+				"text/plain",
+				"text/xml",
+				"text/javascript",
+				"application/javascript",
+				"application/json",
+				"application/rss+xml",
+				"application/xml",
+				"image/svg+xml",
+			},
+
+			BackupInterval: 24 * time.Hour,
+			BackupKeep:     7,
+
+			SQLiteJournalMode:         "wal",
+			SQLiteBusyTimeout:         5 * time.Second,
+			SQLiteMaintenanceInterval: 24 * time.Hour,
+
+			DBMaxOpenConns:    20,
+			DBMaxIdleConns:    5,
+			DBConnMaxLifetime: 30 * time.Minute,
+
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       time.Minute,
+			WriteTimeout:      2 * time.Minute,
+			IdleTimeout:       2 * time.Minute,
+			MaxHeaderBytes:    64 << 10,
+
+			TLSMinVersion: "1.2",
+			HSTSMaxAge:    365 * 24 * time.Hour,
+
+			ShutdownTimeout: 30 * time.Second,
+
+			LoginMaxFailures: 10,
+			LoginLockout:     15 * time.Minute,
+
+			SessionIdleTimeout: 7 * 24 * time.Hour,
+			SessionMaxAge:      30 * 24 * time.Hour,
 		},
 		Notifications{
 			SendEmail: false,
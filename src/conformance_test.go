@@ -0,0 +1,581 @@
+package rtfblog
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// conformanceTests are the scenarios every Data implementation has to go
+// through the same way. Each of them starts with an empty blog.
+var conformanceTests = []struct {
+	name string
+	test func(t *testing.T, db Data)
+}{
+	{"Empty", testConformanceEmpty},
+	{"WritesNeedTransaction", testConformanceWritesNeedTransaction},
+	{"Author", testConformanceAuthor},
+	{"Posts", testConformancePosts},
+	{"HiddenPosts", testConformanceHiddenPosts},
+	{"UpdatePost", testConformanceUpdatePost},
+	{"Tags", testConformanceTags},
+	{"Comments", testConformanceComments},
+	{"DeletePost", testConformanceDeletePost},
+	{"Rollback", testConformanceRollback},
+	{"PanicRollsBack", testConformancePanicRollsBack},
+	{"DumpRestore", testConformanceDumpRestore},
+	{"ConcurrentWriters", testConformanceConcurrentWriters},
+	{"Sessions", testConformanceSessions},
+}
+
+// runConformance runs conformanceTests against the empty databases that
+// open returns.
+func runConformance(t *testing.T, open func(t *testing.T) Data) {
+	for _, test := range conformanceTests {
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, open(t))
+		})
+	}
+}
+
+func TestDataConformance(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		runConformance(t, func(t *testing.T) Data {
+			return newMemData()
+		})
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		runConformance(t, func(t *testing.T) Data {
+			return openTestSQLite(t)
+		})
+	})
+}
+
+// addPost adds a post by the author, who has to exist, dated at the given
+// second.
+func addPost(t *testing.T, db Data, url string, date int64, hidden bool, tags ...string) int64 {
+	var id int64
+	err := withTransaction(db, func(db Data) error {
+		var err error
+		id, err = InsertOrUpdatePost(db, &EntryTable{
+			EntryLink: EntryLink{Title: "Post " + url, URL: url, Hidden: hidden},
+			UnixDate:  date,
+			RawBody:   "*Body* of " + url,
+		})
+		if err != nil {
+			return err
+		}
+		var postTags []*Tag
+		for _, tag := range tags {
+			postTags = append(postTags, &Tag{Name: tag})
+		}
+		return db.updateTags(postTags, id)
+	})
+	require.NoError(t, err)
+	return id
+}
+
+func addAuthor(t *testing.T, db Data) {
+	_, err := InsertOrUpdateAuthor(db, &Author{UserName: "testuser", FullName: "Test User"})
+	require.NoError(t, err)
+}
+
+func linkURLs(links []EntryLink) []string {
+	var urls []string
+	for _, l := range links {
+		urls = append(urls, l.URL)
+	}
+	return urls
+}
+
+func entryURLs(posts []*Entry) []string {
+	var urls []string
+	for _, p := range posts {
+		urls = append(urls, p.URL)
+	}
+	return urls
+}
+
+func testConformanceEmpty(t *testing.T, db Data) {
+	_, err := db.author()
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = db.post("nope", true)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = db.postID("nope")
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = db.commenterID(&Commenter{Name: "Nobody"})
+	require.ErrorIs(t, err, ErrNotFound)
+	n, err := db.numPosts(true)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	posts, err := db.posts(-1, -1, true)
+	require.NoError(t, err)
+	require.Empty(t, posts)
+	titles, err := db.titles(10, true)
+	require.NoError(t, err)
+	require.Empty(t, titles)
+	comments, err := db.allComments()
+	require.NoError(t, err)
+	require.Empty(t, comments)
+	tags, err := db.queryAllTags()
+	require.NoError(t, err)
+	require.Empty(t, tags)
+	// Deleting what's not there is not an error:
+	require.NoError(t, db.deletePost("nope"))
+	require.NoError(t, db.deleteComment("1"))
+	require.NoError(t, db.deleteAuthor(1))
+}
+
+func testConformanceWritesNeedTransaction(t *testing.T, db Data) {
+	_, err := db.insertAuthor(&Author{})
+	require.ErrorContains(t, err, "within transaction")
+	_, err = db.insertPost(&EntryTable{})
+	require.ErrorContains(t, err, "within transaction")
+	_, err = db.insertCommenter(&Commenter{})
+	require.ErrorContains(t, err, "within transaction")
+	_, err = db.insertComment(&CommentTable{})
+	require.ErrorContains(t, err, "within transaction")
+	require.ErrorContains(t, db.updateAuthor(&Author{}), "within transaction")
+	require.ErrorContains(t, db.updatePost(&EntryTable{}), "within transaction")
+	require.ErrorContains(t, db.updateTags(nil, 1), "within transaction")
+	require.ErrorContains(t, db.restore(&tableDump{}), "within transaction")
+}
+
+func testConformanceAuthor(t *testing.T, db Data) {
+	var id int64
+	err := withTransaction(db, func(db Data) error {
+		var err error
+		id, err = InsertOrUpdateAuthor(db, &Author{UserName: "joe", FullName: "Joe"})
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), id)
+	err = withTransaction(db, func(db Data) error {
+		var err error
+		id, err = InsertOrUpdateAuthor(db, &Author{UserName: "joe", FullName: "Zoe", Email: "z@b.lt"})
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), id)
+	a, err := db.author()
+	require.NoError(t, err)
+	require.Equal(t, &Author{ID: 1, UserName: "joe", FullName: "Zoe", Email: "z@b.lt"}, a)
+	a.TOTPSecret, a.RecoveryCodes = "GEZDGNBV", "hash1 hash2"
+	require.NoError(t, withTransaction(db, func(db Data) error {
+		return db.updateAuthor(a)
+	}))
+	a, err = db.author()
+	require.NoError(t, err)
+	require.Equal(t, "GEZDGNBV", a.TOTPSecret)
+	require.Equal(t, "hash1 hash2", a.RecoveryCodes)
+	require.NoError(t, db.deleteAuthor(1))
+	_, err = db.author()
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func testConformancePosts(t *testing.T, db Data) {
+	require.NoError(t, withTransaction(db, func(db Data) error {
+		addAuthor(t, db)
+		return nil
+	}))
+	for i := 1; i <= 7; i++ {
+		id := addPost(t, db, fmt.Sprintf("p%d", i), int64(i*86400), false, "go")
+		require.Equal(t, int64(i), id)
+	}
+	n, err := db.numPosts(false)
+	require.NoError(t, err)
+	require.Equal(t, 7, n)
+	posts, err := db.posts(PostsPerPage, 0, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"p7", "p6", "p5", "p4", "p3"}, entryURLs(posts))
+	posts, err = db.posts(PostsPerPage, PostsPerPage, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"p2", "p1"}, entryURLs(posts))
+	titles, err := db.titles(3, false)
+	require.NoError(t, err)
+	require.Equal(t, []EntryLink{
+		{Title: "Post p7", URL: "p7"}, {Title: "Post p6", URL: "p6"}, {Title: "Post p5", URL: "p5"},
+	}, titles)
+
+	p, err := db.post("p2", false)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), p.ID)
+	require.Equal(t, "Post p2", p.Title)
+	require.Equal(t, "testuser", p.Author)
+	require.Equal(t, int64(2*86400), p.UnixDate)
+	require.Equal(t, time.Unix(2*86400, 0).Format("2006-01-02"), p.Date)
+	require.Equal(t, "*Body* of p2", p.RawBody)
+	require.Contains(t, string(p.Body), "<em>Body</em> of p2")
+	require.Equal(t, []*Tag{{Name: "go"}}, p.Tags)
+	require.Empty(t, p.Comments)
+	id, err := db.postID("p2")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), id)
+}
+
+func testConformanceHiddenPosts(t *testing.T, db Data) {
+	require.NoError(t, withTransaction(db, func(db Data) error {
+		addAuthor(t, db)
+		return nil
+	}))
+	addPost(t, db, "shown", 100, false, "go")
+	addPost(t, db, "hidden", 200, true, "go")
+	for _, includeHidden := range []bool{false, true} {
+		want := []string{"shown"}
+		if includeHidden {
+			want = []string{"hidden", "shown"}
+		}
+		n, err := db.numPosts(includeHidden)
+		require.NoError(t, err)
+		require.Equal(t, len(want), n)
+		posts, err := db.posts(-1, -1, includeHidden)
+		require.NoError(t, err)
+		require.Equal(t, want, entryURLs(posts))
+		titles, err := db.titles(10, includeHidden)
+		require.NoError(t, err)
+		require.Equal(t, want, linkURLs(titles))
+		titles, err = db.titlesByTag("go", includeHidden)
+		require.NoError(t, err)
+		require.Equal(t, want, linkURLs(titles))
+	}
+	_, err := db.post("hidden", false)
+	require.ErrorIs(t, err, ErrNotFound)
+	p, err := db.post("hidden", true)
+	require.NoError(t, err)
+	require.True(t, p.Hidden)
+	// Comments go to hidden posts as well:
+	id, err := db.postID("hidden")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), id)
+}
+
+func testConformanceUpdatePost(t *testing.T, db Data) {
+	require.NoError(t, withTransaction(db, func(db Data) error {
+		addAuthor(t, db)
+		return nil
+	}))
+	addPost(t, db, "post", 1000, false)
+	err := withTransaction(db, func(db Data) error {
+		id, err := InsertOrUpdatePost(db, &EntryTable{
+			EntryLink: EntryLink{Title: "New title", URL: "post", Hidden: true},
+			RawBody:   "New body",
+		})
+		require.Equal(t, int64(1), id)
+		return err
+	})
+	require.NoError(t, err)
+	p, err := db.post("post", true)
+	require.NoError(t, err)
+	require.Equal(t, "New title", p.Title)
+	require.Equal(t, "New body", p.RawBody)
+	require.True(t, p.Hidden)
+	require.Equal(t, int64(1000), p.UnixDate, "the date is kept")
+	n, err := db.numPosts(true)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	err = withTransaction(db, func(db Data) error {
+		_, err := InsertOrUpdatePost(db, &EntryTable{
+			EntryLink: EntryLink{Title: "Imported", URL: "post"},
+			ImportID:  "wxr:1",
+		})
+		return err
+	})
+	require.NoError(t, err)
+	err = withTransaction(db, func(db Data) error {
+		_, err := InsertOrUpdatePost(db, &EntryTable{
+			EntryLink: EntryLink{Title: "Edited", URL: "post"},
+		})
+		return err
+	})
+	require.NoError(t, err)
+	p, err = db.post("post", true)
+	require.NoError(t, err)
+	require.Equal(t, "wxr:1", p.ImportID, "the import ID is kept")
+}
+
+func testConformanceTags(t *testing.T, db Data) {
+	require.NoError(t, withTransaction(db, func(db Data) error {
+		addAuthor(t, db)
+		return nil
+	}))
+	addPost(t, db, "a", 100, false, "go", "sql")
+	addPost(t, db, "b", 200, false, "go")
+	tags, err := db.queryAllTags()
+	require.NoError(t, err)
+	require.Equal(t, []*Tag{{ID: 1, Name: "go"}, {ID: 2, Name: "sql"}}, tags)
+	titles, err := db.titlesByTag("go", false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "a"}, linkURLs(titles))
+	titles, err = db.titlesByTag("nope", false)
+	require.NoError(t, err)
+	require.Empty(t, titles)
+
+	// The tags of a post get replaced, the existing ones are reused:
+	err = withTransaction(db, func(db Data) error {
+		return db.updateTags([]*Tag{{Name: "sql"}, {Name: "memory"}}, 1)
+	})
+	require.NoError(t, err)
+	p, err := db.post("a", false)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []*Tag{{Name: "sql"}, {Name: "memory"}}, p.Tags)
+	tags, err = db.queryAllTags()
+	require.NoError(t, err)
+	require.Len(t, tags, 3)
+	titles, err = db.titlesByTag("go", false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, linkURLs(titles))
+}
+
+func testConformanceComments(t *testing.T, db Data) {
+	require.NoError(t, withTransaction(db, func(db Data) error {
+		addAuthor(t, db)
+		return nil
+	}))
+	addPost(t, db, "post", 100, false)
+	joe := &Commenter{Name: "Joe", Email: "joe@example.com", Website: "http://joe"}
+	var joeID int64
+	err := withTransaction(db, func(db Data) error {
+		var err error
+		joeID, err = db.insertCommenter(joe)
+		if err != nil {
+			return err
+		}
+		for i, body := range []string{"*Second*", "First"} {
+			_, err := db.insertComment(&CommentTable{
+				CommenterID: joeID,
+				PostID:      1,
+				RawBody:     body,
+				Timestamp:   int64(2000 - i*1000),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	id, err := db.commenterID(&Commenter{Name: "Joe", Email: "joe@example.com", Website: "http://joe"})
+	require.NoError(t, err)
+	require.Equal(t, joeID, id)
+	_, err = db.commenterID(&Commenter{Name: "Joe"})
+	require.ErrorIs(t, err, ErrNotFound)
+	url, err := PublishComment(db, 1, joeID, "Third")
+	require.NoError(t, err)
+	require.Equal(t, "#comment-3", url)
+
+	p, err := db.post("post", false)
+	require.NoError(t, err)
+	require.Len(t, p.Comments, 3)
+	c := p.Comments[0]
+	require.Equal(t, "First", c.RawBody)
+	require.Equal(t, int64(2), c.CommentID)
+	require.Equal(t, joeID, c.CommenterID)
+	require.Equal(t, "Joe", c.Name)
+	require.Equal(t, "http://joe", c.Website)
+	require.Equal(t, md5Hash("joe@example.com"), c.EmailHash)
+	require.Equal(t, time.Unix(1000, 0).Format("2006-01-02 15:04"), c.Time)
+	require.Contains(t, string(p.Comments[1].Body), "<em>Second</em>")
+
+	all, err := db.allComments()
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	require.Equal(t, "Third", all[0].RawBody)
+	require.Equal(t, int64(1000), all[2].Timestamp)
+	require.Equal(t, "Post post", all[2].Title)
+	require.Equal(t, "post", all[2].URL)
+	require.Equal(t, "Joe", all[2].Name)
+
+	require.NoError(t, db.updateComment("1", "Edited"))
+	require.NoError(t, db.deleteComment("2"))
+	all, err = db.allComments()
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	require.Equal(t, "Edited", all[1].RawBody)
+	require.Equal(t, int64(1), all[1].CommentID)
+}
+
+func testConformanceDeletePost(t *testing.T, db Data) {
+	require.NoError(t, withTransaction(db, func(db Data) error {
+		addAuthor(t, db)
+		return nil
+	}))
+	addPost(t, db, "gone", 100, false, "go")
+	addPost(t, db, "kept", 200, false, "go")
+	_, err := PublishCommentAndCommenter(db, 1, &Commenter{Name: "N"}, "On the gone one")
+	require.NoError(t, err)
+	_, err = PublishCommentAndCommenter(db, 2, &Commenter{Name: "N"}, "On the kept one")
+	require.NoError(t, err)
+	require.NoError(t, db.deletePost("gone"))
+	_, err = db.post("gone", true)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = db.postID("gone")
+	require.ErrorIs(t, err, ErrNotFound)
+	all, err := db.allComments()
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	require.Equal(t, "kept", all[0].URL)
+	titles, err := db.titlesByTag("go", true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"kept"}, linkURLs(titles))
+}
+
+func testConformanceRollback(t *testing.T, db Data) {
+	failure := errors.New("changed my mind")
+	err := withTransaction(db, func(db Data) error {
+		if _, err := db.insertAuthor(&Author{UserName: "joe"}); err != nil {
+			return err
+		}
+		return failure
+	})
+	require.ErrorIs(t, err, failure)
+	_, err = db.author()
+	require.ErrorIs(t, err, ErrNotFound)
+	// Only committed writes are seen:
+	require.NoError(t, db.begin())
+	_, err = db.insertAuthor(&Author{UserName: "joe"})
+	require.NoError(t, err)
+	_, err = db.author()
+	require.ErrorIs(t, err, ErrNotFound)
+	db.commit()
+	a, err := db.author()
+	require.NoError(t, err)
+	require.Equal(t, "joe", a.UserName)
+}
+
+func testConformancePanicRollsBack(t *testing.T, db Data) {
+	require.Panics(t, func() {
+		withTransaction(db, func(db Data) error {
+			if _, err := db.insertAuthor(&Author{UserName: "joe"}); err != nil {
+				return err
+			}
+			panic("bug")
+		})
+	})
+	_, err := db.author()
+	require.ErrorIs(t, err, ErrNotFound)
+	// The next transaction does not wait forever for the lock:
+	done := make(chan error)
+	go func() {
+		done <- withTransaction(db, func(db Data) error {
+			_, err := db.insertAuthor(&Author{UserName: "joe"})
+			return err
+		})
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the transaction lock was not released")
+	}
+}
+
+func testConformanceDumpRestore(t *testing.T, db Data) {
+	fillTestDB(t, db)
+	d, err := db.dump()
+	require.NoError(t, err)
+	require.Len(t, d.Posts, 2)
+	require.Len(t, d.Tags, 3)
+	require.Len(t, d.TagMap, 4)
+	require.Len(t, d.Comments, 1)
+	require.NoError(t, withTransaction(db, func(db Data) error {
+		return db.restore(&tableDump{})
+	}))
+	n, err := db.numPosts(true)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.NoError(t, withTransaction(db, func(db Data) error {
+		return db.restore(d)
+	}))
+	restored, err := db.dump()
+	require.NoError(t, err)
+	require.Equal(t, d, restored)
+	// New rows get IDs after the restored ones:
+	_, err = PublishCommentAndCommenter(db, 2, &Commenter{Name: "Later"}, "After the restore")
+	require.NoError(t, err)
+	all, err := db.allComments()
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+}
+
+func testConformanceConcurrentWriters(t *testing.T, db Data) {
+	fillTestDB(t, db)
+	const numWriters = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*numWriters)
+	for i := 0; i < numWriters; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			commenter := &Commenter{Name: fmt.Sprintf("Commenter %d", i)}
+			_, err := PublishCommentAndCommenter(db, 2, commenter, "Concurrent")
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := db.posts(-1, -1, true)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	all, err := db.allComments()
+	require.NoError(t, err)
+	require.Len(t, all, numWriters+1)
+}
+
+func testConformanceSessions(t *testing.T, db Data) {
+	_, err := db.session("nope")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.ErrorIs(t, db.updateSession(&SessionTable{ID: "nope"}), ErrNotFound)
+	for _, s := range []SessionTable{
+		{ID: "a", Admin: true, IP: "1.2.3.4", UserAgent: "curl", Created: 10, LastSeen: 30},
+		{ID: "b", Admin: true, Created: 20, LastSeen: 50},
+		{ID: "c", Data: "flashes", Created: 5, LastSeen: 60},
+	} {
+		require.NoError(t, db.insertSession(&s))
+	}
+	require.Error(t, db.insertSession(&SessionTable{ID: "a"}))
+	s, err := db.session("a")
+	require.NoError(t, err)
+	require.Equal(t, &SessionTable{ID: "a", Admin: true, IP: "1.2.3.4", UserAgent: "curl",
+		Created: 10, LastSeen: 30}, s)
+	s.Data, s.IP, s.LastSeen, s.Created = "values", "5.6.7.8", 70, 1
+	require.NoError(t, db.updateSession(s))
+	s, err = db.session("a")
+	require.NoError(t, err)
+	require.Equal(t, &SessionTable{ID: "a", Data: "values", Admin: true, IP: "5.6.7.8",
+		UserAgent: "curl", Created: 10, LastSeen: 70}, s, "created never changes")
+
+	admins, err := db.adminSessions()
+	require.NoError(t, err)
+	require.Len(t, admins, 2)
+	require.Equal(t, "a", admins[0].ID)
+	require.Equal(t, "b", admins[1].ID)
+
+	require.NoError(t, db.deleteStaleSessions(55, 8))
+	_, err = db.session("b")
+	require.ErrorIs(t, err, ErrNotFound, "idle")
+	_, err = db.session("c")
+	require.ErrorIs(t, err, ErrNotFound, "too old")
+	_, err = db.session("a")
+	require.NoError(t, err)
+	require.NoError(t, db.deleteStaleSessions(0, 0))
+	_, err = db.session("a")
+	require.NoError(t, err)
+
+	require.NoError(t, db.insertSession(&SessionTable{ID: "d"}))
+	require.NoError(t, db.deleteSessions("d"))
+	_, err = db.session("a")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, db.deleteSession("d"))
+	_, err = db.session("d")
+	require.ErrorIs(t, err, ErrNotFound)
+}
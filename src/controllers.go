@@ -21,14 +21,17 @@ type globalContext struct {
 	assets *assets.Bin
 	Store  sessions.Store
 	Log    *slog.Logger
+	pages  *pageCache
 }
 
-func newGlobalContext(db Data, assets *assets.Bin, cookieSecret string, log *slog.Logger) globalContext {
+// newGlobalContext makes the context shared by all the handlers. keyPairs
+// are the cookie keys, see cookieKeyPairs.
+func newGlobalContext(db Data, assets *assets.Bin, keyPairs [][]byte, log *slog.Logger) globalContext {
 	return globalContext{
 		Router: pat.New(),
 		Db:     db,
 		assets: assets,
-		Store:  sessions.NewCookieStore([]byte(cookieSecret)),
+		Store:  newDBStore(db, keyPairs...),
 		Log:    log,
 	}
 }
@@ -90,7 +93,7 @@ func (h handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	buf := new(httpbuf.Buffer)
 	err = h.h(buf, req, ctx)
 	if err != nil {
-		h.internalError(ctx, w, req, err, "Error in handler")
+		h.handlerError(ctx, w, req, err)
 		return
 	}
 	//save the session
@@ -101,6 +104,18 @@ func (h handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	buf.Apply(w)
 }
 
+// handlerError responds with the status that matches the kind of err. Only
+// the errors of no known kind count as internal ones.
+func (h handler) handlerError(c *Context, w http.ResponseWriter, req *http.Request, err error) error {
+	status := httpStatus(err)
+	if status == http.StatusInternalServerError {
+		return h.internalError(c, w, req, err, "Error in handler")
+	}
+	h.log.Info("Error in handler", E(err), slog.Int("status", status),
+		slog.String("path", req.URL.Path))
+	return performStatus(c, w, req, status)
+}
+
 func (h handler) internalError(c *Context, w http.ResponseWriter, req *http.Request, err error, prefix string) error {
 	h.mets.numInternalErrors.Inc()
 	h.log.Error(prefix, E(err))
@@ -110,6 +125,7 @@ func (h handler) internalError(c *Context, w http.ResponseWriter, req *http.Requ
 // PerformStatus runs the passed in status on the request and calls the appropriate block
 func performStatus(c *Context, w http.ResponseWriter, req *http.Request, status int) error {
 	if status == 404 || status == 403 {
+		w.WriteHeader(status)
 		html := fmt.Sprintf("%d.html", status)
 		return tmpl(c, html).Execute(w, nil)
 	}
@@ -117,6 +133,7 @@ func performStatus(c *Context, w http.ResponseWriter, req *http.Request, status
 }
 
 func performSimpleStatus(w http.ResponseWriter, status int) error {
+	w.WriteHeader(status)
 	fmt.Fprintf(w, L10n("HTTP Error %d\n"), status)
 	return nil
 }
@@ -0,0 +1,94 @@
+package rtfblog
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+const (
+	// The lengths of the keys --gen-cookie-key makes. The hash key is for
+	// HMAC-SHA256, the block key for AES-256.
+	cookieHashKeyLen  = 64
+	cookieBlockKeyLen = 32
+	// minCookieHashKeyLen is the shortest hash key taken from the config.
+	minCookieHashKeyLen = 32
+)
+
+var errDefaultCookieSecret = errors.New("the default cookie secret is not fit for production, " +
+	"generate cookie_keys with rtfblog --gen-cookie-key")
+
+// usesDefaultCookieSecret tells whether the cookie is signed by the secret
+// everyone knows.
+func usesDefaultCookieSecret(conf *Server) bool {
+	return len(conf.CookieKeys) == 0 && conf.CookieSecret == defaultCookieSecret
+}
+
+// cookieKeyPairs decodes the keys of conf to hash and block key pairs, for
+// securecookie.CodecsFromPairs. The pair of CookieSecret has no block key.
+func cookieKeyPairs(conf *Server) ([][]byte, error) {
+	var pairs [][]byte
+	for i, k := range conf.CookieKeys {
+		hashKey, err := base64.StdEncoding.DecodeString(k.HashKey)
+		if err != nil {
+			return nil, fmt.Errorf("cookie key %d: hash_key: %w", i+1, err)
+		}
+		if len(hashKey) < minCookieHashKeyLen {
+			return nil, fmt.Errorf("cookie key %d: hash_key is %d bytes long, needs at least %d",
+				i+1, len(hashKey), minCookieHashKeyLen)
+		}
+		blockKey, err := base64.StdEncoding.DecodeString(k.BlockKey)
+		if err != nil {
+			return nil, fmt.Errorf("cookie key %d: block_key: %w", i+1, err)
+		}
+		switch len(blockKey) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("cookie key %d: block_key is %d bytes long, needs 16, 24 or 32",
+				i+1, len(blockKey))
+		}
+		pairs = append(pairs, hashKey, blockKey)
+	}
+	if conf.CookieSecret != "" && (len(pairs) == 0 || conf.CookieSecret != defaultCookieSecret) {
+		pairs = append(pairs, []byte(conf.CookieSecret), nil)
+	}
+	if len(pairs) == 0 {
+		return nil, errors.New("neither cookie_keys nor cookie_secret is set")
+	}
+	return pairs, nil
+}
+
+// checkProduction refuses the settings that are not fit for production,
+// when conf says that's where the blog runs.
+func checkProduction(conf *Server) error {
+	if conf.Production && usesDefaultCookieSecret(conf) {
+		return errDefaultCookieSecret
+	}
+	return nil
+}
+
+func randomKey(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand: " + err.Error())
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func newCookieKey() CookieKey {
+	return CookieKey{
+		HashKey:  randomKey(cookieHashKeyLen),
+		BlockKey: randomKey(cookieBlockKeyLen),
+	}
+}
+
+// genCookieKey prints a new key pair, ready to be pasted into the config.
+func genCookieKey() {
+	k := newCookieKey()
+	fmt.Println(L10n("Put the new key first in cookie_keys. Keep the old ones after it for session_max_age, so that the sessions they signed keep working:"))
+	fmt.Println()
+	fmt.Println("    cookie_keys:")
+	fmt.Printf("        - hash_key: %s\n", k.HashKey)
+	fmt.Printf("          block_key: %s\n", k.BlockKey)
+}
@@ -0,0 +1,123 @@
+package rtfblog
+
+import (
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookieKeyPairs(t *testing.T) {
+	k1, k2 := newCookieKey(), newCookieKey()
+	pairs, err := cookieKeyPairs(&Server{CookieKeys: []CookieKey{k1, k2}, CookieSecret: "old secret"})
+	require.NoError(t, err)
+	require.Len(t, pairs, 6)
+	require.Len(t, pairs[0], cookieHashKeyLen)
+	require.Len(t, pairs[1], cookieBlockKeyLen)
+	require.Equal(t, k2.HashKey, base64.StdEncoding.EncodeToString(pairs[2]))
+	require.Equal(t, []byte("old secret"), pairs[4])
+	require.Nil(t, pairs[5])
+
+	// The default secret only counts without any keys:
+	pairs, err = cookieKeyPairs(&Server{CookieKeys: []CookieKey{k1}, CookieSecret: defaultCookieSecret})
+	require.NoError(t, err)
+	require.Len(t, pairs, 2)
+	pairs, err = cookieKeyPairs(&Server{CookieSecret: defaultCookieSecret})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte(defaultCookieSecret), nil}, pairs)
+
+	_, err = cookieKeyPairs(&Server{})
+	require.ErrorContains(t, err, "neither")
+	_, err = cookieKeyPairs(&Server{CookieKeys: []CookieKey{{HashKey: "not base64!", BlockKey: k1.BlockKey}}})
+	require.ErrorContains(t, err, "cookie key 1: hash_key")
+	_, err = cookieKeyPairs(&Server{CookieKeys: []CookieKey{k1, {HashKey: randomKey(16), BlockKey: k1.BlockKey}}})
+	require.ErrorContains(t, err, "cookie key 2: hash_key is 16 bytes long")
+	_, err = cookieKeyPairs(&Server{CookieKeys: []CookieKey{{HashKey: k1.HashKey, BlockKey: randomKey(20)}}})
+	require.ErrorContains(t, err, "block_key is 20 bytes long")
+}
+
+func TestCheckProduction(t *testing.T) {
+	conf := hardcodedConf().Server
+	require.True(t, usesDefaultCookieSecret(&conf))
+	require.NoError(t, checkProduction(&conf), "fine for trying it out")
+	conf.Production = true
+	require.ErrorIs(t, checkProduction(&conf), errDefaultCookieSecret)
+	conf.CookieKeys = []CookieKey{newCookieKey()}
+	require.False(t, usesDefaultCookieSecret(&conf))
+	require.NoError(t, checkProduction(&conf))
+}
+
+func TestCookieKeyRotation(t *testing.T) {
+	s := newLifecycleServer(t, slog.Default())
+	store := s.gctx.Store.(*dbStore)
+	oldKey, newKey := newCookieKey(), newCookieKey()
+	rotate := func(keys ...CookieKey) {
+		conf := *s.config()
+		conf.Server.CookieKeys = keys
+		conf.Server.CookieSecret = ""
+		if len(keys) == 0 {
+			conf.Server.CookieSecret = defaultCookieSecret
+		}
+		s.reload(conf)
+	}
+	// login makes a request with cookie, logging in if it's nil, and
+	// returns whether it's logged in, and the cookie it's answered with.
+	login := func(cookie *http.Cookie) (bool, *http.Cookie) {
+		req := httptest.NewRequest("GET", "/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		sess, err := store.New(req, "rtfblog")
+		require.NoError(t, err)
+		loggedIn := sess.Values["adminlogin"] == "yes"
+		if cookie == nil {
+			sess.Values["adminlogin"] = "yes"
+		}
+		w := httptest.NewRecorder()
+		require.NoError(t, store.Save(req, w, sess))
+		if cookies := w.Result().Cookies(); len(cookies) > 0 {
+			return loggedIn, cookies[0]
+		}
+		return loggedIn, nil
+	}
+
+	rotate(oldKey)
+	_, oldCookie := login(nil)
+	ok, _ := login(oldCookie)
+	require.True(t, ok)
+	// Encrypted, so that the signing key alone does not read it:
+	hashKey, err := base64.StdEncoding.DecodeString(oldKey.HashKey)
+	require.NoError(t, err)
+	var token string
+	require.Error(t, securecookie.New(hashKey, nil).Decode("rtfblog", oldCookie.Value, &token))
+
+	rotate(newKey, oldKey)
+	ok, newCookie := login(oldCookie)
+	require.True(t, ok, "the old key still reads")
+	require.NotEqual(t, oldCookie.Value, newCookie.Value, "the new key signs")
+
+	rotate(newKey)
+	ok, _ = login(newCookie)
+	require.True(t, ok)
+	ok, _ = login(oldCookie)
+	require.False(t, ok, "the old key is gone")
+
+	// Bad keys leave the current ones alone:
+	rotate(CookieKey{HashKey: "bad", BlockKey: "bad"})
+	ok, _ = login(newCookie)
+	require.True(t, ok)
+	require.Equal(t, []CookieKey{newKey}, s.config().Server.CookieKeys)
+
+	// So does the default secret in production:
+	conf := *s.config()
+	conf.Server.Production = true
+	s.setConfig(conf)
+	rotate()
+	ok, _ = login(newCookie)
+	require.True(t, ok)
+	require.Equal(t, []CookieKey{newKey}, s.config().Server.CookieKeys)
+}
@@ -0,0 +1,136 @@
+package rtfblog
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+)
+
+// copyStats reports what copyDB did.
+type copyStats struct {
+	rows     map[string]int
+	orphans  int
+	migrated bool
+}
+
+// dropOrphans removes the rows that refer to rows that are gone. SQLite does
+// not enforce foreign keys unless asked to, so deleting a post there leaves
+// its comments and tag mappings behind. They are never shown, but Postgres
+// would refuse to take them. Returns the number of rows dropped.
+func (d *tableDump) dropOrphans() int {
+	authors := map[int64]bool{}
+	for _, a := range d.Authors {
+		authors[a.ID] = true
+	}
+	before := len(d.Posts) + len(d.TagMap) + len(d.Comments)
+	d.Posts = slices.DeleteFunc(d.Posts, func(p EntryTable) bool {
+		return !authors[p.AuthorID]
+	})
+	posts := map[int64]bool{}
+	for _, p := range d.Posts {
+		posts[p.ID] = true
+	}
+	tags := map[int64]bool{}
+	for _, t := range d.Tags {
+		tags[t.ID] = true
+	}
+	commenters := map[int64]bool{}
+	for _, c := range d.Commenters {
+		commenters[c.ID] = true
+	}
+	d.TagMap = slices.DeleteFunc(d.TagMap, func(tm TagMap) bool {
+		return !posts[tm.EntryID] || !tags[tm.TagID]
+	})
+	d.Comments = slices.DeleteFunc(d.Comments, func(c CommentTable) bool {
+		return !posts[c.PostID] || !commenters[c.CommenterID]
+	})
+	return before - len(d.Posts) - len(d.TagMap) - len(d.Comments)
+}
+
+// verifyCopy compares the row counts and checksums of two dumps.
+func verifyCopy(want, got *tableDump) error {
+	wantSums, err := want.checksums()
+	if err != nil {
+		return err
+	}
+	gotSums, err := got.checksums()
+	if err != nil {
+		return err
+	}
+	wantRows, gotRows := want.rowCounts(), got.rowCounts()
+	for _, table := range slices.Sorted(maps.Keys(wantRows)) {
+		if wantRows[table] != gotRows[table] {
+			msg := "table %s: copied %d rows, but the destination has %d"
+			return fmt.Errorf(msg, table, wantRows[table], gotRows[table])
+		}
+		if wantSums[table] != gotSums[table] {
+			return fmt.Errorf("table %s: the copy differs from the source", table)
+		}
+	}
+	return nil
+}
+
+// copyDB copies every table from src to dst, keeping the IDs, so the two can
+// be of different dialects. The schema of src has to be up to date, while
+// dst gets migrated if it's not. Unless forced, dst has to be empty.
+func copyDB(src, dst *DbData, force bool) (copyStats, error) {
+	var stats copyStats
+	m, err := newMigrator(src.db)
+	if err != nil {
+		return stats, err
+	}
+	if _, _, err := m.checkSchema(false); err != nil {
+		return stats, fmt.Errorf("source: %w", err)
+	}
+	m, err = newMigrator(dst.db)
+	if err != nil {
+		return stats, err
+	}
+	from, to, err := m.checkSchema(true)
+	if err != nil {
+		return stats, fmt.Errorf("destination: %w", err)
+	}
+	stats.migrated = from != to
+	if !force {
+		empty, err := isEmptyDB(dst)
+		if err != nil {
+			return stats, fmt.Errorf("destination: %w", err)
+		}
+		if !empty {
+			return stats, errors.New("the destination database is not empty, use --force to overwrite it")
+		}
+	}
+	dump, err := src.dump()
+	if err != nil {
+		return stats, fmt.Errorf("source: %w", err)
+	}
+	stats.orphans = dump.dropOrphans()
+	err = withTransaction(dst, func(db Data) error {
+		return db.restore(dump)
+	})
+	if err != nil {
+		return stats, fmt.Errorf("destination: %w", err)
+	}
+	copied, err := dst.dump()
+	if err != nil {
+		return stats, fmt.Errorf("destination: %w", err)
+	}
+	if err := verifyCopy(dump, copied); err != nil {
+		return stats, err
+	}
+	stats.rows = copied.rowCounts()
+	return stats, nil
+}
+
+func openCopyDB(conn string, log *slog.Logger) (*DbData, error) {
+	if dialectOf(conn) == "memory" {
+		return nil, errors.New("an in-memory database can't be copied")
+	}
+	db, err := openDB(dialectOf(conn), conn, log)
+	if err != nil {
+		return nil, err
+	}
+	return &DbData{db: db, log: log}, nil
+}
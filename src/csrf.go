@@ -0,0 +1,66 @@
+package rtfblog
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+const (
+	// csrfField is the name of the form field with the CSRF token. Scripts
+	// send the token in csrfHeader instead.
+	csrfField   = "csrf_token"
+	csrfHeader  = "X-CSRF-Token"
+	csrfSessKey = "csrf"
+)
+
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// csrfToken is the token the forms of the logged in admin have to carry. It
+// gets made on first use and kept in the session.
+func (c *Context) csrfToken() string {
+	if !c.AdminLogin {
+		return ""
+	}
+	tok, _ := c.Session.Values[csrfSessKey].(string)
+	if tok == "" {
+		tok = newCSRFToken()
+		c.Session.Values[csrfSessKey] = tok
+	}
+	return tok
+}
+
+// validCSRF tells whether req carries the CSRF token of the session. The
+// token of a multipart form is only looked for in the header, reading the
+// form would eat up the files.
+func (c *Context) validCSRF(req *http.Request) bool {
+	want, _ := c.Session.Values[csrfSessKey].(string)
+	if want == "" {
+		return false
+	}
+	got := req.Header.Get(csrfHeader)
+	if got == "" && !strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/") {
+		got = req.PostFormValue(csrfField)
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// csrfFormField is the hidden input to put into every form that posts to an
+// admin handler, as {{csrfField $.CSRFToken}}.
+func csrfFormField(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + csrfField + `" value="` +
+		template.HTMLEscapeString(token) + `" />`)
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
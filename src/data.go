@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"html/template"
 	"strings"
+	"time"
 )
 
 const (
@@ -31,6 +32,11 @@ type Author struct {
 	FullName string `gorm:"column:full_name"`
 	Email    string `gorm:"column:email"`
 	Www      string `gorm:"column:www"`
+	// TOTPSecret is the base32 secret of the second login step, empty when
+	// the author has not enrolled. RecoveryCodes are the hashes of the
+	// one-time codes that stand in for it, space separated.
+	TOTPSecret    string `gorm:"column:totp_secret"`
+	RecoveryCodes string `gorm:"column:recovery_codes"`
 }
 
 // Commenter and Comment tables have been split up a bit to avoid a couple of
@@ -78,6 +84,14 @@ type Comment struct {
 	CommentTable
 }
 
+// render fills in the fields that are not stored, but derived from the ones
+// that are.
+func (c *Comment) render() {
+	c.EmailHash = md5Hash(c.Email)
+	c.Time = time.Unix(c.Timestamp, 0).Format("2006-01-02 15:04")
+	c.Body = sanitizeHTML(mdToHTML(c.RawBody))
+}
+
 type CommentWithPostTitle struct {
 	Comment
 	EntryLink
@@ -99,6 +113,9 @@ type EntryTable struct {
 	UnixDate int64         `gorm:"column:date"`
 	Body     template.HTML `sql:"-"`
 	RawBody  string        `gorm:"column:body"`
+	// ImportID tells where an imported post came from, so that importing it
+	// again finds it. Empty for the posts written here.
+	ImportID string `gorm:"column:import_id"`
 }
 
 func (e EntryTable) TableName() string {
@@ -112,6 +129,13 @@ type Entry struct {
 	Comments []*Comment `sql:"-"`
 }
 
+// render fills in the fields that are not stored, but derived from the ones
+// that are.
+func (e *Entry) render() {
+	e.Body = sanitizeTrustedHTML(mdToHTML(e.RawBody))
+	e.Date = time.Unix(e.UnixDate, 0).Format("2006-01-02")
+}
+
 func (e Entry) HasTags() bool {
 	return len(e.Tags) > 0
 }
@@ -144,6 +168,36 @@ func (e Entry) TagsList() string {
 	return strings.Join(parts, ", ")
 }
 
+// tableDump is a copy of every row of every table, IDs included. It's what
+// goes into backups.
+type tableDump struct {
+	Authors    []Author         `json:"authors"`
+	Posts      []EntryTable     `json:"posts"`
+	Tags       []Tag            `json:"tags"`
+	TagMap     []TagMap         `json:"tagmap"`
+	Commenters []CommenterTable `json:"commenters"`
+	Comments   []CommentTable   `json:"comments"`
+}
+
 func (t TagMap) TableName() string {
 	return "tagmap"
 }
+
+// SessionTable is a login session, see dbStore. Sessions are not part of
+// tableDump, there's no point in backing them up.
+type SessionTable struct {
+	// ID is the hash of the token in the cookie, so that reading the table
+	// does not give the sessions away.
+	ID string `gorm:"column:id;primary_key:yes"`
+	// Data are the encoded values of the session.
+	Data      string `gorm:"column:data"`
+	Admin     bool   `gorm:"column:admin"`
+	IP        string `gorm:"column:ip"`
+	UserAgent string `gorm:"column:user_agent"`
+	Created   int64  `gorm:"column:created"`
+	LastSeen  int64  `gorm:"column:last_seen"`
+}
+
+func (s SessionTable) TableName() string {
+	return "session"
+}
@@ -5,9 +5,13 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
 	"github.com/rtfb/rtfblog/src/assets"
 )
@@ -29,20 +33,34 @@ type Data interface {
 	updateComment(id, text string) error
 	commenterID(c *Commenter) (id int64, err error)
 	insertCommenter(c *Commenter) (id int64, err error)
-	insertComment(commenterID, postID int64, body string) (id int64, err error)
+	insertComment(c *CommentTable) (id int64, err error)
 	insertPost(e *EntryTable) (id int64, err error)
 	updatePost(e *EntryTable) error
 	updateTags(tags []*Tag, postID int64) error
 	queryAllTags() ([]*Tag, error)
+	session(id string) (*SessionTable, error)
+	insertSession(s *SessionTable) error
+	updateSession(s *SessionTable) error
+	deleteSession(id string) error
+	deleteSessions(keepID string) error
+	deleteStaleSessions(seenBefore, createdBefore int64) error
+	adminSessions() ([]SessionTable, error)
+	dump() (*tableDump, error)
+	restore(d *tableDump) error
 	begin() error
-	commit()
+	commit() error
 	rollback()
 }
 
 type DbData struct {
-	db  *gorm.DB
-	tx  *gorm.DB
-	log *slog.Logger
+	db *gorm.DB
+	// writer is a separate pool of a single connection for writing to
+	// SQLite, which only allows one writer at a time. Nil for other dialects.
+	writer *gorm.DB
+	tx     *gorm.DB
+	// txMu serializes transactions, since they all share tx.
+	txMu sync.Mutex
+	log  *slog.Logger
 }
 
 func prepareDefaultDB(root string) (dialect, conn string) {
@@ -53,7 +71,114 @@ func prepareDefaultDB(root string) (dialect, conn string) {
 	return "sqlite3", assets.MustExtractDBAsset("default.db")
 }
 
-func InitDB(conf Config, root string, log *slog.Logger) *DbData {
+var (
+	pgKeyValueConn = regexp.MustCompile(`^\w+=`)
+	mysqlDSN       = regexp.MustCompile(`@(tcp|unix)(\(|/)`)
+)
+
+// dialectOf tells the dialect from a connection string. Postgres takes URLs
+// and key=value lists, MySQL takes mysql:// URLs and the DSNs of its Go
+// driver (user:passwd@tcp(host)/db), memory:// keeps the blog in memory,
+// anything else is a path to an SQLite file.
+func dialectOf(conn string) string {
+	switch {
+	case strings.HasPrefix(conn, "memory://"):
+		return "memory"
+	case strings.HasPrefix(conn, "postgres://"), strings.HasPrefix(conn, "postgresql://"),
+		pgKeyValueConn.MatchString(conn):
+		return "postgres"
+	case strings.HasPrefix(conn, "mysql://"), mysqlDSN.MatchString(conn):
+		return "mysql"
+	}
+	return "sqlite3"
+}
+
+// mysqlConn turns conn into a DSN for the MySQL driver. Migrations need
+// multi-statement queries enabled.
+func mysqlConn(conn string) (string, error) {
+	cfg, err := mysql.ParseDSN(strings.TrimPrefix(conn, "mysql://"))
+	if err != nil {
+		return "", err
+	}
+	cfg.MultiStatements = true
+	return cfg.FormatDSN(), nil
+}
+
+func openDB(dialect, conn string, log *slog.Logger) (*gorm.DB, error) {
+	logDbConn(dialect, conn, log)
+	if dialect == "mysql" {
+		var err error
+		if conn, err = mysqlConn(conn); err != nil {
+			return nil, err
+		}
+	}
+	db, err := gorm.Open(dialect, conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.DB().Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// TODO: this may be feasible after upgrading GORM to something more
+	// modern. Leave it commented out as a reminder for now:
+	// db.SetLogger(log)
+	db.SingularTable(true)
+	return db, nil
+}
+
+// sqliteConn adds the tuning options from conf to an SQLite connection
+// string, along with extra params.
+func sqliteConn(conn string, conf Server, params ...string) string {
+	if conf.SQLiteJournalMode != "" {
+		params = append(params, "_journal_mode="+conf.SQLiteJournalMode)
+	}
+	if conf.SQLiteBusyTimeout > 0 {
+		params = append(params, fmt.Sprintf("_busy_timeout=%d", conf.SQLiteBusyTimeout.Milliseconds()))
+	}
+	if len(params) == 0 {
+		return conn
+	}
+	sep := "?"
+	if strings.Contains(conn, "?") {
+		sep = "&"
+	}
+	return conn + sep + strings.Join(params, "&")
+}
+
+func openDbData(dialect, conn string, conf Config, log *slog.Logger) (*DbData, error) {
+	if dialect != "sqlite3" {
+		db, err := openDB(dialect, conn, log)
+		if err != nil {
+			return nil, err
+		}
+		db.LogMode(conf.LogSQL)
+		pool := db.DB()
+		pool.SetMaxOpenConns(conf.DBMaxOpenConns)
+		pool.SetMaxIdleConns(conf.DBMaxIdleConns)
+		pool.SetConnMaxLifetime(conf.DBConnMaxLifetime)
+		return &DbData{db: db, log: log}, nil
+	}
+	db, err := openDB(dialect, sqliteConn(conn, conf.Server), log)
+	if err != nil {
+		return nil, err
+	}
+	db.LogMode(conf.LogSQL)
+	// Writers wait for each other on the pool, instead of failing with
+	// 'database is locked'. With WAL, readers don't wait for anyone. Taking
+	// the write lock at the start of a transaction avoids failing when a
+	// read in it turns out to be stale by the time it writes.
+	writer, err := openDB(dialect, sqliteConn(conn, conf.Server, "_txlock=immediate"), log)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	writer.LogMode(conf.LogSQL)
+	writer.DB().SetMaxOpenConns(1)
+	return &DbData{db: db, writer: writer, log: log}, nil
+}
+
+func InitDB(conf Config, root string, log *slog.Logger) Data {
 	conn := conf.Server.DBConn
 	if conn != "" && conn[0] == '$' {
 		envVar := os.ExpandEnv(conn)
@@ -62,31 +187,80 @@ func InitDB(conf Config, root string, log *slog.Logger) *DbData {
 		}
 		conn = envVar
 	}
-	dialect := "postgres"
+	dialect := dialectOf(conn)
 	if conn == "" {
 		dialect, conn = prepareDefaultDB(root)
 	}
-	logDbConn(dialect, conn, log)
-	db, err := gorm.Open(dialect, conn)
-	err = db.DB().Ping()
+	if dialect == "memory" {
+		log.Info("DB connection", slog.String("dialect", dialect))
+		return newMemData()
+	}
+	dd, err := openDbData(dialect, conn, conf, log)
 	if err != nil {
 		panic(err)
 	}
-	db.LogMode(conf.LogSQL)
-	// TODO: this may be feasible after upgrading GORM to something more
-	// modern. Leave it commented out as a reminder for now:
-	// db.SetLogger(log)
-	db.SingularTable(true)
-	return &DbData{
-		db:  db,
-		tx:  nil,
-		log: log,
+	return dd
+}
+
+func (dd *DbData) dialect() string {
+	return dd.db.Dialect().GetName()
+}
+
+// writeDB is the pool to write to.
+func (dd *DbData) writeDB() *gorm.DB {
+	if dd.writer != nil {
+		return dd.writer
+	}
+	return dd.db
+}
+
+func (dd *DbData) close() {
+	if dd.writer != nil {
+		// Recommended before closing, it's cheap if there's nothing to do:
+		if err := dd.writer.Exec("pragma optimize").Error; err != nil {
+			dd.log.Error("pragma optimize", E(err))
+		}
+		dd.writer.Close()
 	}
+	dd.db.Close()
+}
+
+// maintainSQLite refreshes the statistics of the query planner and compacts
+// the DB file every interval, until stop is closed.
+func (dd *DbData) maintainSQLite(interval time.Duration, stop <-chan struct{}) {
+	for sleep(interval, stop) {
+		if err := dd.optimize(); err != nil {
+			dd.log.Error("SQLite maintenance failed", E(err))
+		}
+	}
+}
+
+func (dd *DbData) optimize() error {
+	db := dd.writeDB()
+	if err := db.Exec("pragma optimize").Error; err != nil {
+		return err
+	}
+	return db.Exec("vacuum").Error
+}
+
+// hotBackup writes a consistent copy of an SQLite DB to fileName, while the
+// blog keeps running.
+func (dd *DbData) hotBackup(fileName string) error {
+	if dd.dialect() != "sqlite3" {
+		return fmt.Errorf("hot backups only work with SQLite, not %s", dd.dialect())
+	}
+	if assets.FileExistsNoErr(fileName) {
+		return fmt.Errorf("%s already exists", fileName)
+	}
+	return dd.db.Exec("vacuum into ?", fileName).Error
 }
 
 func logDbConn(dialect, conn string, log *slog.Logger) {
-	if dialect == "postgres" {
+	switch dialect {
+	case "postgres":
 		conn = censorPostgresConnStr(conn)
+	case "mysql":
+		conn = censorMySQLConnStr(conn)
 	}
 	log.Info("DB connection", slog.String("dialect", dialect), slog.String("connstr", conn))
 }
@@ -102,27 +276,32 @@ func notInXactionErr() error {
 }
 
 func (dd *DbData) begin() error {
-	dd.tx = dd.db.Begin()
-	return dd.tx.Error
+	dd.txMu.Lock()
+	dd.tx = dd.writeDB().Begin()
+	if err := dd.tx.Error; err != nil {
+		dd.tx = nil
+		dd.txMu.Unlock()
+		return dbError(err)
+	}
+	return nil
 }
 
-func (dd *DbData) commit() {
-	dd.tx.Commit()
-	if dd.db.Error != nil {
-		dd.log.Error("Commit error", E(dd.db.Error))
-	}
+func (dd *DbData) commit() error {
+	err := dd.tx.Commit().Error
 	dd.tx = nil
+	dd.txMu.Unlock()
+	return dbError(err)
 }
 
 func (dd *DbData) rollback() {
 	if dd.tx == nil {
 		return
 	}
-	dd.tx.Rollback()
-	if dd.db.Error != nil {
-		dd.log.Error("Rollback error", E(dd.db.Error))
+	if err := dd.tx.Rollback().Error; err != nil {
+		dd.log.Error("Rollback error", E(err))
 	}
 	dd.tx = nil
+	dd.txMu.Unlock()
 }
 
 func (dd *DbData) post(url string, includeHidden bool) (*Entry, error) {
@@ -131,7 +310,7 @@ func (dd *DbData) post(url string, includeHidden bool) (*Entry, error) {
 		return nil, err
 	}
 	if len(posts) == 0 {
-		return nil, gorm.ErrRecordNotFound
+		return nil, fmt.Errorf("post %q: %w", url, ErrNotFound)
 	}
 	if len(posts) != 1 {
 		msg := "DbData.post(%q) should return 1 post, but returned %d"
@@ -144,7 +323,7 @@ func (dd *DbData) postID(url string) (int64, error) {
 	var post Entry
 	rows := dd.db.Table("post").Where("url = ?", url).Select("id")
 	err := rows.First(&post).Error
-	return post.ID, err
+	return post.ID, dbError(err)
 }
 
 func (dd *DbData) posts(limit, offset int, includeHidden bool) ([]*Entry, error) {
@@ -153,12 +332,12 @@ func (dd *DbData) posts(limit, offset int, includeHidden bool) ([]*Entry, error)
 
 func (dd *DbData) numPosts(includeHidden bool) (int, error) {
 	var count int
-	if includeHidden {
-		dd.db.Table("post").Count(&count)
-	} else {
-		dd.db.Table("post").Where("hidden=?", false).Count(&count)
+	posts := dd.db.Table("post")
+	if !includeHidden {
+		posts = posts.Where("hidden=?", false)
 	}
-	return count, dd.db.Error
+	err := posts.Count(&count).Error
+	return count, dbError(err)
 }
 
 func (dd *DbData) titles(limit int, includeHidden bool) ([]EntryLink, error) {
@@ -168,7 +347,7 @@ func (dd *DbData) titles(limit int, includeHidden bool) ([]EntryLink, error) {
 		posts = posts.Where("hidden=?", false)
 	}
 	err := posts.Order("date desc").Limit(limit).Scan(&results).Error
-	return results, err
+	return results, dbError(err)
 }
 
 func (dd *DbData) titlesByTag(tag string, includeHidden bool) ([]EntryLink, error) {
@@ -178,7 +357,7 @@ func (dd *DbData) titlesByTag(tag string, includeHidden bool) ([]EntryLink, erro
 	rows := dd.db.Table("tagmap").Joins(join).Where("tag.tag=?", tag)
 	err := rows.Pluck("post_id", &postIDs).Error
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 	columns := "title, url, hidden"
 	posts := dd.db.Table("post").Select(columns).Where("id in (?)", postIDs)
@@ -186,7 +365,7 @@ func (dd *DbData) titlesByTag(tag string, includeHidden bool) ([]EntryLink, erro
 		posts = posts.Where("hidden=?", false)
 	}
 	err = posts.Order("date desc").Scan(&results).Error
-	return results, err
+	return results, dbError(err)
 }
 
 func (dd *DbData) allComments() ([]*CommentWithPostTitle, error) {
@@ -194,18 +373,17 @@ func (dd *DbData) allComments() ([]*CommentWithPostTitle, error) {
 	sel := `commenter.name, commenter.email, commenter.www, commenter.ip,
 		comment.id, comment.timestamp, comment.body,
 		post.title, post.url`
-	join := `right join comment on commenter.id = comment.commenter_id
+	join := `left join commenter on commenter.id = comment.commenter_id
 		inner join post on comment.post_id = post.id`
-	joined := dd.db.Table("commenter").Select(sel).Joins(join)
+	joined := dd.db.Table("comment").Select(sel).Joins(join)
 	err := joined.Order("comment.timestamp desc").Scan(&results).Error
-	// TODO: there's an identical loop in queryComments, but it loops over
-	// []Comment instead of []CommentWithPostTitle. Would be nice to unify.
+	if err != nil {
+		return nil, dbError(err)
+	}
 	for _, c := range results {
-		c.EmailHash = md5Hash(c.Email)
-		c.Time = time.Unix(c.Timestamp, 0).Format("2006-01-02 15:04")
-		c.Body = sanitizeHTML(mdToHTML(c.RawBody))
+		c.render()
 	}
-	return results, err
+	return results, nil
 }
 
 func (dd *DbData) commenterID(c *Commenter) (id int64, err error) {
@@ -213,8 +391,7 @@ func (dd *DbData) commenterID(c *Commenter) (id int64, err error) {
 	where := "name = ? and email = ? and www = ?"
 	rows := dd.db.Table("commenter").Select("id")
 	err = rows.Where(where, c.Name, c.Email, c.Website).Scan(&result).Error
-	id = result.ID
-	return
+	return result.ID, dbError(err)
 }
 
 func (dd *DbData) insertCommenter(c *Commenter) (id int64, err error) {
@@ -223,53 +400,55 @@ func (dd *DbData) insertCommenter(c *Commenter) (id int64, err error) {
 	}
 	entry := CommenterTable{ID: 0, Commenter: *c}
 	err = dd.tx.Save(&entry).Error
-	return entry.ID, err
+	return entry.ID, dbError(err)
 }
 
-func (dd *DbData) insertComment(commenterID, postID int64, body string) (id int64, err error) {
+// insertComment stores a new comment. It's stamped with the current time,
+// unless c already has a Timestamp (e.g. when importing old comments).
+func (dd *DbData) insertComment(c *CommentTable) (id int64, err error) {
 	if dd.tx == nil {
 		return -1, notInXactionErr()
 	}
-	c := CommentTable{
-		CommenterID: commenterID,
-		PostID:      postID,
-		RawBody:     body,
-		Timestamp:   time.Now().Unix(),
+	if c.Timestamp == 0 {
+		c.Timestamp = time.Now().Unix()
 	}
-	err = dd.tx.Save(&c).Error
-	return c.CommentID, err
+	err = dd.tx.Save(c).Error
+	return c.CommentID, dbError(err)
 }
 
 func (dd *DbData) insertPost(e *EntryTable) (id int64, err error) {
 	if dd.tx == nil {
 		return -1, notInXactionErr()
 	}
-	e.UnixDate = time.Now().Unix()
+	if e.UnixDate == 0 {
+		e.UnixDate = time.Now().Unix()
+	}
 	err = dd.tx.Save(e).Error
-	return e.ID, err
+	return e.ID, dbError(err)
 }
 
 func (dd *DbData) updatePost(e *EntryTable) error {
 	if dd.tx == nil {
 		return notInXactionErr()
 	}
-	return dd.tx.Save(e).Error
+	return dbError(dd.tx.Save(e).Error)
 }
 
 func (dd *DbData) updateTags(tags []*Tag, postID int64) error {
 	if dd.tx == nil {
 		return notInXactionErr()
 	}
-	dd.tx.Where("post_id = ?", postID).Delete(TagMap{})
+	if err := dd.tx.Where("post_id = ?", postID).Delete(TagMap{}).Error; err != nil {
+		return dbError(err)
+	}
 	for _, t := range tags {
 		tagID, err := insertOrGetTagID(dd.tx, t)
 		if err != nil {
-			dd.log.Error("insertOrGetTagID", E(err))
-			return err
+			return dbError(err)
 		}
 		err = updateTagMap(dd.tx, postID, tagID)
 		if err != nil {
-			return err
+			return dbError(err)
 		}
 	}
 	return nil
@@ -278,7 +457,7 @@ func (dd *DbData) updateTags(tags []*Tag, postID int64) error {
 func (dd *DbData) author() (*Author, error) {
 	var a Author
 	err := dd.db.First(&a).Error
-	return &a, err
+	return &a, dbError(err)
 }
 
 func (dd *DbData) insertAuthor(a *Author) (id int64, err error) {
@@ -286,37 +465,91 @@ func (dd *DbData) insertAuthor(a *Author) (id int64, err error) {
 		return -1, notInXactionErr()
 	}
 	err = dd.tx.Save(a).Error
-	return a.ID, err
+	return a.ID, dbError(err)
 }
 
 func (dd *DbData) updateAuthor(a *Author) error {
 	if dd.tx == nil {
 		return notInXactionErr()
 	}
-	return dd.tx.Save(a).Error
+	return dbError(dd.tx.Save(a).Error)
 }
 
 func (dd *DbData) deleteAuthor(id int64) error {
-	return dd.db.Where("id=?", id).Delete(Author{}).Error
+	return dbError(dd.writeDB().Where("id=?", id).Delete(Author{}).Error)
 }
 
 func (dd *DbData) deleteComment(id string) error {
-	return dd.db.Where("id=?", id).Delete(CommentTable{}).Error
+	return dbError(dd.writeDB().Where("id=?", id).Delete(CommentTable{}).Error)
 }
 
 func (dd *DbData) deletePost(url string) error {
-	return dd.db.Where("url=?", url).Delete(Entry{}).Error
+	return dbError(dd.writeDB().Where("url=?", url).Delete(Entry{}).Error)
 }
 
 func (dd *DbData) updateComment(id, text string) error {
-	return dd.db.Model(CommentTable{}).Where("id=?", id).Update("body", text).Error
+	err := dd.writeDB().Table("comment").Where("id=?", id).Update("body", text).Error
+	return dbError(err)
+}
+
+func (dd *DbData) session(id string) (*SessionTable, error) {
+	var s SessionTable
+	err := dd.db.Where("id=?", id).First(&s).Error
+	return &s, dbError(err)
+}
+
+func (dd *DbData) insertSession(s *SessionTable) error {
+	return dbError(dd.writeDB().Create(s).Error)
+}
+
+// updateSession updates the session, which has to exist: a revoked session
+// must not come back.
+func (dd *DbData) updateSession(s *SessionTable) error {
+	res := dd.writeDB().Table("session").Where("id=?", s.ID).Updates(map[string]interface{}{
+		"data":       s.Data,
+		"admin":      s.Admin,
+		"ip":         s.IP,
+		"user_agent": s.UserAgent,
+		"last_seen":  s.LastSeen,
+	})
+	if res.Error != nil {
+		return dbError(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("update session: %w", ErrNotFound)
+	}
+	return nil
+}
+
+func (dd *DbData) deleteSession(id string) error {
+	return dbError(dd.writeDB().Where("id=?", id).Delete(SessionTable{}).Error)
+}
+
+// deleteSessions deletes every session but keepID.
+func (dd *DbData) deleteSessions(keepID string) error {
+	return dbError(dd.writeDB().Where("id<>?", keepID).Delete(SessionTable{}).Error)
+}
+
+// deleteStaleSessions deletes the sessions last seen before seenBefore, or
+// created before createdBefore, both in Unix seconds.
+func (dd *DbData) deleteStaleSessions(seenBefore, createdBefore int64) error {
+	where := "last_seen<? or created<?"
+	return dbError(dd.writeDB().Where(where, seenBefore, createdBefore).Delete(SessionTable{}).Error)
+}
+
+// adminSessions returns the sessions logged in as the author, the most
+// recently seen first.
+func (dd *DbData) adminSessions() ([]SessionTable, error) {
+	var sessions []SessionTable
+	err := dd.db.Where("admin=?", true).Order("last_seen desc, created desc").Find(&sessions).Error
+	return sessions, dbError(err)
 }
 
 func (dd *DbData) queryPosts(limit, offset int, url string,
 	includeHidden bool) ([]*Entry, error) {
 	var results []*Entry
 	cols := `author.disp_name, post.id, post.title, post.date, post.body,
-		post.url, post.hidden`
+		post.url, post.hidden, post.import_id`
 	join := "inner join author on post.author_id=author.id"
 	posts := dd.db.Table("post").Select(cols).Joins(join)
 	if !includeHidden {
@@ -326,58 +559,58 @@ func (dd *DbData) queryPosts(limit, offset int, url string,
 		posts = posts.Where("url=?", url)
 	}
 	rows := posts.Order("date desc").Limit(limit).Offset(offset)
-	err := rows.Scan(&results).Error
+	if err := rows.Scan(&results).Error; err != nil {
+		return nil, dbError(err)
+	}
 	for _, p := range results {
-		p.Body = sanitizeTrustedHTML(mdToHTML(p.RawBody))
-		p.Date = time.Unix(p.UnixDate, 0).Format("2006-01-02")
-		p.Tags = dd.queryTags(dd.db, p.ID)
-		p.Comments = dd.queryComments(dd.db, p.ID)
+		p.render()
+		var err error
+		if p.Tags, err = queryTags(dd.db, p.ID); err != nil {
+			return nil, dbError(err)
+		}
+		if p.Comments, err = queryComments(dd.db, p.ID); err != nil {
+			return nil, dbError(err)
+		}
 	}
-	return results, err
+	return results, nil
 }
 
-func (dd *DbData) queryTags(db *gorm.DB, postID int64) []*Tag {
+func queryTags(db *gorm.DB, postID int64) ([]*Tag, error) {
 	var results []*Tag
 	join := "inner join tagmap on tagmap.tag_id = tag.id"
 	tables := db.Table("tag").Select("tag.tag").Joins(join)
-	tables.Where("tagmap.post_id = ?", postID).Scan(&results)
-	if db.Error != nil {
-		dd.log.Error("error querying tags for post", slog.Int64("postID", postID), E(db.Error))
-	}
-	return results
+	err := tables.Where("tagmap.post_id = ?", postID).Scan(&results).Error
+	return results, err
 }
 
 func (dd *DbData) queryAllTags() ([]*Tag, error) {
 	var tags []*Tag
 	err := dd.db.Find(&tags).Error
-	return tags, err
+	return tags, dbError(err)
 }
 
-func (dd *DbData) queryComments(db *gorm.DB, postID int64) []*Comment {
+func queryComments(db *gorm.DB, postID int64) ([]*Comment, error) {
 	var comments []*Comment
 	join := "inner join commenter on comment.commenter_id = commenter.id"
 	order := "timestamp asc"
 	tables := db.Table("comment").Select("*").Joins(join)
 	rows := tables.Where("post_id = ?", postID).Order(order)
-	err := rows.Scan(&comments).Error
-	if err != nil {
-		dd.log.Error("error querying comments", E(err))
+	if err := rows.Scan(&comments).Error; err != nil {
+		return nil, err
 	}
 	for _, c := range comments {
-		c.EmailHash = md5Hash(c.Email)
-		c.Time = time.Unix(c.Timestamp, 0).Format("2006-01-02 15:04")
-		c.Body = sanitizeHTML(mdToHTML(c.RawBody))
+		c.render()
 	}
-	return comments
+	return comments, nil
 }
 
 func insertOrGetTagID(db *gorm.DB, tag *Tag) (tagID int64, err error) {
 	var result Tag
 	err = db.Where("tag = ?", tag.Name).First(&result).Error
-	switch err {
-	case nil:
+	switch {
+	case err == nil:
 		return result.ID, nil
-	case gorm.ErrRecordNotFound:
+	case gorm.IsRecordNotFoundError(err):
 		err = db.Save(tag).Error
 		return tag.ID, err
 	default:
@@ -388,3 +621,105 @@ func insertOrGetTagID(db *gorm.DB, tag *Tag) (tagID int64, err error) {
 func updateTagMap(db *gorm.DB, postID int64, tagID int64) error {
 	return db.Save(&TagMap{TagID: tagID, EntryID: postID}).Error
 }
+
+// dump reads every table in a single transaction, so that it sees a
+// consistent snapshot even if the blog is being written to meanwhile.
+func (dd *DbData) dump() (*tableDump, error) {
+	tx := dd.db.Begin()
+	if tx.Error != nil {
+		return nil, dbError(tx.Error)
+	}
+	defer tx.Rollback()
+	if dd.dialect() == "postgres" {
+		// The default READ COMMITTED takes a new snapshot for each statement:
+		err := tx.Exec("set transaction isolation level repeatable read read only").Error
+		if err != nil {
+			return nil, dbError(err)
+		}
+	}
+	var d tableDump
+	for _, rows := range []interface{}{
+		&d.Authors, &d.Posts, &d.Tags, &d.TagMap, &d.Commenters, &d.Comments,
+	} {
+		if err := tx.Order("id").Find(rows).Error; err != nil {
+			return nil, dbError(err)
+		}
+	}
+	return &d, nil
+}
+
+// restore replaces everything in the DB with the contents of d, keeping the
+// IDs.
+func (dd *DbData) restore(d *tableDump) error {
+	if dd.tx == nil {
+		return notInXactionErr()
+	}
+	// Referencing tables go first, so that foreign keys are never violated:
+	for _, table := range []interface{}{
+		CommentTable{}, CommenterTable{}, TagMap{}, Tag{}, EntryTable{}, Author{},
+	} {
+		if err := dd.tx.Delete(table).Error; err != nil {
+			return dbError(err)
+		}
+	}
+	if err := createAll(dd.tx, d.Authors); err != nil {
+		return dbError(err)
+	}
+	if err := createAll(dd.tx, d.Posts); err != nil {
+		return dbError(err)
+	}
+	if err := createAll(dd.tx, d.Tags); err != nil {
+		return dbError(err)
+	}
+	if err := createAll(dd.tx, d.TagMap); err != nil {
+		return dbError(err)
+	}
+	if err := createAll(dd.tx, d.Commenters); err != nil {
+		return dbError(err)
+	}
+	if err := createAll(dd.tx, d.Comments); err != nil {
+		return dbError(err)
+	}
+	return dbError(resetSequences(dd.tx))
+}
+
+// createAll inserts the rows, leaving out the columns the table doesn't
+// have, as it doesn't when a backup of an older schema is being restored.
+func createAll[T any](db *gorm.DB, rows []T) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	scope := db.NewScope(&rows[0])
+	var missing []string
+	for _, f := range scope.Fields() {
+		if f.IsNormal && !f.IsIgnored && !scope.Dialect().HasColumn(scope.TableName(), f.DBName) {
+			missing = append(missing, f.DBName)
+		}
+	}
+	if len(missing) > 0 {
+		db = db.Omit(missing...)
+	}
+	for i := range rows {
+		if err := db.Create(&rows[i]).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetSequences moves Postgres' serial sequences past the IDs that were
+// inserted explicitly, otherwise the next insert would collide with them.
+// SQLite and MySQL pick max(id)+1 by themselves.
+func resetSequences(db *gorm.DB) error {
+	if db.Dialect().GetName() != "postgres" {
+		return nil
+	}
+	for _, table := range []string{"author", "post", "tag", "tagmap", "commenter", "comment"} {
+		q := fmt.Sprintf("select setval(pg_get_serial_sequence('%[1]s', 'id'), "+
+			"coalesce(max(id), 0) + 1, false) from %[1]s", table)
+		if err := db.Exec(q).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
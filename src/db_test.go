@@ -1,12 +1,12 @@
 package rtfblog
 
 import (
+	"errors"
 	"log/slog"
 	"os"
 	"strings"
 	"testing"
 
-	"github.com/jinzhu/gorm"
 	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/require"
 )
@@ -29,7 +29,9 @@ func init() {
 	if envVar == "" {
 		return
 	}
-	if !strings.HasPrefix(envVar, "host=/tmp/PGSQL-") {
+	// Only run against the throwaway servers of scripts/run-*-tests.sh, the
+	// tests wipe the DB out:
+	if !strings.HasPrefix(envVar, "host=/tmp/PGSQL-") && !strings.Contains(envVar, "@unix(/tmp/MYSQL-") {
 		return
 	}
 	realDB = InitDB(conf, bindir(), slogger)
@@ -79,7 +81,7 @@ func testDeleteAuthor(t *testing.T) {
 	require.NoError(t, err, "deleteAuthor failed")
 	data.commit()
 	_, err = data.author()
-	if err != gorm.ErrRecordNotFound {
+	if !errors.Is(err, ErrNotFound) {
 		t.Fatalf("Unexpected error querying author: %s", err.Error())
 	}
 }
@@ -277,7 +279,11 @@ func testInsertComment(t *testing.T) {
 	if commenterID != 1 {
 		t.Fatalf("Wrong commenterID = %d, expected %d", commenterID, 1)
 	}
-	commentID, err := data.insertComment(commenterID, 1, "comment body")
+	commentID, err := data.insertComment(&CommentTable{
+		CommenterID: commenterID,
+		PostID:      1,
+		RawBody:     "comment body",
+	})
 	require.NoError(t, err, "Failed to insert comment")
 	if commentID != 1 {
 		t.Fatalf("Wrong commentID = %d, expected %d", commentID, 1)
@@ -345,6 +351,34 @@ func testDeletePost(t *testing.T) {
 	}
 }
 
+func testMigrations(t *testing.T) {
+	db := realDB.(*DbData).db
+	m, err := newMigrator(db)
+	require.NoError(t, err)
+	_, _, err = m.down(schemaVersion)
+	require.NoError(t, err)
+	requireMigratesUpAndDown(t, db)
+}
+
+// testCopyDB copies SQLite to Postgres and back.
+func testCopyDB(t *testing.T) {
+	src := openTestSQLite(t)
+	fillTestDB(t, src)
+	requireCopies(t, src, realDB.(*DbData))
+}
+
+// testConformance runs the conformance tests against Postgres or MySQL,
+// wiping it out before each.
+func testConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T) Data {
+		err := withTransaction(realDB, func(db Data) error {
+			return db.restore(&tableDump{})
+		})
+		require.NoError(t, err)
+		return realDB
+	})
+}
+
 func TestDB(t *testing.T) {
 	if realDB == nil {
 		return
@@ -354,6 +388,7 @@ func TestDB(t *testing.T) {
 	defer func() {
 		data = tempData
 	}()
+	testMigrations(t)
 	testInsertAuthor(t)
 	testUpdateAuthor(t)
 	testExistingAuthor(t)
@@ -371,4 +406,6 @@ func TestDB(t *testing.T) {
 	testDeleteComment(t)
 	testDeletePost(t)
 	testDeleteAuthor(t)
+	testCopyDB(t)
+	testConformance(t)
 }
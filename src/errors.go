@@ -0,0 +1,97 @@
+package rtfblog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// The kinds of errors every Data implementation reports, whatever the
+// storage underneath. Check for them with errors.Is, the original error is
+// wrapped along.
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+	ErrConstraint = errors.New("constraint violation")
+	ErrTimeout    = errors.New("timeout")
+)
+
+// httpStatus tells the status to respond with when a handler fails with err.
+func httpStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrConstraint):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrTimeout):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// dbError wraps an error of GORM or of an SQL driver with the kind it is of,
+// so that callers don't need to know the storage. Errors of no known kind
+// are returned as they are.
+func dbError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if kind := dbErrorKind(err); kind != nil && !errors.Is(err, kind) {
+		return fmt.Errorf("%w: %w", kind, err)
+	}
+	return err
+}
+
+func dbErrorKind(err error) error {
+	if gorm.IsRecordNotFoundError(err) {
+		return ErrNotFound
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23505", "40001": // unique_violation, serialization_failure
+			return ErrConflict
+		case "23503", "23502", "23514": // foreign_key, not_null, check
+			return ErrConstraint
+		case "57014", "55P03": // query_canceled, lock_not_available
+			return ErrTimeout
+		}
+		return nil
+	}
+	var liteErr sqlite3.Error
+	if errors.As(err, &liteErr) {
+		switch {
+		case liteErr.ExtendedCode == sqlite3.ErrConstraintUnique,
+			liteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey:
+			return ErrConflict
+		case liteErr.Code == sqlite3.ErrConstraint:
+			return ErrConstraint
+		case liteErr.Code == sqlite3.ErrBusy, liteErr.Code == sqlite3.ErrLocked:
+			return ErrTimeout
+		}
+		return nil
+	}
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		switch myErr.Number {
+		case 1062, 1213: // ER_DUP_ENTRY, ER_LOCK_DEADLOCK
+			return ErrConflict
+		case 1048, 1451, 1452: // ER_BAD_NULL_ERROR, ER_ROW_IS_REFERENCED_2, ER_NO_REFERENCED_ROW_2
+			return ErrConstraint
+		case 1205: // ER_LOCK_WAIT_TIMEOUT
+			return ErrTimeout
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package rtfblog
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPStatus(t *testing.T) {
+	var tests = []struct {
+		err    error
+		status int
+	}{
+		{ErrNotFound, http.StatusNotFound},
+		{fmt.Errorf("post %q: %w", "x", ErrNotFound), http.StatusNotFound},
+		{ErrConflict, http.StatusConflict},
+		{ErrConstraint, http.StatusBadRequest},
+		{ErrTimeout, http.StatusServiceUnavailable},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.status, httpStatus(test.err), test.err.Error())
+	}
+}
+
+func TestDBErrors(t *testing.T) {
+	db := openTestSQLite(t)
+	_, err := db.author()
+	require.ErrorIs(t, err, ErrNotFound)
+	fillTestDB(t, db)
+	_, err = db.post("no-such-post", true)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = db.postID("no-such-post")
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = db.commenterID(&Commenter{Name: "Nobody"})
+	require.ErrorIs(t, err, ErrNotFound)
+
+	err = withTransaction(db, func(db Data) error {
+		return db.restore(&tableDump{Authors: []Author{{ID: 1}, {ID: 1}}})
+	})
+	require.ErrorIs(t, err, ErrConflict)
+	require.ErrorContains(t, err, "UNIQUE")
+
+	n, err := db.numPosts(true)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.NoError(t, dbError(nil))
+	require.Equal(t, ErrTimeout, dbError(ErrTimeout))
+}
@@ -0,0 +1,334 @@
+package rtfblog
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// exportManifest lists all files written by the previous export, so that
+	// the ones that are no longer produced can be removed without touching
+	// anything else that might live in the output directory.
+	exportManifest = ".rtfblog-export"
+)
+
+var (
+	// rootRelativeLink matches href, src and action attributes that point to
+	// a root-relative URL. Protocol-relative URLs (//host/...) are left
+	// alone.
+	rootRelativeLink = regexp.MustCompile(`(\s(?:href|src|action)=")(/(?:[^/"][^"]*)?)"`)
+)
+
+// exportStats reports what an export did to the output directory.
+type exportStats struct {
+	written   int
+	unchanged int
+	removed   int
+}
+
+// exportPage is a public page of the blog, rendered the same way as it would
+// be when served to an anonymous reader.
+type exportPage struct {
+	path  string
+	h     handlerFunc
+	query url.Values
+}
+
+// exporter renders the public part of the blog to a directory that can be
+// served by any static file server.
+type exporter struct {
+	s       *server
+	outDir  string
+	baseURL string
+	files   map[string]bool
+	stats   exportStats
+}
+
+// exportSite writes the blog to outDir. Only files whose contents have
+// changed since the previous export to the same directory are rewritten, and
+// files that are not produced any more are removed. baseURL is the absolute
+// URL the site will be published at, it's only needed for the feed, which
+// must contain absolute links.
+func (s *server) exportSite(outDir, baseURL string) (exportStats, error) {
+	e := &exporter{
+		s:       s,
+		outDir:  outDir,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		files:   map[string]bool{},
+	}
+	if err := requireAuthor(s.gctx.Db); err != nil {
+		return e.stats, err
+	}
+	pages, err := e.listPages()
+	if err != nil {
+		return e.stats, err
+	}
+	pagePaths := map[string]bool{}
+	for _, p := range pages {
+		pagePaths[p.path] = true
+	}
+	for _, p := range pages {
+		html, err := e.render(p)
+		if err != nil {
+			return e.stats, fmt.Errorf("export %s: %w", p.path, err)
+		}
+		html = relativizeLinks(html, p.path, pagePaths)
+		if err := e.write(pageFile(p.path), html); err != nil {
+			return e.stats, err
+		}
+	}
+	if err := e.exportFeed(); err != nil {
+		return e.stats, err
+	}
+	if err := e.exportAssets(); err != nil {
+		return e.stats, err
+	}
+	if err := e.prune(); err != nil {
+		return e.stats, err
+	}
+	return e.stats, nil
+}
+
+// listPages enumerates the home page, all pages of the paginated post list,
+// the archive, every non-hidden post and the pages of tags that have at
+// least one non-hidden post.
+func (e *exporter) listPages() ([]exportPage, error) {
+	db := e.s.gctx.Db
+	pages := []exportPage{
+		{path: "/", h: e.s.home},
+		{path: "/archive", h: e.s.archive},
+	}
+	numPosts, err := db.numPosts(false)
+	if err != nil {
+		return nil, err
+	}
+	numPages := (numPosts + PostsPerPage - 1) / PostsPerPage
+	for p := 1; p <= numPages; p++ {
+		pages = append(pages, exportPage{
+			path:  fmt.Sprintf("/page/%d", p),
+			h:     e.s.pageNum,
+			query: url.Values{":pageNo": {strconv.Itoa(p)}},
+		})
+	}
+	// Not -1 for 'all', since sqlite does not accept OFFSET without LIMIT:
+	posts, err := db.posts(numPosts, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]bool{}
+	for _, post := range posts {
+		pages = append(pages, exportPage{path: "/" + post.URL, h: e.s.home})
+		for _, t := range post.Tags {
+			tags[t.Name] = true
+		}
+	}
+	var tagNames []string
+	for t := range tags {
+		tagNames = append(tagNames, t)
+	}
+	sort.Strings(tagNames)
+	for _, t := range tagNames {
+		pages = append(pages, exportPage{
+			path:  "/tag/" + t,
+			h:     e.s.postsWithTag,
+			query: url.Values{":tag": {t}},
+		})
+	}
+	return pages, nil
+}
+
+// render runs a page handler with an anonymous session, just like a request
+// from a first-time visitor would.
+func (e *exporter) render(p exportPage) ([]byte, error) {
+	req, err := http.NewRequest("GET", p.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Path = p.path
+	req.URL.RawQuery = p.query.Encode()
+	ctx, err := NewContext(req, &e.s.gctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx.StaticExport = true
+	rec := newPageRecorder()
+	if err := p.h(rec, req, ctx); err != nil {
+		return nil, err
+	}
+	if rec.status != http.StatusOK {
+		return nil, fmt.Errorf("got HTTP status %d", rec.status)
+	}
+	return rec.body.Bytes(), nil
+}
+
+func (e *exporter) exportFeed() error {
+	posts, err := e.s.gctx.Db.posts(NumFeedItems, 0, false)
+	if err != nil {
+		return fmt.Errorf("export feed: %w", err)
+	}
+	req, err := http.NewRequest("GET", "/feeds/rss.xml", nil)
+	if err != nil {
+		return err
+	}
+	ctx, err := NewContext(req, &e.s.gctx)
+	if err != nil {
+		return err
+	}
+	rec := newPageRecorder()
+	e.s.produceFeedXML(rec, e.baseURL, posts, ctx)
+	return e.write("feeds/rss.xml", rec.body.Bytes())
+}
+
+// exportAssets copies everything that is served under /static/, including
+// the uploaded files. robots.txt and favicon are also put to the root of the
+// site, where they are expected to be.
+func (e *exporter) exportAssets() error {
+	fsys := e.s.gctx.assets.FS()
+	err := fs.WalkDir(fsys, "static", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		return e.write(name, data)
+	})
+	if err != nil {
+		return fmt.Errorf("export assets: %w", err)
+	}
+	for _, name := range []string{"robots.txt", e.s.config().Server.Favicon} {
+		if name == "" {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, path.Join(e.s.config().Server.StaticDir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("export %s: %w", name, err)
+		}
+		if err := e.write(name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write stores the file under the output directory, unless it's already
+// there with the very same contents. name is slash separated, and may not
+// climb out of the output directory, which a post URL like ../x would.
+func (e *exporter) write(name string, data []byte) error {
+	if !fs.ValidPath(name) {
+		return fmt.Errorf("export %s: not a valid file name", name)
+	}
+	e.files[name] = true
+	fullPath := filepath.Join(e.outDir, filepath.FromSlash(name))
+	old, err := os.ReadFile(fullPath)
+	if err == nil && bytes.Equal(old, data) {
+		e.stats.unchanged++
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(fullPath, data, 0644); err != nil {
+		return err
+	}
+	e.stats.written++
+	return nil
+}
+
+// prune removes files that were written by the previous export, but not by
+// this one (e.g. deleted or hidden posts), and records the new manifest.
+func (e *exporter) prune() error {
+	manifestPath := filepath.Join(e.outDir, exportManifest)
+	old, err := os.ReadFile(manifestPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(old))
+	for scanner.Scan() {
+		name := scanner.Text()
+		if name == "" || e.files[name] || !fs.ValidPath(name) {
+			continue
+		}
+		err := os.Remove(filepath.Join(e.outDir, filepath.FromSlash(name)))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		e.stats.removed++
+		e.removeEmptyDirs(path.Dir(name))
+	}
+	var names []string
+	for name := range e.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	manifest := strings.Join(names, "\n") + "\n"
+	return os.WriteFile(manifestPath, []byte(manifest), 0644)
+}
+
+func (e *exporter) removeEmptyDirs(dir string) {
+	for dir != "." {
+		if os.Remove(filepath.Join(e.outDir, filepath.FromSlash(dir))) != nil {
+			return // Not empty, or already gone
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// pageFile returns the name of the file a page is stored at. Pages become
+// directories with an index.html so that their URLs stay the same.
+func pageFile(page string) string {
+	if page == "/" {
+		return "index.html"
+	}
+	return strings.TrimPrefix(page, "/") + "/index.html"
+}
+
+// relativizeLinks rewrites root-relative links in a page at pagePath to ones
+// relative to the page itself, so that the exported site works no matter
+// what path it is published under. pages is the set of all exported pages,
+// links to those get a trailing slash, since pages are stored as directories.
+func relativizeLinks(html []byte, pagePath string, pages map[string]bool) []byte {
+	prefix := ""
+	if pagePath != "/" {
+		prefix = strings.Repeat("../", strings.Count(pagePath, "/"))
+	}
+	return rootRelativeLink.ReplaceAllFunc(html, func(m []byte) []byte {
+		sub := rootRelativeLink.FindSubmatch(m)
+		return []byte(string(sub[1]) + relativeLink(string(sub[2]), prefix, pages) + `"`)
+	})
+}
+
+func relativeLink(link, prefix string, pages map[string]bool) string {
+	target, suffix := link, ""
+	if i := strings.IndexAny(link, "?#"); i >= 0 {
+		target, suffix = link[:i], link[i:]
+	}
+	rel := strings.TrimPrefix(target, "/")
+	unescaped, err := url.PathUnescape(target)
+	if err != nil {
+		unescaped = target
+	}
+	if (pages[target] || pages[unescaped]) && rel != "" {
+		rel += "/"
+	}
+	if prefix+rel == "" {
+		return "./" + suffix
+	}
+	return prefix + rel + suffix
+}
@@ -0,0 +1,137 @@
+package rtfblog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readExported(t *testing.T, dir, name string) string {
+	b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestExportSite(t *testing.T) {
+	uploads := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(uploads, "upload.png"), []byte("png"), 0644))
+	s := initTests(uploads)
+	out := t.TempDir()
+	_, err := s.exportSite(out, "http://example.com/blog/")
+	require.NoError(t, err)
+
+	home := readExported(t, out, "index.html")
+	mustContain(t, home, `href="./"`)
+	mustContain(t, home, `href="archive/"`)
+	mustContain(t, home, `href="hello1/#comments"`)
+	mustContain(t, home, `href="page/2/"`)
+	mustContain(t, home, `href="static/css/main.css?v=`)
+	require.NotContains(t, home, `href="/`)
+	require.NotContains(t, home, `/login`)
+
+	post := readExported(t, out, "hello1/index.html")
+	mustContain(t, post, "Body1")
+	mustContain(t, post, `href="../tag/u1/"`)
+	mustContain(t, post, `src="../static/rss.png?v=`)
+	mustContain(t, post, "Comments can not be posted to this copy of the blog.")
+	require.NotContains(t, post, `id="comment"`)
+	require.NotContains(t, post, "getPagedownEditor().run()")
+
+	mustContain(t, readExported(t, out, "page/2/index.html"), `href="../../hello1/"`)
+	mustContain(t, readExported(t, out, "tag/u1/index.html"), `href="../../archive/"`)
+	mustContain(t, readExported(t, out, "archive/index.html"), "Hi11")
+	mustContain(t, readExported(t, out, "feeds/rss.xml"), "http://example.com/blog/hello1")
+	require.Equal(t, "png", readExported(t, out, "static/upload.png"))
+	readExported(t, out, "static/css/main.css")
+	readExported(t, out, "robots.txt")
+
+	require.NoFileExists(t, filepath.Join(out, "hello1001", "index.html"))
+	require.NoDirExists(t, filepath.Join(out, "tag", "u1001"))
+}
+
+func TestReExportOnlyWritesChanges(t *testing.T) {
+	s := initTests(t.TempDir())
+	out := t.TempDir()
+	first, err := s.exportSite(out, "")
+	require.NoError(t, err)
+	require.Zero(t, first.unchanged)
+
+	again, err := s.exportSite(out, "")
+	require.NoError(t, err)
+	require.Zero(t, again.written)
+	require.Equal(t, first.written, again.unchanged)
+
+	// Drop a post, which also takes its tag page and the last page of the
+	// post list with it:
+	bak := testPosts
+	defer func() {
+		testPosts = bak
+	}()
+	testPosts = nil
+	for _, p := range bak {
+		if p.URL != "hello11" {
+			testPosts = append(testPosts, p)
+		}
+	}
+	pruned, err := s.exportSite(out, "")
+	require.NoError(t, err)
+	require.Equal(t, 3, pruned.removed)
+	require.NoDirExists(t, filepath.Join(out, "hello11"))
+	require.NoDirExists(t, filepath.Join(out, "page", "3"))
+	require.NoDirExists(t, filepath.Join(out, "tag", "u11"))
+	require.FileExists(t, filepath.Join(out, "static", "css", "main.css"))
+	mustContain(t, readExported(t, out, exportManifest), "hello1/index.html\n")
+}
+
+func TestExportRequiresAuthor(t *testing.T) {
+	s := initTests(t.TempDir())
+	bak := testAuthor
+	defer func() {
+		testAuthor = bak
+	}()
+	testAuthor = nil
+	_, err := s.exportSite(t.TempDir(), "")
+	require.Error(t, err)
+}
+
+func TestExportRejectsEscapingURLs(t *testing.T) {
+	s := initTests(t.TempDir())
+	bak := testPosts
+	defer func() {
+		testPosts = bak
+	}()
+	escaping := *bak[0]
+	escaping.URL = "../../escaped"
+	testPosts = append([]*Entry{&escaping}, bak[1:]...)
+	root := t.TempDir()
+	out := filepath.Join(root, "a", "out")
+	_, err := s.exportSite(out, "")
+	require.ErrorContains(t, err, "not a valid file name")
+	require.NoDirExists(t, filepath.Join(root, "escaped"))
+}
+
+func TestRelativizeLinks(t *testing.T) {
+	pages := map[string]bool{"/": true, "/archive": true, "/tag/a b": true}
+	var tests = []struct {
+		page string
+		in   string
+		out  string
+	}{
+		{"/", `<a href="/">`, `<a href="./">`},
+		{"/", `<a href="/#top">`, `<a href="./#top">`},
+		{"/", `<a href="/archive">`, `<a href="archive/">`},
+		{"/post", `<a href="/archive">`, `<a href="../archive/">`},
+		{"/page/2", `<img src="/static/x.png?v=1">`, `<img src="../../static/x.png?v=1">`},
+		{"/post", `<a href="/tag/a%20b">`, `<a href="../tag/a%20b/">`},
+		{"/post", `<a href="/unknown.html">`, `<a href="../unknown.html">`},
+		{"/post", `<a href="//cdn.example.com/x">`, `<a href="//cdn.example.com/x">`},
+		{"/post", `<a href="http://example.com/">`, `<a href="http://example.com/">`},
+		{"/post", `<a href="#comments">`, `<a href="#comments">`},
+	}
+	for _, test := range tests {
+		got := relativizeLinks([]byte(test.in), test.page, pages)
+		require.Equal(t, test.out, string(got), "page %s, link %s", test.page, test.in)
+	}
+}
@@ -0,0 +1,107 @@
+package rtfblog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+)
+
+const (
+	fingerprintLen   = 12
+	fingerprintParam = "v"
+
+	immutableCacheControl = "public, max-age=31536000, immutable"
+)
+
+// fingerprinter rewrites static asset paths to URLs that contain a hash of
+// the asset's contents, e.g. /static/css/post.css becomes
+// /static/css/post.css?v=0123456789ab. Such URLs change whenever the file
+// does, so they can be cached by clients forever.
+type fingerprinter struct {
+	fs http.FileSystem
+	mu sync.RWMutex
+	// hashes maps file names to their fingerprints, an empty one for the
+	// files the templates ask for, but which can't be read. It's emptied on
+	// reload, when the assets might have changed.
+	hashes map[string]string
+}
+
+func newFingerprinter(fs http.FileSystem) *fingerprinter {
+	return &fingerprinter{
+		fs:     fs,
+		hashes: map[string]string{},
+	}
+}
+
+// reset forgets the hashes, so that they are computed anew.
+func (f *fingerprinter) reset() {
+	f.mu.Lock()
+	f.hashes = map[string]string{}
+	f.mu.Unlock()
+}
+
+// hash returns the fingerprint of a file, hashing it only the first time.
+// Only if rememberMissing is set, a file that can't be read is remembered
+// as such, the requests would otherwise fill the map with whatever names.
+func (f *fingerprinter) hash(name string, rememberMissing bool) (string, bool) {
+	name = path.Clean("/" + name)
+	f.mu.RLock()
+	hash, ok := f.hashes[name]
+	f.mu.RUnlock()
+	if ok {
+		return hash, hash != ""
+	}
+	hash, err := hashFile(f.fs, name)
+	if err != nil && !rememberMissing {
+		return "", false
+	}
+	f.mu.Lock()
+	f.hashes[name] = hash
+	f.mu.Unlock()
+	return hash, hash != ""
+}
+
+func hashFile(fs http.FileSystem, name string) (string, error) {
+	file, err := fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:fingerprintLen], nil
+}
+
+// url is the 'asset' template function. It returns the fingerprinted URL of
+// a static file, or the path unchanged if the file can't be read.
+func (f *fingerprinter) url(name string) string {
+	hash, ok := f.hash(name, true)
+	if !ok {
+		return name
+	}
+	return name + "?" + fingerprintParam + "=" + hash
+}
+
+// serve marks responses to URLs with a valid fingerprint as immutable. Ones
+// with a stale fingerprint (e.g. requested by a page rendered before an
+// upgrade) get the current file, but are not cached. Plain paths are served
+// as before.
+func (f *fingerprinter) serve(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		want := req.URL.Query().Get(fingerprintParam)
+		if want != "" {
+			hash, ok := f.hash(req.URL.Path, false)
+			if ok && hash == want {
+				w.Header().Set("Cache-Control", immutableCacheControl)
+			} else {
+				w.Header().Set("Cache-Control", "no-cache")
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,64 @@
+package rtfblog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprintedURLs(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "main.css")
+	require.NoError(t, os.WriteFile(file, []byte("body {}"), 0644))
+	fp := newFingerprinter(http.Dir(dir))
+
+	url := fp.url("/main.css")
+	require.True(t, strings.HasPrefix(url, "/main.css?v="), url)
+	require.Len(t, url, len("/main.css?v=")+fingerprintLen)
+	require.Equal(t, url, fp.url("/main.css"))
+	require.Equal(t, "/missing.css", fp.url("/missing.css"))
+
+	// The files are hashed once, until a reload:
+	require.NoError(t, os.WriteFile(file, []byte("body { color: red; }"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "missing.css"), nil, 0644))
+	require.Equal(t, url, fp.url("/main.css"))
+	require.Equal(t, "/missing.css", fp.url("/missing.css"))
+	fp.reset()
+	require.NotEqual(t, url, fp.url("/main.css"))
+	require.NotEqual(t, "/missing.css", fp.url("/missing.css"))
+}
+
+func TestFingerprintedURLsCaching(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.css"), []byte("body {}"), 0644))
+	fs := http.Dir(dir)
+	fp := newFingerprinter(fs)
+	h := fp.serve(http.FileServer(fs))
+	var tests = []struct {
+		url, cacheControl string
+	}{
+		{fp.url("/main.css"), immutableCacheControl},
+		{"/main.css?v=0123456789ab", "no-cache"},
+		{"/main.css", ""},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", test.url, nil))
+		require.Equal(t, http.StatusOK, rec.Code, test.url)
+		require.Equal(t, "body {}", rec.Body.String(), test.url)
+		require.Equal(t, test.cacheControl, rec.Header().Get("Cache-Control"), test.url)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/nope.css?v=0123456789ab", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.NotContains(t, fp.hashes, "/nope.css", "requests don't get to fill the map")
+}
+
+func TestTemplatesUseFingerprintedAssets(t *testing.T) {
+	mustContain(t, tserver.Curl(""), `src="/static/gopher.png?v=`)
+}
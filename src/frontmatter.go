@@ -0,0 +1,272 @@
+package rtfblog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	frontMatterDelim = "---"
+	markdownExt      = ".md"
+	// commentsExt is the extension of JSON files with post's comments, that
+	// live next to the Markdown file of the post.
+	commentsExt = ".comments.json"
+)
+
+var (
+	frontMatterDateLayouts = []string{
+		time.RFC3339,
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04",
+		"2006-01-02",
+	}
+)
+
+// frontMatter is the YAML header of a post kept in a Markdown file. Only
+// the title is mandatory, the slug defaults to the file's name and the date to
+// the time of import.
+type frontMatter struct {
+	Title  string   `yaml:"title"`
+	Slug   string   `yaml:"slug,omitempty"`
+	Date   string   `yaml:"date,omitempty"`
+	Tags   []string `yaml:"tags,flow,omitempty"`
+	Hidden bool     `yaml:"hidden,omitempty"`
+}
+
+type fileComment struct {
+	Name    string    `json:"name"`
+	Email   string    `json:"email,omitempty"`
+	Website string    `json:"website,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Time    time.Time `json:"time"`
+	Body    string    `json:"body"`
+}
+
+// splitFrontMatter separates the YAML header delimited by '---' lines from
+// the Markdown body.
+func splitFrontMatter(text string) (header, body string, err error) {
+	text = strings.TrimPrefix(text, "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	rest, ok := strings.CutPrefix(text, frontMatterDelim+"\n")
+	if !ok {
+		return "", "", errors.New("no front matter")
+	}
+	if body, ok := strings.CutPrefix(rest, frontMatterDelim+"\n"); ok {
+		return "", strings.TrimPrefix(body, "\n"), nil
+	}
+	header, body, ok = strings.Cut(rest, "\n"+frontMatterDelim+"\n")
+	if !ok {
+		header, ok = strings.CutSuffix(rest, "\n"+frontMatterDelim)
+		if !ok {
+			return "", "", errors.New("unterminated front matter")
+		}
+	}
+	return header, strings.TrimPrefix(body, "\n"), nil
+}
+
+func parseFrontMatterDate(date string) (int64, error) {
+	if date == "" {
+		return 0, nil
+	}
+	for _, layout := range frontMatterDateLayouts {
+		if t, err := time.ParseInLocation(layout, date, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("can't parse date %q", date)
+}
+
+// parseMarkdownPost reads a post from a Markdown file. name is the file's
+// path relative to the imported directory, it's used for the default slug.
+func parseMarkdownPost(name string, text []byte) (importedPost, error) {
+	header, body, err := splitFrontMatter(string(text))
+	if err != nil {
+		return importedPost{}, err
+	}
+	var fm frontMatter
+	if err := yaml.Unmarshal([]byte(header), &fm); err != nil {
+		return importedPost{}, err
+	}
+	if fm.Title == "" {
+		return importedPost{}, errors.New("no title")
+	}
+	slug := fm.Slug
+	if slug == "" {
+		slug = strings.TrimSuffix(filepath.ToSlash(name), markdownExt)
+	}
+	date, err := parseFrontMatterDate(fm.Date)
+	if err != nil {
+		return importedPost{}, err
+	}
+	return importedPost{
+		post: EntryTable{
+			EntryLink: EntryLink{
+				Title:  fm.Title,
+				URL:    slug,
+				Hidden: fm.Hidden,
+			},
+			UnixDate: date,
+			RawBody:  body,
+		},
+		tags: explodeTags(strings.Join(fm.Tags, ",")),
+	}, nil
+}
+
+func readComments(fileName string) ([]importedComment, error) {
+	text, err := os.ReadFile(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var comments []fileComment
+	if err := json.Unmarshal(text, &comments); err != nil {
+		return nil, err
+	}
+	var imported []importedComment
+	for _, c := range comments {
+		imported = append(imported, importedComment{
+			commenter: Commenter{
+				Name:    c.Name,
+				Email:   c.Email,
+				Website: c.Website,
+				IP:      c.IP,
+			},
+			comment: CommentTable{
+				RawBody:   c.Body,
+				Timestamp: c.Time.Unix(),
+			},
+		})
+	}
+	return imported, nil
+}
+
+// readMarkdownPosts reads all *.md files under dir, along with their comment
+// files, if there are any. All of them are parsed before anything gets
+// imported, so that a typo in one file does not leave a half done import.
+func readMarkdownPosts(dir string) ([]importedPost, error) {
+	var posts []importedPost
+	err := filepath.WalkDir(dir, func(fileName string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(fileName) != markdownExt {
+			return err
+		}
+		name, err := filepath.Rel(dir, fileName)
+		if err != nil {
+			return err
+		}
+		text, err := os.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+		p, err := parseMarkdownPost(name, text)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fileName, err)
+		}
+		p.comments, err = readComments(strings.TrimSuffix(fileName, markdownExt) + commentsExt)
+		if err != nil {
+			return fmt.Errorf("%s: comments: %w", fileName, err)
+		}
+		posts = append(posts, p)
+		return nil
+	})
+	return posts, err
+}
+
+// importMarkdown imports a directory of Markdown files with front matter.
+// Posts that are already there get updated, so the same directory can be
+// imported over and over again.
+func importMarkdown(db Data, dir string) (importStats, error) {
+	if err := requireAuthor(db); err != nil {
+		return importStats{}, err
+	}
+	posts, err := readMarkdownPosts(dir)
+	if err != nil {
+		return importStats{}, err
+	}
+	return importPosts(db, posts)
+}
+
+func formatMarkdownPost(p *Entry) ([]byte, error) {
+	fm := frontMatter{
+		Title:  p.Title,
+		Slug:   p.URL,
+		Date:   time.Unix(p.UnixDate, 0).UTC().Format(time.RFC3339),
+		Hidden: p.Hidden,
+	}
+	for _, t := range p.Tags {
+		fm.Tags = append(fm.Tags, t.Name)
+	}
+	header, err := yaml.Marshal(fm)
+	if err != nil {
+		return nil, err
+	}
+	text := frontMatterDelim + "\n" + string(header) + frontMatterDelim + "\n\n" + p.RawBody
+	return []byte(text), nil
+}
+
+func formatComments(comments []*Comment) ([]byte, error) {
+	var fc []fileComment
+	for _, c := range comments {
+		fc = append(fc, fileComment{
+			Name:    c.Name,
+			Email:   c.Email,
+			Website: c.Website,
+			IP:      c.IP,
+			Time:    time.Unix(c.Timestamp, 0).UTC(),
+			Body:    c.RawBody,
+		})
+	}
+	text, err := json.MarshalIndent(fc, "", "  ")
+	return append(text, '\n'), err
+}
+
+// exportMarkdown writes every post, hidden ones included, to a Markdown file
+// with front matter, named after the post's slug. With withComments, the
+// comments of the post go to a JSON file next to it. Returns the number of
+// posts exported.
+func exportMarkdown(db Data, dir string, withComments bool) (int, error) {
+	numPosts, err := db.numPosts(true)
+	if err != nil {
+		return 0, err
+	}
+	posts, err := db.posts(numPosts, 0, true)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range posts {
+		if !fs.ValidPath(p.URL) {
+			return 0, fmt.Errorf("post %q: can't make a file name of its URL", p.URL)
+		}
+		base := filepath.Join(dir, filepath.FromSlash(p.URL))
+		if err := os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+			return 0, err
+		}
+		text, err := formatMarkdownPost(p)
+		if err != nil {
+			return 0, fmt.Errorf("post %q: %w", p.URL, err)
+		}
+		if err := os.WriteFile(base+markdownExt, text, 0644); err != nil {
+			return 0, err
+		}
+		if !withComments || len(p.Comments) == 0 {
+			continue
+		}
+		comments, err := formatComments(p.Comments)
+		if err != nil {
+			return 0, fmt.Errorf("post %q: %w", p.URL, err)
+		}
+		if err := os.WriteFile(base+commentsExt, comments, 0644); err != nil {
+			return 0, err
+		}
+	}
+	return len(posts), nil
+}
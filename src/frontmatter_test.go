@@ -0,0 +1,92 @@
+package rtfblog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMarkdownPost(t *testing.T) {
+	text := "---\r\n" +
+		"title: Hand written\r\n" +
+		"date: 2024-01-05\r\n" +
+		"tags: [Go, web dev]\r\n" +
+		"---\r\n" +
+		"\r\n" +
+		"*Body* text\r\n"
+	p, err := parseMarkdownPost(filepath.Join("drafts", "hand-written.md"), []byte(text))
+	require.NoError(t, err)
+	require.Equal(t, "Hand written", p.post.Title)
+	require.Equal(t, "drafts/hand-written", p.post.URL)
+	require.False(t, p.post.Hidden)
+	require.Equal(t, time.Date(2024, 1, 5, 0, 0, 0, 0, time.Local).Unix(), p.post.UnixDate)
+	require.Equal(t, []*Tag{{Name: "go"}, {Name: "web dev"}}, p.tags)
+	require.Equal(t, "*Body* text\n", p.post.RawBody)
+
+	var bad = []string{
+		"no front matter",
+		"---\ntitle: x\nunterminated",
+		"---\nslug: no-title\n---\n",
+		"---\ntitle: x\ndate: yesterday\n---\n",
+		"---\ntitle: [\n---\n",
+	}
+	for _, text := range bad {
+		_, err := parseMarkdownPost("x.md", []byte(text))
+		require.Error(t, err, text)
+	}
+}
+
+func TestMarkdownRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	date := time.Date(2015, 7, 1, 12, 30, 0, 0, time.UTC).Unix()
+	bak := testPosts[0].UnixDate
+	defer func() {
+		testPosts[0].UnixDate = bak
+	}()
+	testPosts[0].UnixDate = date
+	n, err := exportMarkdown(&testData, dir, true)
+	require.NoError(t, err)
+	require.Equal(t, len(testPosts), n)
+	require.FileExists(t, filepath.Join(dir, "hello1001.md")) // Hidden ones too
+	require.FileExists(t, filepath.Join(dir, "hello1.comments.json"))
+
+	posts, err := readMarkdownPosts(dir)
+	require.NoError(t, err)
+	require.Len(t, posts, len(testPosts))
+	byURL := map[string]importedPost{}
+	for _, p := range posts {
+		byURL[p.post.URL] = p
+	}
+	for _, want := range testPosts {
+		got, ok := byURL[want.URL]
+		require.True(t, ok, want.URL)
+		require.Equal(t, want.Title, got.post.Title)
+		require.Equal(t, want.Hidden, got.post.Hidden)
+		require.Equal(t, want.RawBody, got.post.RawBody)
+		require.Equal(t, want.Tags[0].Name, got.tags[0].Name)
+		require.Len(t, got.comments, len(want.Comments))
+		require.Equal(t, want.Comments[0].RawBody, got.comments[0].comment.RawBody)
+		require.Equal(t, want.Comments[0].Timestamp, got.comments[0].comment.Timestamp)
+		wantCommenter := want.Comments[0].Commenter
+		wantCommenter.EmailHash = "" // Derived, not stored
+		require.Equal(t, wantCommenter, got.comments[0].commenter)
+	}
+	require.Equal(t, date, byURL["hello1"].post.UnixDate)
+}
+
+func TestImportMarkdown(t *testing.T) {
+	defer testData.reset()
+	dir := t.TempDir()
+	text := "---\ntitle: From git\nslug: from-git\nhidden: true\n---\n\nHello\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "post.md"), []byte(text), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0644))
+	stats, err := importMarkdown(&testData, dir)
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.posts)
+	calls := testData.calls()
+	require.Contains(t, calls, "Title:From git URL:from-git Hidden:true")
+	require.Contains(t, calls, "updateTags('0: none')")
+}
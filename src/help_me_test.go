@@ -5,10 +5,12 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"testing"
 
 	"github.com/rtfb/rtfblog/src/assets"
+	"github.com/rtfb/rtfblog/src/htmltest"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/html"
 )
@@ -30,9 +32,21 @@ func mustNotContain(t *testing.T, page, what string) {
 	require.NotContains(t, page, what)
 }
 
+var csrfMetaRe = regexp.MustCompile(`<meta name="csrf-token" content="([^"]+)">`)
+
+// csrfToken fetches the CSRF token of the admin logged in to ht.
+func csrfToken(ht *htmltest.HT) string {
+	m := csrfMetaRe.FindStringSubmatch(ht.Curl("admin"))
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
 func postForm(t *testing.T, path string, values *url.Values, testFunc func(html string)) {
 	defer testData.reset()
 	ensureLogin()
+	values.Set(csrfField, csrfToken(&tserver))
 	body, err := tserver.PostForm(path, values)
 	if err != nil {
 		t.Error(err)
@@ -0,0 +1,326 @@
+package rtfblog
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	// captionShortcode matches WordPress [caption] shortcode tags, the
+	// image and text they wrap are kept.
+	captionShortcode = regexp.MustCompile(`\[/?caption[^\]]*\]`)
+	blankLines       = regexp.MustCompile(`\n{3,}`)
+	whitespace       = regexp.MustCompile(`[ \t\r\n]+`)
+	markdownEscaper  = strings.NewReplacer(
+		`\`, `\\`,
+		"*", `\*`,
+		"_", `\_`,
+		"`", "\\`",
+		"[", `\[`,
+		"]", `\]`,
+		"<", "&lt;",
+	)
+)
+
+// htmlToMarkdown converts HTML, as found in posts and comments exported from
+// other blog engines, to Markdown that renders the same way. Newlines in text
+// outside of paragraphs are treated the way WordPress does: a blank line
+// starts a new paragraph, a single newline is a line break. Elements that have
+// no Markdown equivalent (tables, iframes, etc.) are kept as inline HTML.
+func htmlToMarkdown(s string) (string, error) {
+	s = captionShortcode.ReplaceAllString(s, "")
+	nodes, err := html.ParseFragment(strings.NewReader(s), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return "", err
+	}
+	var c mdConverter
+	for _, n := range nodes {
+		if err := c.node(n); err != nil {
+			return "", err
+		}
+	}
+	return c.String(), nil
+}
+
+// mdConverter accumulates Markdown for a sequence of nodes. Breaks between
+// blocks are not written out immediately, but kept pending until more text
+// comes, so that they don't pile up and don't get written at the end.
+type mdConverter struct {
+	out strings.Builder
+	// pending is the number of newlines owed before the next text: 1 for a
+	// line break, 2 for a paragraph break.
+	pending int
+	// inline is set inside paragraphs, headers and the like, where newlines
+	// in text are just whitespace.
+	inline bool
+}
+
+func (c *mdConverter) String() string {
+	return strings.TrimSpace(blankLines.ReplaceAllString(c.out.String(), "\n\n"))
+}
+
+func (c *mdConverter) breakLine(n int) {
+	c.pending = max(c.pending, n)
+}
+
+func (c *mdConverter) write(s string) {
+	if c.pending > 0 || c.out.Len() == 0 {
+		// Whitespace at the start of a line means something else in Markdown
+		s = strings.TrimLeft(s, " ")
+	}
+	if s == "" {
+		return
+	}
+	if c.out.Len() > 0 {
+		switch c.pending {
+		case 1:
+			c.out.WriteString("  \n")
+		case 2:
+			c.out.WriteString("\n\n")
+		}
+	}
+	c.pending = 0
+	c.out.WriteString(s)
+}
+
+// sub converts the children of n with a fresh converter and returns the
+// result, for the elements whose contents need post-processing.
+func (c *mdConverter) sub(n *html.Node, inline bool) (string, error) {
+	sc := mdConverter{inline: inline}
+	if err := sc.children(n); err != nil {
+		return "", err
+	}
+	return sc.String(), nil
+}
+
+func (c *mdConverter) children(n *html.Node) error {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if err := c.node(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *mdConverter) text(s string) {
+	if c.inline {
+		c.write(markdownEscaper.Replace(whitespace.ReplaceAllString(s, " ")))
+		return
+	}
+	for i, para := range strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n\n") {
+		if i > 0 {
+			c.breakLine(2)
+		}
+		for j, line := range strings.Split(para, "\n") {
+			if j > 0 {
+				c.breakLine(1)
+			}
+			c.write(markdownEscaper.Replace(whitespace.ReplaceAllString(line, " ")))
+		}
+	}
+}
+
+func (c *mdConverter) node(n *html.Node) error {
+	switch n.Type {
+	case html.TextNode:
+		c.text(n.Data)
+		return nil
+	case html.ElementNode:
+		return c.element(n)
+	case html.DocumentNode:
+		return c.children(n)
+	}
+	// Comments (including Gutenberg block delimiters) and doctypes are dropped
+	return nil
+}
+
+func (c *mdConverter) element(n *html.Node) error {
+	switch n.DataAtom {
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Figure:
+		c.breakLine(2)
+		wasInline := c.inline
+		c.inline = n.DataAtom == atom.P
+		err := c.children(n)
+		c.inline = wasInline
+		c.breakLine(2)
+		return err
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		text, err := c.sub(n, true)
+		if err != nil {
+			return err
+		}
+		level := int(n.Data[1] - '0')
+		c.breakLine(2)
+		c.write(strings.Repeat("#", level) + " " + text)
+		c.breakLine(2)
+	case atom.Br:
+		c.breakLine(1)
+	case atom.Hr:
+		c.breakLine(2)
+		c.write("* * *")
+		c.breakLine(2)
+	case atom.Strong, atom.B:
+		return c.wrap(n, "**")
+	case atom.Em, atom.I:
+		return c.wrap(n, "*")
+	case atom.Del, atom.S, atom.Strike:
+		return c.wrap(n, "~~")
+	case atom.Code:
+		code := textContent(n)
+		fence := "`"
+		if strings.Contains(code, "`") {
+			fence = "`` "
+		}
+		c.write(fence + code + reverse(fence))
+	case atom.Pre:
+		code := strings.Trim(textContent(n), "\n")
+		fence := "```"
+		if strings.Contains(code, fence) {
+			fence = "~~~"
+		}
+		c.breakLine(2)
+		c.write(fence + "\n" + code + "\n" + fence)
+		c.breakLine(2)
+	case atom.A:
+		text, err := c.sub(n, true)
+		if err != nil {
+			return err
+		}
+		href := attr(n, "href")
+		switch {
+		case href == "":
+			c.write(text)
+		case text == "":
+			c.write("<" + href + ">")
+		default:
+			c.write(fmt.Sprintf("[%s](%s%s)", text, mdURL(href), mdTitle(attr(n, "title"))))
+		}
+	case atom.Img:
+		alt := markdownEscaper.Replace(attr(n, "alt"))
+		c.write(fmt.Sprintf("![%s](%s%s)", alt, mdURL(attr(n, "src")), mdTitle(attr(n, "title"))))
+	case atom.Blockquote:
+		text, err := c.sub(n, false)
+		if err != nil {
+			return err
+		}
+		c.breakLine(2)
+		c.write(prefixLines(text, "> ", "> "))
+		c.breakLine(2)
+	case atom.Ul, atom.Ol:
+		return c.list(n)
+	case atom.Span, atom.Font, atom.U, atom.Small, atom.Big, atom.Abbr, atom.Cite:
+		return c.children(n)
+	case atom.Script, atom.Style:
+		// Not something we want to carry over
+	default:
+		var buf strings.Builder
+		if err := html.Render(&buf, n); err != nil {
+			return err
+		}
+		c.breakLine(2)
+		c.write(buf.String())
+		c.breakLine(2)
+	}
+	return nil
+}
+
+func (c *mdConverter) wrap(n *html.Node, marker string) error {
+	text, err := c.sub(n, true)
+	if err != nil || text == "" {
+		return err
+	}
+	c.write(marker + text + marker)
+	return nil
+}
+
+func (c *mdConverter) list(n *html.Node) error {
+	var items []string
+	num := 1
+	for li := n.FirstChild; li != nil; li = li.NextSibling {
+		if li.Type != html.ElementNode || li.DataAtom != atom.Li {
+			continue
+		}
+		text, err := c.sub(li, false)
+		if err != nil {
+			return err
+		}
+		bullet := "- "
+		if n.DataAtom == atom.Ol {
+			bullet = fmt.Sprintf("%d. ", num)
+			num++
+		}
+		items = append(items, prefixLines(text, bullet, strings.Repeat(" ", len(bullet))))
+	}
+	c.breakLine(2)
+	c.write(strings.Join(items, "\n"))
+	c.breakLine(2)
+	return nil
+}
+
+// prefixLines prefixes the first line of text with first and all the
+// following ones with rest. Blank lines don't get trailing whitespace.
+func prefixLines(text, first, rest string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		switch {
+		case i == 0:
+			lines[i] = first + line
+		case line == "":
+			lines[i] = strings.TrimRight(rest, " ")
+		default:
+			lines[i] = rest + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var sb strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode && child.DataAtom == atom.Br {
+			sb.WriteString("\n")
+			continue
+		}
+		sb.WriteString(textContent(child))
+	}
+	return sb.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func mdURL(u string) string {
+	return strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29").Replace(u)
+}
+
+func mdTitle(title string) string {
+	if title == "" {
+		return ""
+	}
+	return fmt.Sprintf(` "%s"`, strings.ReplaceAll(title, `"`, `&quot;`))
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
@@ -0,0 +1,42 @@
+package rtfblog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTMLToMarkdown(t *testing.T) {
+	var tests = []struct {
+		html string
+		md   string
+	}{
+		{"plain text", "plain text"},
+		{"<p>one</p><p>two</p>", "one\n\ntwo"},
+		{"one\n\ntwo\nthree", "one\n\ntwo  \nthree"},
+		{"<p>wrapped\nline</p>", "wrapped line"},
+		{"a <b>bold</b> and <em>em</em> word", "a **bold** and *em* word"},
+		{"<del>gone</del>", "~~gone~~"},
+		{"<h2>Title</h2>text", "## Title\n\ntext"},
+		{"line<br />break", "line  \nbreak"},
+		{`<a href="http://x.y/a b">link</a>`, "[link](http://x.y/a%20b)"},
+		{`<a href="http://x.y"></a>`, "<http://x.y>"},
+		{`<img src="/pic.png" alt="A pic">`, "![A pic](/pic.png)"},
+		{`[caption id="x"]<img src="/p.png" alt="p">[/caption]`, "![p](/p.png)"},
+		{"<code>x := 1</code>", "`x := 1`"},
+		{"<pre><code>if x {\n\ty()\n}</code></pre>", "```\nif x {\n\ty()\n}\n```"},
+		{"<blockquote><p>one</p><p>two</p></blockquote>", "> one\n>\n> two"},
+		{"<ul><li>a</li><li>b</li></ul>", "- a\n- b"},
+		{"<ol><li>a</li><li>b</li></ol>", "1. a\n2. b"},
+		{"<ul><li>a<ul><li>b</li></ul></li></ul>", "- a\n\n  - b"},
+		{"2*3 = [six] &lt;not a tag&gt;", `2\*3 = \[six\] &lt;not a tag>`},
+		{"<!-- wp:paragraph --><p>block</p><!-- /wp:paragraph -->", "block"},
+		{"<table><tr><td>cell</td></tr></table>", "<table><tbody><tr><td>cell</td></tr></tbody></table>"},
+		{"<script>alert(1)</script>safe", "safe"},
+	}
+	for _, test := range tests {
+		md, err := htmlToMarkdown(test.html)
+		require.NoError(t, err)
+		require.Equal(t, test.md, md, "html: %q", test.html)
+	}
+}
@@ -0,0 +1,162 @@
+package rtfblog
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// importedPost is a post from an outside source (another blog engine, a
+// bunch of files), converted to what we store.
+type importedPost struct {
+	post     EntryTable
+	tags     []*Tag
+	comments []importedComment
+	// oldPaths are the paths the post used to be reachable at, the ones that
+	// need a redirect to the new URL.
+	oldPaths []string
+}
+
+type importedComment struct {
+	commenter Commenter
+	comment   CommentTable
+}
+
+// importStats reports what an import did. renamed are the posts whose URL
+// was taken by a post of the blog's own.
+type importStats struct {
+	posts     int
+	comments  int
+	redirects []redirect
+	renamed   []redirect
+}
+
+type redirect struct {
+	from, to string
+}
+
+// requireAuthor checks that the author is set up. All imported posts get
+// attributed to them.
+func requireAuthor(db Data) error {
+	_, err := db.author()
+	if errors.Is(err, ErrNotFound) {
+		return errors.New("the blog has no author configured yet")
+	}
+	return err
+}
+
+func slugPath(slug string) string {
+	return (&url.URL{Path: "/" + slug}).EscapedPath()
+}
+
+// importPosts stores the posts, each in its own transaction. Importing the
+// same posts again updates them in place: posts are matched by URL, and
+// comments by their text and author, so nothing gets duplicated.
+func importPosts(db Data, posts []importedPost) (importStats, error) {
+	var stats importStats
+	commenters := map[Commenter]int64{}
+	for _, p := range posts {
+		var existing []*Comment
+		slug := p.post.URL
+		old, err := importTarget(db, &p.post)
+		if err != nil {
+			return stats, fmt.Errorf("import %q: %w", slug, err)
+		}
+		if old != nil {
+			existing = old.Comments
+		}
+		if p.post.URL != slug {
+			stats.renamed = append(stats.renamed, redirect{from: slug, to: p.post.URL})
+		}
+		numComments := 0
+		err = withTransaction(db, func(db Data) error {
+			post := p.post
+			postID, err := InsertOrUpdatePost(db, &post)
+			if err != nil {
+				return err
+			}
+			if err := db.updateTags(p.tags, postID); err != nil {
+				return err
+			}
+			for _, c := range p.comments {
+				if hasComment(existing, c) {
+					continue
+				}
+				commenterID, err := importCommenter(db, commenters, c.commenter)
+				if err != nil {
+					return err
+				}
+				comment := c.comment
+				comment.CommenterID = commenterID
+				comment.PostID = postID
+				if _, err := db.insertComment(&comment); err != nil {
+					return fmt.Errorf("db.insertComment: %w", err)
+				}
+				numComments++
+			}
+			return nil
+		})
+		if err != nil {
+			return stats, fmt.Errorf("import %q: %w", p.post.URL, err)
+		}
+		stats.posts++
+		stats.comments += numComments
+		for _, from := range p.oldPaths {
+			stats.redirects = append(stats.redirects, redirect{from: from, to: slugPath(p.post.URL)})
+		}
+	}
+	return stats, nil
+}
+
+// importTarget finds the post that post updates, nil if it's a new one. A
+// post with an ImportID only updates the one imported from the same place,
+// it does not take the URL of another: it gets a -2, -3, ... suffix instead.
+func importTarget(db Data, post *EntryTable) (*Entry, error) {
+	slug := post.URL
+	for n := 2; ; n++ {
+		old, err := db.post(post.URL, true)
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if old.ImportID == post.ImportID {
+			return old, nil
+		}
+		post.URL = fmt.Sprintf("%s-%d", slug, n)
+	}
+}
+
+// hasComment tells whether c has been imported already. The time is no good
+// for telling, a comment without one gets stamped with the time of the
+// import.
+func hasComment(comments []*Comment, c importedComment) bool {
+	for _, e := range comments {
+		if e.RawBody == c.comment.RawBody && e.Name == c.commenter.Name && e.Email == c.commenter.Email {
+			return true
+		}
+	}
+	return false
+}
+
+// importCommenter finds a commenter or creates one. The ones created in this
+// import are remembered in known, since the lookup may not see the
+// uncommitted ones.
+func importCommenter(db Data, known map[Commenter]int64, c Commenter) (int64, error) {
+	key := Commenter{Name: c.Name, Email: c.Email, Website: c.Website}
+	if id, ok := known[key]; ok {
+		return id, nil
+	}
+	id, err := db.commenterID(&c)
+	if errors.Is(err, ErrNotFound) {
+		id, err = db.insertCommenter(&c)
+		if err != nil {
+			return -1, fmt.Errorf("db.insertCommenter: %w", err)
+		}
+	} else if err != nil {
+		return -1, fmt.Errorf("db.commenterID: %w", err)
+	}
+	known[key] = id
+	return id, nil
+}
@@ -2,6 +2,7 @@ package rtfblog
 
 import (
 	"path/filepath"
+	"sync/atomic"
 
 	"github.com/nicksnyder/go-i18n/i18n"
 	"github.com/rtfb/rtfblog/src/assets"
@@ -12,14 +13,37 @@ const (
 )
 
 var (
-	L10n i18n.TranslateFunc
+	tfunc atomic.Pointer[i18n.TranslateFunc]
 )
 
-func loadLanguage(assets *assets.Bin, langFile string) {
+// L10n retrieves the translation of translationID in the current language.
+func L10n(translationID string, args ...interface{}) string {
+	return (*tfunc.Load())(translationID, args...)
+}
+
+func loadLanguage(assets *assets.Bin, langFile string) error {
 	fp := filepath.Join(l10n, langFile)
-	if err := i18n.ParseTranslationFileBytes(fp, assets.MustLoad(fp)); err != nil {
-		panic("Can't load language '" + langFile + "'; " + err.Error())
+	b, err := assets.Load(fp)
+	if err != nil {
+		return err
 	}
+	return i18n.ParseTranslationFileBytes(fp, b)
+}
+
+// loadL10n (re)loads the translation files and switches L10n to userLocale.
+func loadL10n(assets *assets.Bin, userLocale string) error {
+	for _, f := range []string{"en-US.all.json", "lt-LT.all.json"} {
+		if err := loadLanguage(assets, f); err != nil {
+			return err
+		}
+	}
+	defaultLocale := "en-US" // known valid locale
+	f, err := i18n.Tfunc(userLocale, defaultLocale)
+	if err != nil {
+		return err
+	}
+	tfunc.Store(&f)
+	return nil
 }
 
 // Loads translation files and inits L10n func that retrieves the translations.
@@ -27,9 +51,8 @@ func loadLanguage(assets *assets.Bin, langFile string) {
 // userLocale specifies a locale preferred by the user (a preference or accept
 // header or language cookie).
 func InitL10n(assets *assets.Bin, userLocale string) {
-	loadLanguage(assets, "en-US.all.json")
-	loadLanguage(assets, "lt-LT.all.json")
-	defaultLocale := "en-US" // known valid locale
-	L10n = i18n.MustTfunc(userLocale, defaultLocale)
+	if err := loadL10n(assets, userLocale); err != nil {
+		panic("Can't load translations; " + err.Error())
+	}
 	addTemplateFunc("L10n", L10n)
 }
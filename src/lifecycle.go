@@ -0,0 +1,341 @@
+package rtfblog
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rtfb/rtfblog/src/assets"
+)
+
+// logFile is the file the main log goes to. It can be reopened, so that it
+// plays along with logrotate.
+type logFile struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openLogFile(name string) (*logFile, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &logFile{f: f}, nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// reopen closes the file and opens name in its place. On failure the log
+// keeps going to the old file.
+func (l *logFile) reopen(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.f.Close()
+	l.f = f
+	return nil
+}
+
+// endpoint is an HTTP server along with the way to start it.
+type endpoint struct {
+	srv   *http.Server
+	serve func(srv *http.Server) error
+}
+
+// httpServer makes a server with the timeouts and limits from the config.
+func (s *server) httpServer(h http.Handler) *http.Server {
+	conf := s.config().Server
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: conf.ReadHeaderTimeout,
+		ReadTimeout:       conf.ReadTimeout,
+		WriteTimeout:      conf.WriteTimeout,
+		IdleTimeout:       conf.IdleTimeout,
+		MaxHeaderBytes:    conf.MaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(s.gctx.Log.Handler(), slog.LevelWarn),
+	}
+}
+
+// listeners opens the listeners for plain HTTP and for HTTPS, or takes
+// them from systemd when it did the opening. tl is nil without HTTPS.
+func (s *server) listeners(withTLS bool) (l, tl net.Listener, err error) {
+	conf := s.config().Server
+	activated, err := systemdListeners()
+	if err != nil {
+		return nil, nil, err
+	}
+	if activated != nil {
+		l, tl = activated["http"], activated["https"]
+		if l == nil {
+			if tl != nil {
+				tl.Close()
+			}
+			return nil, nil, errors.New("systemd passed no http socket")
+		}
+		if tl != nil && !withTLS {
+			s.gctx.Log.Warn("Not serving the https socket from systemd, TLS is not configured")
+			tl.Close()
+			tl = nil
+		}
+		return l, tl, nil
+	}
+	if l, err = listen(conf.Port, conf.SocketMode); err != nil {
+		return nil, nil, err
+	}
+	if withTLS {
+		if tl, err = listen(conf.TLSPort, conf.SocketMode); err != nil {
+			l.Close()
+			return nil, nil, err
+		}
+	}
+	return l, tl, nil
+}
+
+// endpoints opens the listeners the config asks for. When there's HTTPS,
+// plain HTTP can be made to redirect to it.
+func (s *server) endpoints(h http.Handler) ([]endpoint, error) {
+	conf := s.config().Server
+	var tlsConf *tls.Config
+	if conf.TLSPort != "" && assets.FileExistsNoErr(conf.TLSCert) && assets.FileExistsNoErr(conf.TLSKey) {
+		var err error
+		if tlsConf, err = tlsConfig(&conf, s.gctx.Log); err != nil {
+			return nil, err
+		}
+	}
+	l, tl, err := s.listeners(tlsConf != nil)
+	if err != nil {
+		return nil, err
+	}
+	if tl == nil && conf.RedirectHTTPS {
+		s.gctx.Log.Warn("Not redirecting to HTTPS, it's not configured")
+	}
+	plain := h
+	if tl != nil && conf.RedirectHTTPS {
+		plain = s.redirectToHTTPS(h, conf.TLSPort)
+	}
+	eps := []endpoint{{
+		srv: s.httpServer(plain),
+		serve: func(srv *http.Server) error {
+			return srv.Serve(l)
+		},
+	}}
+	if tl == nil {
+		return eps, nil
+	}
+	if conf.RedirectHTTPS && conf.HSTSMaxAge > 0 {
+		h = withHSTS(h, conf.HSTSMaxAge)
+	}
+	srv := s.httpServer(h)
+	srv.TLSConfig = tlsConf
+	return append(eps, endpoint{
+		srv: srv,
+		serve: func(srv *http.Server) error {
+			return srv.ServeTLS(tl, "", "")
+		},
+	}), nil
+}
+
+// run serves h until SIGINT or SIGTERM, then shuts down gracefully. SIGHUP
+// reloads the config. systemd is kept informed of all that.
+func (s *server) run(h http.Handler) error {
+	eps, err := s.endpoints(h)
+	if err != nil {
+		return err
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	stopWatchdog := make(chan struct{})
+	defer close(stopWatchdog)
+	go s.watchdog(stopWatchdog)
+	s.gctx.Log.Info("The server is listening...")
+	s.sdNotify("READY=1")
+	return s.serve(eps, sigs)
+}
+
+// serve runs the endpoints until a signal to stop comes in on sigs, or one
+// of them fails.
+func (s *server) serve(eps []endpoint, sigs <-chan os.Signal) error {
+	errs := make(chan error, len(eps))
+	for _, ep := range eps {
+		go func() {
+			errs <- ep.serve(ep.srv)
+		}()
+	}
+	for {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				s.sdNotify("RELOADING=1")
+				s.reload(readConfigs())
+				s.sdNotify("READY=1")
+				continue
+			}
+			s.gctx.Log.Info("Shutting down", slog.String("signal", sig.String()))
+			s.shutdown(eps)
+			return nil
+		case err := <-errs:
+			s.gctx.Log.Error("Serving failed", E(err))
+			s.shutdown(eps)
+			return err
+		}
+	}
+}
+
+// shutdown stops accepting new connections, then waits for the requests in
+// flight and for the notifications being sent, ShutdownTimeout at most.
+func (s *server) shutdown(eps []endpoint) {
+	s.sdNotify("STOPPING=1")
+	ctx, cancel := context.WithTimeout(context.Background(), s.config().Server.ShutdownTimeout)
+	defer cancel()
+	for _, ep := range eps {
+		if err := ep.srv.Shutdown(ctx); err != nil {
+			s.gctx.Log.Error("Graceful shutdown failed", E(err))
+			ep.srv.Close()
+		}
+	}
+	sent := make(chan struct{})
+	go func() {
+		s.notifs.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-ctx.Done():
+		s.gctx.Log.Error("Gave up on sending notifications", E(ctx.Err()))
+	}
+	if path := s.config().Server.LoginThrottleFile; path != "" {
+		if err := s.throttle.save(path); err != nil {
+			s.gctx.Log.Error("Saving the login throttle failed", E(err))
+		}
+	}
+}
+
+// sleep waits for d to pass, or for stop to be closed. Tells whether it was
+// the former.
+func sleep(d time.Duration, stop <-chan struct{}) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// notify sends an email in the background. Shutting down waits for it.
+func (s *server) notify(to, subj, body string) {
+	s.notifs.Add(1)
+	go func() {
+		defer s.notifs.Done()
+		if err := s.sendMail(&s.config().Notifications, to, subj, body); err != nil {
+			s.gctx.Log.Error("Sending email failed", slog.String("subject", subj), E(err))
+		}
+	}()
+}
+
+// restartSettings are the settings a reload can't change, since they are
+// only looked at on startup.
+var restartSettings = map[string]func(c *Config) any{
+	"db_conn":              func(c *Config) any { return c.DBConn },
+	"port":                 func(c *Config) any { return c.Port },
+	"socket_mode":          func(c *Config) any { return c.SocketMode },
+	"tls_port":             func(c *Config) any { return c.TLSPort },
+	"tls_cert":             func(c *Config) any { return c.TLSCert },
+	"tls_key":              func(c *Config) any { return c.TLSKey },
+	"production":           func(c *Config) any { return c.Production },
+	"uploads_root":         func(c *Config) any { return c.UploadsRoot },
+	"page_cache_size":      func(c *Config) any { return c.PageCacheSize },
+	"compress":             func(c *Config) any { return c.Compress },
+	"compress_types":       func(c *Config) any { return c.CompressTypes },
+	"backup_dir":           func(c *Config) any { return c.BackupDir },
+	"backup_interval":      func(c *Config) any { return c.BackupInterval },
+	"log_sql":              func(c *Config) any { return c.LogSQL },
+	"compress_min_size":    func(c *Config) any { return c.CompressMinSize },
+	"backup_keep":          func(c *Config) any { return c.BackupKeep },
+	"read_timeout":         func(c *Config) any { return c.ReadTimeout },
+	"read_header_timeout":  func(c *Config) any { return c.ReadHeaderTimeout },
+	"write_timeout":        func(c *Config) any { return c.WriteTimeout },
+	"idle_timeout":         func(c *Config) any { return c.IdleTimeout },
+	"max_header_bytes":     func(c *Config) any { return c.MaxHeaderBytes },
+	"tls_min_version":      func(c *Config) any { return c.TLSMinVersion },
+	"tls_ciphers":          func(c *Config) any { return c.TLSCiphers },
+	"redirect_https":       func(c *Config) any { return c.RedirectHTTPS },
+	"hsts_max_age":         func(c *Config) any { return c.HSTSMaxAge },
+	"login_throttle_file":  func(c *Config) any { return c.LoginThrottleFile },
+	"session_idle_timeout": func(c *Config) any { return c.SessionIdleTimeout },
+	"session_max_age":      func(c *Config) any { return c.SessionMaxAge },
+	"db_max_open_conns":    func(c *Config) any { return c.DBMaxOpenConns },
+	"db_max_idle_conns":    func(c *Config) any { return c.DBMaxIdleConns },
+	"db_conn_max_lifetime": func(c *Config) any { return c.DBConnMaxLifetime },
+	"sqlite_journal_mode":  func(c *Config) any { return c.SQLiteJournalMode },
+	"sqlite_busy_timeout":  func(c *Config) any { return c.SQLiteBusyTimeout },
+	"sqlite_maintenance_interval": func(c *Config) any {
+		return c.SQLiteMaintenanceInterval
+	},
+}
+
+// needRestart lists the settings that differ in conf, but can't be changed
+// without a restart.
+func needRestart(old, conf *Config) []string {
+	var names []string
+	for _, name := range slices.Sorted(maps.Keys(restartSettings)) {
+		if get := restartSettings[name]; !reflect.DeepEqual(get(old), get(conf)) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// reload switches to conf, reopens the log file and reloads the templates
+// and translations. Requests keep being served meanwhile.
+func (s *server) reload(conf Config) {
+	log := s.gctx.Log
+	if s.logFile != nil {
+		if err := s.logFile.reopen(conf.Server.Log); err != nil {
+			log.Error("Reopening the log failed", E(err))
+		}
+	}
+	if names := needRestart(s.config(), &conf); len(names) > 0 {
+		log.Warn("Some settings only take effect after a restart", slog.Any("settings", names))
+	}
+	if err := loadL10n(s.gctx.assets, conf.Interface.Language); err != nil {
+		log.Error("Reloading translations failed", E(err))
+	}
+	// The reset links are signed with the keys from the config, so the
+	// rejected keys don't stay there either.
+	old := &s.config().Server
+	if err := checkProduction(&conf.Server); err != nil {
+		log.Error("Refusing the new cookie keys, keeping the old ones", E(err))
+		conf.Server.CookieKeys, conf.Server.CookieSecret = old.CookieKeys, old.CookieSecret
+	} else if keys, err := cookieKeyPairs(&conf.Server); err != nil {
+		log.Error("Bad cookie keys, keeping the old ones", E(err))
+		conf.Server.CookieKeys, conf.Server.CookieSecret = old.CookieKeys, old.CookieSecret
+	} else if store, ok := s.gctx.Store.(*dbStore); ok {
+		store.setKeys(keys...)
+	}
+	resetTemplates()
+	s.assetURLs.reset()
+	s.setConfig(conf)
+	s.gctx.pages.invalidate()
+	log.Info("Reloaded the config")
+}
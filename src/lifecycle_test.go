@@ -0,0 +1,154 @@
+package rtfblog
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rtfb/rtfblog/src/assets"
+	"github.com/stretchr/testify/require"
+)
+
+func newLifecycleServer(t *testing.T, log *slog.Logger) server {
+	conf := readConfigs()
+	conf.Server.ShutdownTimeout = 5 * time.Second
+	conf.Interface.Language = "en-US"
+	bin, err := assets.NewBin(buildRoot, t.TempDir(), log)
+	require.NoError(t, err)
+	gctx := newGlobalContext(newMemData(), bin, [][]byte{[]byte("aaabbbcccddd")}, log)
+	return newServer(&TestCryptoHelper{}, gctx, conf)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	s := newLifecycleServer(t, slog.Default())
+	started, release := make(chan struct{}), make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	eps := []endpoint{{
+		srv:   &http.Server{Handler: h},
+		serve: func(srv *http.Server) error { return srv.Serve(l) },
+	}}
+	sigs := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serve(eps, sigs)
+	}()
+	url := "http://" + l.Addr().String()
+	bodies := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			bodies <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		bodies <- string(b)
+	}()
+	<-started
+	var sent atomic.Bool
+	s.notifs.Add(1)
+	go func() {
+		defer s.notifs.Done()
+		<-release
+		time.Sleep(50 * time.Millisecond)
+		sent.Store(true)
+	}()
+	sigs <- syscall.SIGTERM
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned with a request in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	require.Equal(t, "done", <-bodies)
+	require.NoError(t, <-served)
+	require.True(t, sent.Load(), "shutdown didn't wait for the notification")
+	_, err = http.Get(url)
+	require.Error(t, err)
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	oldLog, newLog := filepath.Join(dir, "old.log"), filepath.Join(dir, "new.log")
+	logFile, err := openLogFile(oldLog)
+	require.NoError(t, err)
+	s := newLifecycleServer(t, slog.New(slog.NewJSONHandler(logFile, nil)))
+	s.logFile = logFile
+	conf := *s.config()
+	conf.Server.Log = newLog
+	conf.Server.Port = "65000"
+	conf.Interface.BlogTitle = "Reloaded"
+	cachedMutex.Lock()
+	cachedTemplates["stale.html"] = nil
+	cachedMutex.Unlock()
+	s.reload(conf)
+	require.Equal(t, "Reloaded", s.config().Interface.BlogTitle)
+	cachedMutex.Lock()
+	require.NotContains(t, cachedTemplates, "stale.html")
+	cachedMutex.Unlock()
+	logged, err := os.ReadFile(newLog)
+	require.NoError(t, err)
+	require.Contains(t, string(logged), `"settings":["port"]`)
+	require.Contains(t, string(logged), "Reloaded the config")
+	require.Equal(t, "All Comments", L10n("All Comments"))
+}
+
+func TestNeedRestart(t *testing.T) {
+	old := readConfigs()
+	conf := old
+	require.Empty(t, needRestart(&old, &conf))
+	conf.Interface.BlogTitle = "Another title"
+	conf.Notifications.SendEmail = !old.Notifications.SendEmail
+	require.Empty(t, needRestart(&old, &conf))
+	conf.Server.TLSPort = "8443"
+	conf.Server.DBConn = "memory://"
+	require.Equal(t, []string{"db_conn", "tls_port"}, needRestart(&old, &conf))
+}
+
+func TestBackgroundJobsStop(t *testing.T) {
+	s := newLifecycleServer(t, slog.Default())
+	conf := *s.config()
+	conf.Server.BackupDir = t.TempDir()
+	conf.Server.BackupInterval = time.Hour
+	s.setConfig(conf)
+	db := openTestSQLite(t)
+	store := s.gctx.Store.(*dbStore)
+	stop := make(chan struct{})
+	done := make(chan struct{}, 3)
+	for _, job := range []func(){
+		func() { db.maintainSQLite(time.Hour, stop) },
+		func() { s.backupOnSchedule(stop) },
+		func() { store.purgeSessions(slog.Default(), stop) },
+	} {
+		go func() {
+			job()
+			done <- struct{}{}
+		}()
+	}
+	// The first backup is due right away:
+	require.Eventually(t, func() bool {
+		names, err := listBackups(conf.Server.BackupDir)
+		return err == nil && len(names) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	close(stop)
+	for range 3 {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("a job did not stop")
+		}
+	}
+}
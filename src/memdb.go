@@ -0,0 +1,620 @@
+package rtfblog
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemData keeps the whole blog in memory, which makes it handy for demos and
+// fast tests. Everything is gone on exit. Select it with db_conn: memory://.
+// It behaves the same as DbData, TestDataConformance holds both to that.
+type MemData struct {
+	// mu guards tables and tx. Once in tables, a copy is never modified, so
+	// readers can go through it without holding mu.
+	mu     sync.Mutex
+	tables *tableDump
+	// tx is a private copy of tables that a transaction writes to. It
+	// replaces tables on commit.
+	tx   *tableDump
+	txMu sync.Mutex
+	// sessions are kept apart from tables, they are not part of dumps and
+	// are written to outside of transactions. Guarded by mu as well.
+	sessions map[string]SessionTable
+}
+
+func newMemData() *MemData {
+	return &MemData{tables: &tableDump{}, sessions: map[string]SessionTable{}}
+}
+
+// clone copies the tables, but not the rows, which are never modified in
+// place.
+func (d *tableDump) clone() *tableDump {
+	return &tableDump{
+		Authors:    slices.Clone(d.Authors),
+		Posts:      slices.Clone(d.Posts),
+		Tags:       slices.Clone(d.Tags),
+		TagMap:     slices.Clone(d.TagMap),
+		Commenters: slices.Clone(d.Commenters),
+		Comments:   slices.Clone(d.Comments),
+	}
+}
+
+// The rows of every table are kept sorted by ID. These tell the ID of a row.
+func authorID(a *Author) *int64               { return &a.ID }
+func entryID(e *EntryTable) *int64            { return &e.ID }
+func tagID(t *Tag) *int64                     { return &t.ID }
+func tagMapID(tm *TagMap) *int64              { return &tm.ID }
+func commenterRowID(c *CommenterTable) *int64 { return &c.ID }
+func commentID(c *CommentTable) *int64        { return &c.CommentID }
+
+func findRow[T any](rows []T, id int64, idOf func(*T) *int64) (int, bool) {
+	return slices.BinarySearchFunc(rows, id, func(row T, id int64) int {
+		return cmp.Compare(*idOf(&row), id)
+	})
+}
+
+// saveRow does what GORM's Save does: replaces the row with the same ID, or
+// inserts a new one. A row without an ID gets the next free one, the same
+// way SQLite picks it. Returns the ID of the row.
+func saveRow[T any](rows *[]T, row T, idOf func(*T) *int64) int64 {
+	id := idOf(&row)
+	if *id == 0 {
+		*id = 1
+		if n := len(*rows); n > 0 {
+			*id = *idOf(&(*rows)[n-1]) + 1
+		}
+	}
+	i, found := findRow(*rows, *id, idOf)
+	if found {
+		(*rows)[i] = row
+	} else {
+		*rows = slices.Insert(*rows, i, row)
+	}
+	return *id
+}
+
+func sortRows[T any](rows []T, idOf func(*T) *int64) {
+	slices.SortFunc(rows, func(a, b T) int {
+		return cmp.Compare(*idOf(&a), *idOf(&b))
+	})
+}
+
+// page applies a limit and an offset the way SQL does, with -1 for none.
+func page[T any](rows []T, limit, offset int) []T {
+	if offset > 0 {
+		rows = rows[min(offset, len(rows)):]
+	}
+	if limit >= 0 {
+		rows = rows[:min(limit, len(rows))]
+	}
+	return rows
+}
+
+// read returns the committed tables.
+func (m *MemData) read() *tableDump {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tables
+}
+
+// writeTx runs fn on the tables of the transaction in progress.
+func (m *MemData) writeTx(fn func(t *tableDump) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return fn(m.tx)
+}
+
+// write runs fn on the committed tables right away, the way a statement
+// outside of a transaction does. It's run on the transaction in progress, if
+// any, as well, so that committing it does not undo fn.
+func (m *MemData) write(fn func(t *tableDump)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tables := m.tables.clone()
+	fn(tables)
+	m.tables = tables
+	if m.tx != nil {
+		fn(m.tx)
+	}
+}
+
+func (m *MemData) begin() error {
+	m.txMu.Lock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tx = m.tables.clone()
+	return nil
+}
+
+func (m *MemData) commit() error {
+	m.mu.Lock()
+	m.tables = m.tx
+	m.tx = nil
+	m.mu.Unlock()
+	m.txMu.Unlock()
+	return nil
+}
+
+func (m *MemData) rollback() {
+	m.mu.Lock()
+	if m.tx == nil {
+		m.mu.Unlock()
+		return
+	}
+	m.tx = nil
+	m.mu.Unlock()
+	m.txMu.Unlock()
+}
+
+// sortedPosts returns the posts, the newest first.
+func (d *tableDump) sortedPosts(includeHidden bool) []EntryTable {
+	var posts []EntryTable
+	for _, p := range d.Posts {
+		if includeHidden || !p.Hidden {
+			posts = append(posts, p)
+		}
+	}
+	slices.SortStableFunc(posts, func(a, b EntryTable) int {
+		return cmp.Compare(b.UnixDate, a.UnixDate)
+	})
+	return posts
+}
+
+func (d *tableDump) postTags(postID int64) []*Tag {
+	var tags []*Tag
+	for _, tm := range d.TagMap {
+		if tm.EntryID != postID {
+			continue
+		}
+		if i, ok := findRow(d.Tags, tm.TagID, tagID); ok {
+			tags = append(tags, &Tag{Name: d.Tags[i].Name})
+		}
+	}
+	return tags
+}
+
+func (d *tableDump) postComments(postID int64) []*Comment {
+	var comments []*Comment
+	for _, c := range d.Comments {
+		if c.PostID != postID {
+			continue
+		}
+		i, ok := findRow(d.Commenters, c.CommenterID, commenterRowID)
+		if !ok {
+			continue
+		}
+		comment := &Comment{Commenter: d.Commenters[i].Commenter, CommentTable: c}
+		comment.render()
+		comments = append(comments, comment)
+	}
+	slices.SortStableFunc(comments, func(a, b *Comment) int {
+		return cmp.Compare(a.Timestamp, b.Timestamp)
+	})
+	return comments
+}
+
+func (m *MemData) queryPosts(limit, offset int, url string, includeHidden bool) []*Entry {
+	t := m.read()
+	var results []*Entry
+	for _, p := range t.sortedPosts(includeHidden) {
+		if url != "" && p.URL != url {
+			continue
+		}
+		i, ok := findRow(t.Authors, p.AuthorID, authorID)
+		if !ok {
+			continue
+		}
+		e := &Entry{
+			EntryTable: EntryTable{
+				EntryLink: p.EntryLink,
+				ID:        p.ID,
+				UnixDate:  p.UnixDate,
+				RawBody:   p.RawBody,
+				ImportID:  p.ImportID,
+			},
+			Author:   t.Authors[i].UserName,
+			Tags:     t.postTags(p.ID),
+			Comments: t.postComments(p.ID),
+		}
+		e.render()
+		results = append(results, e)
+	}
+	return page(results, limit, offset)
+}
+
+func (m *MemData) post(url string, includeHidden bool) (*Entry, error) {
+	posts := m.queryPosts(-1, -1, url, includeHidden)
+	if len(posts) == 0 {
+		return nil, fmt.Errorf("post %q: %w", url, ErrNotFound)
+	}
+	return posts[0], nil
+}
+
+func (m *MemData) postID(url string) (int64, error) {
+	for _, p := range m.read().Posts {
+		if p.URL == url {
+			return p.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("post %q: %w", url, ErrNotFound)
+}
+
+func (m *MemData) posts(limit, offset int, includeHidden bool) ([]*Entry, error) {
+	return m.queryPosts(limit, offset, "", includeHidden), nil
+}
+
+func (m *MemData) numPosts(includeHidden bool) (int, error) {
+	return len(m.read().sortedPosts(includeHidden)), nil
+}
+
+func (m *MemData) titles(limit int, includeHidden bool) ([]EntryLink, error) {
+	var results []EntryLink
+	for _, p := range m.read().sortedPosts(includeHidden) {
+		results = append(results, p.EntryLink)
+	}
+	return page(results, limit, -1), nil
+}
+
+func (m *MemData) titlesByTag(tag string, includeHidden bool) ([]EntryLink, error) {
+	t := m.read()
+	tagged := map[int64]bool{}
+	for _, tm := range t.TagMap {
+		if i, ok := findRow(t.Tags, tm.TagID, tagID); ok && t.Tags[i].Name == tag {
+			tagged[tm.EntryID] = true
+		}
+	}
+	var results []EntryLink
+	for _, p := range t.sortedPosts(includeHidden) {
+		if tagged[p.ID] {
+			results = append(results, p.EntryLink)
+		}
+	}
+	return results, nil
+}
+
+func (m *MemData) allComments() ([]*CommentWithPostTitle, error) {
+	t := m.read()
+	var results []*CommentWithPostTitle
+	for _, c := range t.Comments {
+		i, ok := findRow(t.Posts, c.PostID, entryID)
+		if !ok {
+			continue
+		}
+		var commenter Commenter
+		if j, ok := findRow(t.Commenters, c.CommenterID, commenterRowID); ok {
+			commenter = t.Commenters[j].Commenter
+		}
+		comment := &CommentWithPostTitle{
+			Comment: Comment{
+				Commenter: commenter,
+				CommentTable: CommentTable{
+					CommentID: c.CommentID,
+					Timestamp: c.Timestamp,
+					RawBody:   c.RawBody,
+				},
+			},
+			EntryLink: EntryLink{Title: t.Posts[i].Title, URL: t.Posts[i].URL},
+		}
+		comment.render()
+		results = append(results, comment)
+	}
+	slices.SortStableFunc(results, func(a, b *CommentWithPostTitle) int {
+		return cmp.Compare(b.Timestamp, a.Timestamp)
+	})
+	return results, nil
+}
+
+func (m *MemData) author() (*Author, error) {
+	t := m.read()
+	if len(t.Authors) == 0 {
+		return &Author{}, fmt.Errorf("author: %w", ErrNotFound)
+	}
+	a := t.Authors[0]
+	return &a, nil
+}
+
+func (m *MemData) insertAuthor(a *Author) (id int64, err error) {
+	if m.tx == nil {
+		return -1, notInXactionErr()
+	}
+	err = m.writeTx(func(t *tableDump) error {
+		a.ID = saveRow(&t.Authors, *a, authorID)
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+	return a.ID, nil
+}
+
+func (m *MemData) updateAuthor(a *Author) error {
+	if m.tx == nil {
+		return notInXactionErr()
+	}
+	_, err := m.insertAuthor(a)
+	return err
+}
+
+// deletePosts deletes the posts that match, cascading to their comments and
+// tag mappings, as the foreign keys of the schema do.
+func (d *tableDump) deletePosts(match func(p EntryTable) bool) {
+	deleted := map[int64]bool{}
+	d.Posts = slices.DeleteFunc(d.Posts, func(p EntryTable) bool {
+		deleted[p.ID] = match(p)
+		return deleted[p.ID]
+	})
+	d.TagMap = slices.DeleteFunc(d.TagMap, func(tm TagMap) bool {
+		return deleted[tm.EntryID]
+	})
+	d.Comments = slices.DeleteFunc(d.Comments, func(c CommentTable) bool {
+		return deleted[c.PostID]
+	})
+}
+
+func (m *MemData) deleteAuthor(id int64) error {
+	m.write(func(t *tableDump) {
+		t.Authors = slices.DeleteFunc(t.Authors, func(a Author) bool {
+			return a.ID == id
+		})
+		t.deletePosts(func(p EntryTable) bool {
+			return p.AuthorID == id
+		})
+	})
+	return nil
+}
+
+// deleteComment and updateComment take the ID as it comes from the request.
+// One that is not a number matches no comment.
+func (m *MemData) deleteComment(id string) error {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil
+	}
+	m.write(func(t *tableDump) {
+		t.Comments = slices.DeleteFunc(t.Comments, func(c CommentTable) bool {
+			return c.CommentID == n
+		})
+	})
+	return nil
+}
+
+func (m *MemData) deletePost(url string) error {
+	m.write(func(t *tableDump) {
+		t.deletePosts(func(p EntryTable) bool {
+			return p.URL == url
+		})
+	})
+	return nil
+}
+
+func (m *MemData) updateComment(id, text string) error {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil
+	}
+	m.write(func(t *tableDump) {
+		if i, ok := findRow(t.Comments, n, commentID); ok {
+			t.Comments[i].RawBody = text
+		}
+	})
+	return nil
+}
+
+func (m *MemData) commenterID(c *Commenter) (id int64, err error) {
+	for _, row := range m.read().Commenters {
+		if row.Name == c.Name && row.Email == c.Email && row.Website == c.Website {
+			return row.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("commenter %q: %w", c.Name, ErrNotFound)
+}
+
+func (m *MemData) insertCommenter(c *Commenter) (id int64, err error) {
+	if m.tx == nil {
+		return -1, notInXactionErr()
+	}
+	err = m.writeTx(func(t *tableDump) error {
+		row := CommenterTable{Commenter: *c}
+		row.EmailHash = ""
+		id = saveRow(&t.Commenters, row, commenterRowID)
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
+// insertComment stores a new comment. It's stamped with the current time,
+// unless c already has a Timestamp (e.g. when importing old comments).
+func (m *MemData) insertComment(c *CommentTable) (id int64, err error) {
+	if m.tx == nil {
+		return -1, notInXactionErr()
+	}
+	err = m.writeTx(func(t *tableDump) error {
+		if _, ok := findRow(t.Posts, c.PostID, entryID); !ok {
+			return fmt.Errorf("comment on post %d: %w", c.PostID, ErrConstraint)
+		}
+		if _, ok := findRow(t.Commenters, c.CommenterID, commenterRowID); !ok {
+			return fmt.Errorf("comment by commenter %d: %w", c.CommenterID, ErrConstraint)
+		}
+		if c.Timestamp == 0 {
+			c.Timestamp = time.Now().Unix()
+		}
+		row := *c
+		row.Body, row.Time = "", ""
+		c.CommentID = saveRow(&t.Comments, row, commentID)
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+	return c.CommentID, nil
+}
+
+func (m *MemData) savePost(e *EntryTable) error {
+	return m.writeTx(func(t *tableDump) error {
+		if _, ok := findRow(t.Authors, e.AuthorID, authorID); !ok {
+			return fmt.Errorf("post by author %d: %w", e.AuthorID, ErrConstraint)
+		}
+		row := *e
+		row.Body, row.Date = "", ""
+		e.ID = saveRow(&t.Posts, row, entryID)
+		return nil
+	})
+}
+
+func (m *MemData) insertPost(e *EntryTable) (id int64, err error) {
+	if m.tx == nil {
+		return -1, notInXactionErr()
+	}
+	if e.UnixDate == 0 {
+		e.UnixDate = time.Now().Unix()
+	}
+	if err := m.savePost(e); err != nil {
+		return -1, err
+	}
+	return e.ID, nil
+}
+
+func (m *MemData) updatePost(e *EntryTable) error {
+	if m.tx == nil {
+		return notInXactionErr()
+	}
+	return m.savePost(e)
+}
+
+func (m *MemData) updateTags(tags []*Tag, postID int64) error {
+	if m.tx == nil {
+		return notInXactionErr()
+	}
+	return m.writeTx(func(t *tableDump) error {
+		t.TagMap = slices.DeleteFunc(t.TagMap, func(tm TagMap) bool {
+			return tm.EntryID == postID
+		})
+		for _, tag := range tags {
+			i := slices.IndexFunc(t.Tags, func(row Tag) bool {
+				return row.Name == tag.Name
+			})
+			var id int64
+			if i >= 0 {
+				id = t.Tags[i].ID
+			} else {
+				tag.ID = saveRow(&t.Tags, *tag, tagID)
+				id = tag.ID
+			}
+			saveRow(&t.TagMap, TagMap{TagID: id, EntryID: postID}, tagMapID)
+		}
+		return nil
+	})
+}
+
+func (m *MemData) queryAllTags() ([]*Tag, error) {
+	var tags []*Tag
+	for _, t := range m.read().Tags {
+		tags = append(tags, &Tag{ID: t.ID, Name: t.Name})
+	}
+	return tags, nil
+}
+
+func (m *MemData) session(id string) (*SessionTable, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return &SessionTable{}, fmt.Errorf("session: %w", ErrNotFound)
+	}
+	return &s, nil
+}
+
+func (m *MemData) insertSession(s *SessionTable) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[s.ID]; ok {
+		return fmt.Errorf("insert session: %w", ErrConflict)
+	}
+	m.sessions[s.ID] = *s
+	return nil
+}
+
+func (m *MemData) updateSession(s *SessionTable) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.sessions[s.ID]
+	if !ok {
+		return fmt.Errorf("update session: %w", ErrNotFound)
+	}
+	row := *s
+	row.Created = old.Created
+	m.sessions[s.ID] = row
+	return nil
+}
+
+func (m *MemData) deleteSession(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *MemData) deleteSessions(keepID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id := range m.sessions {
+		if id != keepID {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (m *MemData) deleteStaleSessions(seenBefore, createdBefore int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, s := range m.sessions {
+		if s.LastSeen < seenBefore || s.Created < createdBefore {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (m *MemData) adminSessions() ([]SessionTable, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sessions []SessionTable
+	for _, s := range m.sessions {
+		if s.Admin {
+			sessions = append(sessions, s)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b SessionTable) int {
+		return cmp.Or(cmp.Compare(b.LastSeen, a.LastSeen), cmp.Compare(b.Created, a.Created))
+	})
+	return sessions, nil
+}
+
+func (m *MemData) dump() (*tableDump, error) {
+	return m.read().clone(), nil
+}
+
+// restore replaces everything with the contents of d, keeping the IDs.
+func (m *MemData) restore(d *tableDump) error {
+	if m.tx == nil {
+		return notInXactionErr()
+	}
+	return m.writeTx(func(t *tableDump) error {
+		*t = *d.clone()
+		sortRows(t.Authors, authorID)
+		sortRows(t.Posts, entryID)
+		sortRows(t.Tags, tagID)
+		sortRows(t.TagMap, tagMapID)
+		sortRows(t.Commenters, commenterRowID)
+		sortRows(t.Comments, commentID)
+		return nil
+	})
+}
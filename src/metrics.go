@@ -10,10 +10,14 @@ type metrics struct {
 	registry              *prometheus.Registry
 	numRobotsServed       prometheus.Counter
 	numForbiddenResponses prometheus.Counter
+	numFailedLogins       prometheus.Counter
+	numThrottledLogins    prometheus.Counter
 	numAdminRequests      prometheus.Counter
 	numNonAdminRequests   prometheus.Counter
 	numPanics             prometheus.Counter
 	numInternalErrors     prometheus.Counter
+	numPageCacheHits      prometheus.Counter
+	numPageCacheMisses    prometheus.Counter
 	latenciesHist         prometheus.Histogram
 }
 
@@ -32,6 +36,18 @@ func initMetrics() metrics {
 		Name:      "num_403s",
 		Help:      "The total number of Forbidden responses",
 	})
+	numFailedLogins := factory.NewCounter(prometheus.CounterOpts{
+		Namespace: "rtfblog",
+		Subsystem: "server",
+		Name:      "num_failed_logins",
+		Help:      "The total number of logins with a wrong user name or password",
+	})
+	numThrottledLogins := factory.NewCounter(prometheus.CounterOpts{
+		Namespace: "rtfblog",
+		Subsystem: "server",
+		Name:      "num_throttled_logins",
+		Help:      "The total number of logins refused for too many failures",
+	})
 	numAdminRequests := factory.NewCounter(prometheus.CounterOpts{
 		Namespace: "rtfblog",
 		Subsystem: "server",
@@ -56,6 +72,18 @@ func initMetrics() metrics {
 		Name:      "num_internal_errors",
 		Help:      "The total number of internal errors in the handler",
 	})
+	numPageCacheHits := factory.NewCounter(prometheus.CounterOpts{
+		Namespace: "rtfblog",
+		Subsystem: "page_cache",
+		Name:      "num_hits",
+		Help:      "The total number of pages served from the page cache",
+	})
+	numPageCacheMisses := factory.NewCounter(prometheus.CounterOpts{
+		Namespace: "rtfblog",
+		Subsystem: "page_cache",
+		Name:      "num_misses",
+		Help:      "The total number of cacheable pages that had to be rendered",
+	})
 	latenciesHist := factory.NewHistogram(prometheus.HistogramOpts{
 		Namespace: "rtfblog",
 		Subsystem: "server",
@@ -74,10 +102,14 @@ func initMetrics() metrics {
 		registry:              reg,
 		numRobotsServed:       numRobotsServed,
 		numForbiddenResponses: numForbiddenResponses,
+		numFailedLogins:       numFailedLogins,
+		numThrottledLogins:    numThrottledLogins,
 		numAdminRequests:      numAdminRequests,
 		numNonAdminRequests:   numNonAdminRequests,
 		numPanics:             numPanics,
 		numInternalErrors:     numInternalErrors,
+		numPageCacheHits:      numPageCacheHits,
+		numPageCacheMisses:    numPageCacheMisses,
 		latenciesHist:         latenciesHist,
 	}
 }
@@ -0,0 +1,271 @@
+package rtfblog
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/jinzhu/gorm"
+	embedded "github.com/rtfb/rtfblog"
+)
+
+// schemaVersion is the number of the latest migration. The code expects the
+// schema to be at this version, the backups record the one they were made at.
+const schemaVersion = 7
+
+var (
+	migrationDirs = map[string]string{
+		"mysql":    "db/mysql/migrations",
+		"postgres": "db/pg/migrations",
+		"sqlite3":  "db/sqlite/migrations",
+	}
+
+	// migrationsTables are compatible with the ones golang-migrate creates,
+	// so databases that were migrated with its CLI are picked up as they are.
+	migrationsTables = map[string]string{
+		"mysql": `create table if not exists schema_migrations (
+			version bigint not null primary key, dirty boolean not null)
+			engine=InnoDB default charset=utf8mb4 collate=utf8mb4_unicode_ci`,
+		"postgres": `create table if not exists schema_migrations (
+			version bigint not null primary key, dirty boolean not null)`,
+		"sqlite3": `create table if not exists schema_migrations (
+			version uint64, dirty bool);
+			create unique index if not exists version_unique on schema_migrations (version)`,
+	}
+
+	migrationFileName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+)
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+type schemaMigration struct {
+	Version int64
+	Dirty   bool
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// migrator applies the migrations embedded into the binary. It keeps track of
+// the applied version the same way golang-migrate does.
+type migrator struct {
+	db         *gorm.DB
+	dialect    string
+	migrations []migration
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, e := range entries {
+		match := migrationFileName.FindStringSubmatch(e.Name())
+		if match == nil {
+			continue
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+		sql, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		}
+		if match[3] == "up" {
+			m.up = string(sql)
+		} else {
+			m.down = string(sql)
+		}
+	}
+	var migrations []migration
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %03d_%s lacks an up or down part", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b migration) int {
+		return a.version - b.version
+	})
+	return migrations, nil
+}
+
+func newMigrator(db *gorm.DB) (*migrator, error) {
+	dialect := db.Dialect().GetName()
+	dir, ok := migrationDirs[dialect]
+	if !ok {
+		return nil, fmt.Errorf("no migrations for %s", dialect)
+	}
+	migrations, err := loadMigrations(embedded.Migrations, dir)
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{db: db, dialect: dialect, migrations: migrations}, nil
+}
+
+func (m *migrator) latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].version
+}
+
+// version returns the version the schema is at, zero for an empty database.
+func (m *migrator) version() (int, error) {
+	if !m.db.HasTable(schemaMigration{}) {
+		if m.db.HasTable("post") {
+			return 0, fmt.Errorf("the database has tables, but no %s table to tell its version",
+				schemaMigration{}.TableName())
+		}
+		return 0, nil
+	}
+	var rows []schemaMigration
+	if err := m.db.Find(&rows).Error; err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	if rows[0].Dirty {
+		return 0, fmt.Errorf("a migration to version %d has failed halfway, the schema needs fixing by hand",
+			rows[0].Version)
+	}
+	return int(rows[0].Version), nil
+}
+
+func writeVersion(db *gorm.DB, version int, dirty bool) error {
+	if err := db.Delete(schemaMigration{}).Error; err != nil {
+		return err
+	}
+	if version == 0 && !dirty {
+		return nil
+	}
+	return db.Create(&schemaMigration{Version: int64(version), Dirty: dirty}).Error
+}
+
+// setVersion runs sql and records the new version in the same transaction,
+// so that a failed migration leaves no trace. Except on MySQL, which commits
+// schema changes right away: there the version is marked dirty until the
+// migration is done, so that a failed one does not go unnoticed.
+func (m *migrator) setVersion(version int, sql string) error {
+	if err := m.db.Exec(migrationsTables[m.dialect]).Error; err != nil {
+		return err
+	}
+	if m.dialect == "mysql" {
+		if err := writeVersion(m.db, version, true); err != nil {
+			return err
+		}
+	}
+	tx := m.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	defer tx.Rollback()
+	if err := tx.Exec(sql).Error; err != nil {
+		return err
+	}
+	if err := writeVersion(tx, version, false); err != nil {
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// up applies all migrations newer than the current version. Returns the
+// versions before and after.
+func (m *migrator) up() (from, to int, err error) {
+	from, err = m.version()
+	if err != nil {
+		return from, from, err
+	}
+	to = from
+	for _, mig := range m.migrations {
+		if mig.version <= from {
+			continue
+		}
+		if err := m.setVersion(mig.version, mig.up); err != nil {
+			return from, to, fmt.Errorf("migration %03d_%s: %w", mig.version, mig.name, err)
+		}
+		to = mig.version
+	}
+	return from, to, nil
+}
+
+// down reverts the n latest applied migrations. Returns the versions before
+// and after.
+func (m *migrator) down(n int) (from, to int, err error) {
+	from, err = m.version()
+	if err != nil {
+		return from, from, err
+	}
+	to = from
+	for i := len(m.migrations) - 1; i >= 0 && n > 0; i-- {
+		mig := m.migrations[i]
+		if mig.version > to {
+			continue
+		}
+		prev := 0
+		if i > 0 {
+			prev = m.migrations[i-1].version
+		}
+		if err := m.setVersion(prev, mig.down); err != nil {
+			return from, to, fmt.Errorf("migration %03d_%s: %w", mig.version, mig.name, err)
+		}
+		to = prev
+		n--
+	}
+	return from, to, nil
+}
+
+// downTo reverts the applied migrations newer than version. Returns the
+// versions before and after.
+func (m *migrator) downTo(version int) (from, to int, err error) {
+	from, err = m.version()
+	if err != nil {
+		return from, from, err
+	}
+	n := 0
+	for _, mig := range m.migrations {
+		if mig.version > version && mig.version <= from {
+			n++
+		}
+	}
+	return m.down(n)
+}
+
+// checkSchema makes sure the schema is up to date, migrating it if allowed
+// to. A schema newer than the binary knows of is never touched. Returns the
+// versions before and after.
+func (m *migrator) checkSchema(migrate bool) (from, to int, err error) {
+	version, err := m.version()
+	if err != nil {
+		return version, version, err
+	}
+	switch {
+	case version == m.latest():
+		return version, version, nil
+	case version > m.latest():
+		msg := "the database schema is at version %d, newer than %d this version of rtfblog knows of"
+		return version, version, fmt.Errorf(msg, version, m.latest())
+	case !migrate:
+		msg := "the database schema is at version %d, but this version of rtfblog needs %d, " +
+			"run with --migrate to upgrade it"
+		return version, version, fmt.Errorf(msg, version, m.latest())
+	}
+	return m.up()
+}
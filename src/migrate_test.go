@@ -0,0 +1,109 @@
+package rtfblog
+
+import (
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	embedded "github.com/rtfb/rtfblog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationsMatchSchemaVersion(t *testing.T) {
+	for dialect, dir := range migrationDirs {
+		migrations, err := loadMigrations(embedded.Migrations, dir)
+		require.NoError(t, err, dialect)
+		require.Len(t, migrations, schemaVersion, dialect)
+		for i, m := range migrations {
+			require.Equal(t, i+1, m.version, dialect)
+		}
+	}
+}
+
+// requireMigratesUpAndDown takes an empty database all the way up, checks
+// that the code works with the schema, then takes it back down.
+func requireMigratesUpAndDown(t *testing.T, db *gorm.DB) {
+	m, err := newMigrator(db)
+	require.NoError(t, err)
+	_, _, err = m.checkSchema(false)
+	require.ErrorContains(t, err, "--migrate")
+	from, to, err := m.checkSchema(true)
+	require.NoError(t, err)
+	require.Equal(t, 0, from)
+	require.Equal(t, schemaVersion, to)
+
+	dd := &DbData{db: db, log: slog.Default()}
+	err = withTransaction(dd, func(db Data) error {
+		_, err := db.insertAuthor(&Author{UserName: "migrated"})
+		return err
+	})
+	require.NoError(t, err)
+	err = withTransaction(dd, func(db Data) error {
+		id, err := InsertOrUpdatePost(db, &EntryTable{EntryLink: EntryLink{Title: "T", URL: "t"}})
+		if err != nil {
+			return err
+		}
+		return db.updateTags([]*Tag{{Name: "tag"}}, id)
+	})
+	require.NoError(t, err)
+	titles, err := dd.titlesByTag("tag", true)
+	require.NoError(t, err)
+	require.Equal(t, []EntryLink{{Title: "T", URL: "t"}}, titles)
+	require.NoError(t, dd.deletePost("t"))
+	require.NoError(t, dd.deleteAuthor(1))
+
+	from, to, err = m.down(schemaVersion)
+	require.NoError(t, err)
+	require.Equal(t, schemaVersion, from)
+	require.Equal(t, 0, to)
+	require.False(t, db.HasTable("post"))
+	from, to, err = m.up()
+	require.NoError(t, err)
+	require.Equal(t, 0, from)
+	require.Equal(t, schemaVersion, to)
+}
+
+func TestMigrateEmptySQLite(t *testing.T) {
+	db, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "empty.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	db.SingularTable(true)
+	requireMigratesUpAndDown(t, db)
+}
+
+func TestMigrateDefaultDB(t *testing.T) {
+	db := openTestSQLite(t)
+	m, err := newMigrator(db.db)
+	require.NoError(t, err)
+	version, err := m.version()
+	require.NoError(t, err)
+	require.Equal(t, schemaVersion, version)
+	_, _, err = m.checkSchema(false)
+	require.NoError(t, err)
+
+	from, to, err := m.down(1)
+	require.NoError(t, err)
+	require.Equal(t, schemaVersion, from)
+	require.Equal(t, schemaVersion-1, to)
+	_, _, err = m.checkSchema(false)
+	require.Error(t, err)
+	from, to, err = m.checkSchema(true)
+	require.NoError(t, err)
+	require.Equal(t, schemaVersion-1, from)
+	require.Equal(t, schemaVersion, to)
+
+	// A schema from the future is left alone:
+	require.NoError(t, m.setVersion(schemaVersion+1, "select 1"))
+	_, _, err = m.checkSchema(true)
+	require.ErrorContains(t, err, "newer")
+}
+
+func TestMigrateUntrackedSchema(t *testing.T) {
+	db := openTestSQLite(t)
+	require.NoError(t, db.db.DropTable(schemaMigration{}).Error)
+	m, err := newMigrator(db.db)
+	require.NoError(t, err)
+	_, _, err = m.checkSchema(true)
+	require.ErrorContains(t, err, "schema_migrations")
+}
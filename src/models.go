@@ -1,12 +1,12 @@
 package rtfblog
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 
 	"github.com/gorilla/sessions"
-	"github.com/jinzhu/gorm"
 )
 
 type Context struct {
@@ -14,6 +14,9 @@ type Context struct {
 	Session    *sessions.Session
 	AdminLogin bool
 	Captcha    *Deck
+	// StaticExport is set when rendering pages for a static copy of the
+	// blog, where nothing can be posted back.
+	StaticExport bool
 }
 
 func NewContext(req *http.Request, gctx *globalContext) (*Context, error) {
@@ -70,23 +73,32 @@ func MkBasicData(ctx *Context, pageNo, offset int, conf Config) tmplMap {
 		"entries":         posts,
 		"sidebar_entries": titles,
 		"AdminLogin":      ctx.AdminLogin,
+		"StaticExport":    ctx.StaticExport,
 		"Version":         versionString(),
 		"Flashes":         MkFlashes(ctx),
+		"CSRFToken":       ctx.csrfToken(),
 	}
 }
 
+// withTransaction runs fn in a transaction, which is committed if fn
+// succeeds, and rolled back if it fails or panics. Either way the
+// transaction lock is let go of, a panic would otherwise block every write
+// after it.
 func withTransaction(db Data, fn func(db Data) error) error {
-	txErr := db.begin()
-	if txErr != nil {
-		return txErr
+	if err := db.begin(); err != nil {
+		return err
 	}
-	err := fn(db)
-	if err != nil {
-		db.rollback()
+	committed := false
+	defer func() {
+		if !committed {
+			db.rollback()
+		}
+	}()
+	if err := fn(db); err != nil {
 		return err
 	}
-	db.commit()
-	return nil
+	committed = true
+	return db.commit()
 }
 
 func PublishCommentAndCommenter(db Data, postID int64, commenter *Commenter, rawBody string) (string, error) {
@@ -96,7 +108,11 @@ func PublishCommentAndCommenter(db Data, postID int64, commenter *Commenter, raw
 		if err != nil {
 			return fmt.Errorf("db.insertCommenter: %w", err)
 		}
-		commentID, err = db.insertComment(commenterID, postID, rawBody)
+		commentID, err = db.insertComment(&CommentTable{
+			CommenterID: commenterID,
+			PostID:      postID,
+			RawBody:     rawBody,
+		})
 		if err != nil {
 			return fmt.Errorf("db.insertComment: %w", err)
 		}
@@ -109,7 +125,11 @@ func PublishComment(db Data, postID, commenterID int64, body string) (string, er
 	var commentID int64
 	err := withTransaction(db, func(db Data) error {
 		var insErr error
-		commentID, insErr = db.insertComment(commenterID, postID, body)
+		commentID, insErr = db.insertComment(&CommentTable{
+			CommenterID: commenterID,
+			PostID:      postID,
+			RawBody:     body,
+		})
 		if insErr != nil {
 			return fmt.Errorf("db.insertComment: %w", insErr)
 		}
@@ -126,7 +146,7 @@ func InsertOrUpdatePost(db Data, post *EntryTable) (id int64, err error) {
 	oldPost, idErr := db.post(post.URL, true)
 	var postID int64
 	if idErr != nil {
-		if idErr == gorm.ErrRecordNotFound {
+		if errors.Is(idErr, ErrNotFound) {
 			post.AuthorID = author.ID
 			newPostID, err := db.insertPost(post)
 			if err != nil {
@@ -140,7 +160,13 @@ func InsertOrUpdatePost(db Data, post *EntryTable) (id int64, err error) {
 		postID = oldPost.ID
 		post.ID = postID
 		post.AuthorID = author.ID
-		post.UnixDate = oldPost.UnixDate
+		if post.UnixDate == 0 {
+			// Keep the original date unless the caller has one to set
+			post.UnixDate = oldPost.UnixDate
+		}
+		if post.ImportID == "" {
+			post.ImportID = oldPost.ImportID
+		}
 		updErr := db.updatePost(post)
 		if updErr != nil {
 			return -1, updErr
@@ -151,14 +177,16 @@ func InsertOrUpdatePost(db Data, post *EntryTable) (id int64, err error) {
 
 func InsertOrUpdateAuthor(db Data, newAuthor *Author) (id int64, err error) {
 	author, err := db.author() // Pick default author
-	id = author.ID
-	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			id, err = db.insertAuthor(newAuthor)
-		}
-	} else {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		id, err = db.insertAuthor(newAuthor)
+	case err == nil:
+		id = author.ID
 		newAuthor.ID = id
 		err = db.updateAuthor(newAuthor)
 	}
-	return id, fmt.Errorf("InsertOrUpdateAuthor: %w", err)
+	if err != nil {
+		return -1, fmt.Errorf("InsertOrUpdateAuthor: %w", err)
+	}
+	return id, nil
 }
@@ -0,0 +1,194 @@
+package rtfblog
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/sessions"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// flashesKey is the session key gorilla/sessions keeps flashes under by
+	// default.
+	flashesKey = "_flash"
+)
+
+// pageCache keeps fully rendered public pages in memory, keyed by URL path.
+// Every page carries the sidebar and most of them carry post lists with
+// comment counts, so any write to posts, comments or the author drops the
+// whole cache instead of trying to figure out which pages were affected.
+//
+// A nil *pageCache is valid and caches nothing.
+type pageCache struct {
+	mu         sync.Mutex
+	maxPages   int
+	generation uint64
+	lru        *list.List
+	pages      map[string]*list.Element
+	hits       prometheus.Counter
+	misses     prometheus.Counter
+}
+
+type cachedPage struct {
+	key    string
+	header http.Header
+	body   []byte
+}
+
+func newPageCache(maxPages int, mets metrics) *pageCache {
+	if maxPages <= 0 {
+		return nil
+	}
+	return &pageCache{
+		maxPages: maxPages,
+		lru:      list.New(),
+		pages:    map[string]*list.Element{},
+		hits:     mets.numPageCacheHits,
+		misses:   mets.numPageCacheMisses,
+	}
+}
+
+// get returns a cached page and the cache generation it was looked up at.
+// The generation has to be passed back to put, so that a page rendered
+// concurrently with an invalidation does not get stored.
+func (c *pageCache) get(key string) (*cachedPage, uint64) {
+	if c == nil {
+		return nil, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.pages[key]
+	if !ok {
+		c.misses.Inc()
+		return nil, c.generation
+	}
+	c.hits.Inc()
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cachedPage), c.generation
+}
+
+func (c *pageCache) put(generation uint64, page *cachedPage) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if elem, ok := c.pages[page.key]; ok {
+		elem.Value = page
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.pages[page.key] = c.lru.PushFront(page)
+	for c.lru.Len() > c.maxPages {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.pages, oldest.Value.(*cachedPage).key)
+	}
+}
+
+// invalidate drops all cached pages. It has to be called after every
+// successful write that may change the contents of a public page.
+func (c *pageCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.lru.Init()
+	c.pages = map[string]*list.Element{}
+}
+
+func (p *cachedPage) writeTo(w http.ResponseWriter) {
+	h := w.Header()
+	for key, val := range p.header {
+		h[key] = val
+	}
+	w.Write(p.body)
+}
+
+// pageRecorder is a http.ResponseWriter that captures a rendered page so that
+// it can be both served and stored in the cache.
+type pageRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newPageRecorder() *pageRecorder {
+	return &pageRecorder{
+		header: make(http.Header),
+		status: http.StatusOK,
+	}
+}
+
+func (r *pageRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *pageRecorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *pageRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+func (r *pageRecorder) apply(w http.ResponseWriter) {
+	h := w.Header()
+	for key, val := range r.header {
+		h[key] = val
+	}
+	if r.status != http.StatusOK {
+		w.WriteHeader(r.status)
+	}
+	w.Write(r.body.Bytes())
+}
+
+// isAnonymousView tells whether the request is served to someone who would see
+// the very same page as any other anonymous reader.
+func isAnonymousView(sess *sessions.Session) bool {
+	if sess.Values["adminlogin"] == "yes" {
+		return false
+	}
+	flashes, _ := sess.Values[flashesKey].([]interface{})
+	return len(flashes) == 0
+}
+
+// cached wraps a public page handler with the page cache. Admins and
+// requests with pending flashes always get a freshly rendered page.
+func cached(f handlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+		if ctx.pages == nil || req.Method != "GET" || !isAnonymousView(ctx.Session) {
+			return f(w, req, ctx)
+		}
+		key := req.URL.Path
+		page, generation := ctx.pages.get(key)
+		if page != nil {
+			page.writeTo(w)
+			return nil
+		}
+		rec := newPageRecorder()
+		err := f(rec, req, ctx)
+		if err != nil {
+			return err
+		}
+		// The handler itself may have logged the visitor in or added a flash,
+		// re-check before storing:
+		if rec.status == http.StatusOK && isAnonymousView(ctx.Session) {
+			ctx.pages.put(generation, &cachedPage{
+				key:    key,
+				header: rec.header.Clone(),
+				body:   bytes.Clone(rec.body.Bytes()),
+			})
+		}
+		rec.apply(w)
+		return nil
+	}
+}
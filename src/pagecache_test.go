@@ -0,0 +1,78 @@
+package rtfblog
+
+import (
+	"log/slog"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rtfb/rtfblog/src/htmltest"
+	"github.com/stretchr/testify/require"
+)
+
+func initCachingTestServer(t *testing.T) (server, htmltest.HT, htmltest.HT) {
+	s := initTests(t.TempDir(), func(conf *Config) {
+		conf.Server.PageCacheSize = 2
+	})
+	router := s.initRoutes(slog.Default())
+	return s, htmltest.New(router), htmltest.New(router)
+}
+
+func TestPageCacheServesStalePageUntilWrite(t *testing.T) {
+	s, anon, admin := initCachingTestServer(t)
+	defer testData.reset()
+	oldTitle := testPosts[0].Title
+	defer func() {
+		testPosts[0].Title = oldTitle
+	}()
+	mustContain(t, anon.Curl("archive"), oldTitle+"<")
+	testPosts[0].Title = "Changed behind the back of the cache"
+	mustContain(t, anon.Curl("archive"), oldTitle+"<")
+	require.Equal(t, 1.0, testutil.ToFloat64(s.mets.numPageCacheHits))
+	require.Equal(t, 1.0, testutil.ToFloat64(s.mets.numPageCacheMisses))
+
+	_, err := admin.PostForm("login", &url.Values{
+		"uname":  {"testuser"},
+		"passwd": {"testpasswd"},
+	})
+	require.NoError(t, err)
+	// Admins bypass the cache:
+	mustContain(t, admin.Curl("archive"), testPosts[0].Title)
+	_, err = admin.PostForm("submit_post", &url.Values{
+		"title": {"T1tlE"},
+		"url":   {testPosts[0].URL},
+		"tags":  {"tagzorz"},
+		"text":  {"contentzorz"},
+
+		csrfField: {csrfToken(&admin)},
+	})
+	require.NoError(t, err)
+	mustContain(t, anon.Curl("archive"), testPosts[0].Title)
+	require.Equal(t, 2.0, testutil.ToFloat64(s.mets.numPageCacheMisses))
+}
+
+func TestPageCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	s, anon, _ := initCachingTestServer(t)
+	anon.Curl("archive")
+	anon.Curl("page/1")
+	anon.Curl("archive")
+	anon.Curl("page/2")
+	require.Equal(t, 1.0, testutil.ToFloat64(s.mets.numPageCacheHits))
+	anon.Curl("archive")
+	require.Equal(t, 2.0, testutil.ToFloat64(s.mets.numPageCacheHits))
+	anon.Curl("page/1")
+	require.Equal(t, 2.0, testutil.ToFloat64(s.mets.numPageCacheHits))
+	require.Equal(t, 4.0, testutil.ToFloat64(s.mets.numPageCacheMisses))
+}
+
+func TestIsAnonymousView(t *testing.T) {
+	sess := sessions.NewSession(nil, "rtfblog")
+	require.True(t, isAnonymousView(sess))
+	sess.AddFlash("hi")
+	require.False(t, isAnonymousView(sess))
+	sess.Flashes()
+	require.True(t, isAnonymousView(sess))
+	sess.Values["adminlogin"] = "yes"
+	require.False(t, isAnonymousView(sess))
+}
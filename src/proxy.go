@@ -0,0 +1,176 @@
+package rtfblog
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies are the addresses of the reverse proxies whose forwarding
+// headers are believed. Anyone else could put anything there.
+type trustedProxies []netip.Prefix
+
+// parseTrustedProxies takes IP addresses and CIDR ranges. The bad ones are
+// logged and left out.
+func parseTrustedProxies(addrs []string, log *slog.Logger) trustedProxies {
+	var proxies trustedProxies
+	for _, a := range addrs {
+		if !strings.Contains(a, "/") {
+			if ip, err := netip.ParseAddr(a); err == nil {
+				proxies = append(proxies, netip.PrefixFrom(ip, ip.BitLen()))
+				continue
+			}
+		}
+		prefix, err := netip.ParsePrefix(a)
+		if err != nil {
+			log.Error("Bad trusted_proxies entry", slog.String("entry", a), E(err))
+			continue
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies
+}
+
+func (p trustedProxies) trusts(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwarded is what a proxy tells about the request it forwarded.
+type forwarded struct {
+	// chain of client addresses, the original client first.
+	chain []string
+	proto string
+	host  string
+}
+
+// parseForwarded reads the Forwarded header, or the X-Forwarded-* ones if
+// that's missing.
+func parseForwarded(req *http.Request) forwarded {
+	if hdrs := req.Header.Values("Forwarded"); len(hdrs) > 0 {
+		return parseForwardedHeader(hdrs)
+	}
+	var fwd forwarded
+	for _, h := range req.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(h, ",") {
+			fwd.chain = append(fwd.chain, strings.TrimSpace(addr))
+		}
+	}
+	fwd.proto = firstValue(req.Header.Get("X-Forwarded-Proto"))
+	fwd.host = firstValue(req.Header.Get("X-Forwarded-Host"))
+	return fwd
+}
+
+// parseForwardedHeader parses RFC 7239 elements like
+// 'for=192.0.2.60;proto=https;host=blog.com, for="[2001:db8::1]:4711"'.
+// Proto and host are taken from the first element, the one the first proxy
+// added.
+func parseForwardedHeader(hdrs []string) forwarded {
+	var fwd forwarded
+	first := true
+	for _, h := range hdrs {
+		for _, elem := range strings.Split(h, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				value = strings.Trim(value, `"`)
+				switch strings.ToLower(key) {
+				case "for":
+					fwd.chain = append(fwd.chain, stripPort(value))
+				case "proto":
+					if first {
+						fwd.proto = strings.ToLower(value)
+					}
+				case "host":
+					if first {
+						fwd.host = value
+					}
+				}
+			}
+			first = false
+		}
+	}
+	return fwd
+}
+
+func firstValue(h string) string {
+	v, _, _ := strings.Cut(h, ",")
+	return strings.TrimSpace(v)
+}
+
+// stripPort takes the port off of an address, if there is one. IPv6
+// addresses lose their brackets.
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// proxied tells whether req came from a trusted proxy. Whoever may connect
+// to our unix socket is trusted, its permissions decide that.
+func (s *server) proxied(req *http.Request) bool {
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		return true
+	}
+	return s.proxies.Load().trusts(stripPort(req.RemoteAddr))
+}
+
+// clientIP finds the address of whoever made the request. Going back along
+// the chain of forwarding proxies, it's the first one we don't trust.
+func (s *server) clientIP(req *http.Request) string {
+	ip := stripPort(req.RemoteAddr)
+	if !s.proxied(req) {
+		return ip
+	}
+	proxies := s.proxies.Load()
+	chain := parseForwarded(req).chain
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip = stripPort(chain[i])
+		if !proxies.trusts(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// scheme tells whether the client came in over HTTP or HTTPS.
+func (s *server) scheme(req *http.Request) string {
+	if s.proxied(req) {
+		if proto := parseForwarded(req).proto; proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// baseURL is the absolute URL of the blog root, without the trailing slash.
+// It's base_url when that's set, otherwise it's what the client asked for.
+func (s *server) baseURL(req *http.Request) string {
+	if base := s.config().Server.BaseURL; base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	host := req.Host
+	if s.proxied(req) {
+		if fwdHost := parseForwarded(req).host; fwdHost != "" {
+			host = fwdHost
+		}
+	}
+	return s.scheme(req) + "://" + host
+}
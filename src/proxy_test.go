@@ -0,0 +1,101 @@
+package rtfblog
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newProxiedServer(t *testing.T, baseURL string, proxies ...string) server {
+	s := newLifecycleServer(t, slog.Default())
+	conf := *s.config()
+	conf.Server.BaseURL = baseURL
+	conf.Server.TrustedProxies = proxies
+	s.setConfig(conf)
+	return s
+}
+
+func proxiedRequest(remote string, hdrs ...string) *http.Request {
+	req := httptest.NewRequest("GET", "/feeds/rss.xml", nil)
+	req.Host = "internal:8080"
+	req.RemoteAddr = remote
+	for i := 0; i < len(hdrs); i += 2 {
+		req.Header.Add(hdrs[i], hdrs[i+1])
+	}
+	return req
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies := parseTrustedProxies([]string{"10.0.0.1", "192.168.1.0/24", "::1", "nonsense"}, slog.Default())
+	require.Len(t, proxies, 3)
+	for _, ip := range []string{"10.0.0.1", "192.168.1.77", "::1", "::ffff:10.0.0.1"} {
+		require.True(t, proxies.trusts(ip), ip)
+	}
+	for _, ip := range []string{"10.0.0.2", "192.168.2.1", "::2", "unknown", ""} {
+		require.False(t, proxies.trusts(ip), ip)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	s := newProxiedServer(t, "", "10.0.0.0/8", "::1")
+	var tests = []struct {
+		req *http.Request
+		ip  string
+	}{
+		{proxiedRequest("1.2.3.4:5555"), "1.2.3.4"},
+		{proxiedRequest("1.2.3.4:5555", "X-Forwarded-For", "6.6.6.6"), "1.2.3.4"},
+		{proxiedRequest("10.0.0.1:5555", "X-Forwarded-For", "5.6.7.8"), "5.6.7.8"},
+		{proxiedRequest("10.0.0.1:5555", "X-Forwarded-For", "6.6.6.6, 5.6.7.8, 10.0.0.2"), "5.6.7.8"},
+		{proxiedRequest("10.0.0.1:5555", "X-Forwarded-For", "6.6.6.6", "X-Forwarded-For", "5.6.7.8"), "5.6.7.8"},
+		{proxiedRequest("10.0.0.1:5555", "X-Forwarded-For", "10.0.0.3"), "10.0.0.3"},
+		{proxiedRequest("10.0.0.1:5555"), "10.0.0.1"},
+		{proxiedRequest("[::1]:5555", "Forwarded", `for="[2001:db8::1]:4711";proto=https`), "2001:db8::1"},
+		{proxiedRequest("[::1]:5555", "Forwarded", "for=6.6.6.6, for=5.6.7.8", "X-Forwarded-For", "7.7.7.7"), "5.6.7.8"},
+	}
+	for i, test := range tests {
+		require.Equal(t, test.ip, s.clientIP(test.req), "test %d", i)
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	s := newProxiedServer(t, "", "10.0.0.1")
+	var tests = []struct {
+		req *http.Request
+		url string
+	}{
+		{proxiedRequest("1.2.3.4:5555"), "http://internal:8080"},
+		{proxiedRequest("1.2.3.4:5555", "X-Forwarded-Proto", "https", "X-Forwarded-Host", "evil.com"), "http://internal:8080"},
+		{proxiedRequest("10.0.0.1:5555", "X-Forwarded-Proto", "https", "X-Forwarded-Host", "blog.com"), "https://blog.com"},
+		{proxiedRequest("10.0.0.1:5555", "X-Forwarded-Proto", "https, http"), "https://internal:8080"},
+		{proxiedRequest("10.0.0.1:5555", "Forwarded", `proto=https;host="blog.com", proto=http;host=internal`), "https://blog.com"},
+		{proxiedRequest("10.0.0.1:5555", "X-Forwarded-Proto", "gopher"), "http://internal:8080"},
+	}
+	for i, test := range tests {
+		require.Equal(t, test.url, s.baseURL(test.req), "test %d", i)
+	}
+	req := proxiedRequest("1.2.3.4:5555")
+	req.TLS = &tls.ConnectionState{}
+	require.Equal(t, "https://internal:8080", s.baseURL(req))
+	s = newProxiedServer(t, "https://blog.com/", "10.0.0.1")
+	require.Equal(t, "https://blog.com", s.baseURL(proxiedRequest("10.0.0.1:5555", "X-Forwarded-Host", "other.com")))
+}
+
+func TestRedirectBehindProxy(t *testing.T) {
+	s := newProxiedServer(t, "", "10.0.0.1")
+	h := s.redirectToHTTPS(http.NotFoundHandler(), ":443")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, proxiedRequest("10.0.0.1:5555", "X-Forwarded-Proto", "https"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, proxiedRequest("1.2.3.4:5555", "X-Forwarded-Proto", "https"))
+	require.Equal(t, "https://internal/feeds/rss.xml", w.Header().Get("Location"))
+	s = newProxiedServer(t, "https://blog.com", "10.0.0.1")
+	h = s.redirectToHTTPS(http.NotFoundHandler(), ":8443")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, proxiedRequest("10.0.0.1:5555", "X-Forwarded-Proto", "http"))
+	require.Equal(t, "https://blog.com/feeds/rss.xml", w.Header().Get("Location"))
+}
@@ -0,0 +1,259 @@
+package rtfblog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	// passwordResetTTL is how long a reset link is good for.
+	passwordResetTTL = time.Hour
+	// passwordResetMailInterval is the least time between two reset emails
+	// asked for from the same IP address to the same email address.
+	passwordResetMailInterval = 5 * time.Minute
+	// passwordResetLockout is the longest an address waits to ask again.
+	// Every request counts, the way failed logins do.
+	passwordResetLockout = time.Hour
+	// passwordResetName binds the signature of a link to its purpose, so
+	// that nothing else signed by the cookie keys passes for one.
+	passwordResetName = "password_reset"
+)
+
+// passwordResetEnabled tells whether the reset links can be sent. The link
+// has to point to base_url: the Host header is whatever whoever asks for it
+// wants it to be.
+func (s *server) passwordResetEnabled() bool {
+	conf := s.config()
+	return conf.Notifications.SendEmail && conf.Server.BaseURL != ""
+}
+
+// passwdFingerprint stands in for the password hash in a reset link. Any
+// change of the password, the reset itself included, changes it, which
+// makes a link good only once.
+func passwdFingerprint(a *Author) string {
+	sum := sha256.Sum256([]byte(a.Passwd))
+	return hex.EncodeToString(sum[:16])
+}
+
+// resetCodecs sign and encrypt the reset links with the current cookie keys.
+func (s *server) resetCodecs() ([]securecookie.Codec, error) {
+	pairs, err := cookieKeyPairs(&s.config().Server)
+	if err != nil {
+		return nil, err
+	}
+	codecs := securecookie.CodecsFromPairs(pairs...)
+	for _, c := range codecs {
+		c.(*securecookie.SecureCookie).MaxAge(int(passwordResetTTL / time.Second))
+	}
+	return codecs, nil
+}
+
+func (s *server) newResetToken(a *Author) (string, error) {
+	codecs, err := s.resetCodecs()
+	if err != nil {
+		return "", err
+	}
+	return securecookie.EncodeMulti(passwordResetName, passwdFingerprint(a), codecs...)
+}
+
+// checkResetToken tells whether token is a fresh link for the password a
+// has now.
+func (s *server) checkResetToken(a *Author, token string) bool {
+	codecs, err := s.resetCodecs()
+	if err != nil {
+		return false
+	}
+	var fingerprint string
+	if securecookie.DecodeMulti(passwordResetName, token, &fingerprint, codecs...) != nil {
+		return false
+	}
+	return fingerprint == passwdFingerprint(a)
+}
+
+func mkPasswordResetEmail(blogTitle, link, ip string) (subj, body string) {
+	subj = fmt.Sprintf("Password reset for '%s'", blogTitle)
+	body = fmt.Sprintf(`
+Someone, hopefully you, asked to reset the password of '%s' from %s.
+Follow this link within %s to choose a new one:
+
+%s
+
+If it was not you, ignore this email, the password stays as it is.
+`, blogTitle, ip, passwordResetTTL, link)
+	return subj, body
+}
+
+func (s *server) renderResetPassword(w http.ResponseWriter, ctx *Context, token string) error {
+	tmplData := MkBasicData(ctx, 0, 0, *s.config())
+	tmplData["PageTitle"] = L10n("Reset Password")
+	tmplData["Token"] = token
+	return tmpl(ctx, "reset_password.html").Execute(w, tmplData)
+}
+
+func (s *server) forgotPasswordForm(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	if !s.passwordResetEnabled() {
+		return performStatus(ctx, w, req, http.StatusNotFound)
+	}
+	return s.renderResetPassword(w, ctx, "")
+}
+
+// forgotPassword emails a reset link to the author, if the user name or the
+// email matches theirs. The answer is the same either way, so that it does
+// not tell what the user name is.
+func (s *server) forgotPassword(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	if !s.passwordResetEnabled() {
+		return performStatus(ctx, w, req, http.StatusNotFound)
+	}
+	ip := s.clientIP(req)
+	if wait := s.resetThrottle.begin(ip, "", 0, passwordResetLockout); wait > 0 {
+		secs := int((wait + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+		w.WriteHeader(http.StatusTooManyRequests)
+		ctx.Session.AddFlash(fmt.Sprintf(L10n("Too many requests, try again in %d seconds."), secs))
+		return s.renderResetPassword(w, ctx, "")
+	}
+	name := strings.TrimSpace(req.FormValue("uname"))
+	a, err := ctx.Db.author()
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	matches := err == nil && a.Email != "" && name != "" &&
+		(strings.EqualFold(name, a.UserName) || strings.EqualFold(name, a.Email))
+	log := ctx.Log.With(slog.String("ip", ip), slog.String("user_agent", req.UserAgent()))
+	if matches && s.resetMails.reserve(ip, a.Email) {
+		token, err := s.newResetToken(a)
+		if err != nil {
+			return err
+		}
+		link := s.baseURL(req) + "/reset_password?token=" + url.QueryEscape(token)
+		subj, body := mkPasswordResetEmail(s.config().Interface.BlogTitle, link, ip)
+		s.notify(a.Email, subj, body)
+		log.Info("Password reset link sent", slog.String("username", a.UserName))
+	} else {
+		log.Info("Password reset not sent", slog.Bool("matches", matches))
+	}
+	ctx.Session.AddFlash(L10n("If that is the author, a reset link is on its way to their email."))
+	http.Redirect(w, req, "/login", http.StatusSeeOther)
+	return nil
+}
+
+// resetMails remembers when a reset email last went out, per client IP and
+// email address. Keying on both keeps a stranger asking over and over from
+// using up the author's own turn.
+type resetMails struct {
+	mu   sync.Mutex
+	sent map[string]time.Time
+	now  func() time.Time
+}
+
+func newResetMails() *resetMails {
+	return &resetMails{
+		sent: map[string]time.Time{},
+		now:  time.Now,
+	}
+}
+
+// reserve tells whether it's been long enough since the last reset email
+// from ip to addr to send another one, and if so, takes the turn.
+func (r *resetMails) reserve(ip, addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	for key, at := range r.sent {
+		if now.Sub(at) >= passwordResetMailInterval {
+			delete(r.sent, key)
+		}
+	}
+	key := ip + " " + strings.ToLower(addr)
+	if _, ok := r.sent[key]; ok {
+		return false
+	}
+	r.sent[key] = now
+	return true
+}
+
+// resetLinkAuthor returns the author if the token of the request is good.
+// Otherwise it tells so and shows the form to ask for a new link.
+func (s *server) resetLinkAuthor(w http.ResponseWriter, req *http.Request, ctx *Context) (*Author, error) {
+	a, err := ctx.Db.author()
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err == nil && s.checkResetToken(a, req.FormValue("token")) {
+		return a, nil
+	}
+	ctx.Session.AddFlash(L10n("The reset link is wrong, used or expired. Ask for a new one."))
+	return nil, s.renderResetPassword(w, ctx, "")
+}
+
+func (s *server) resetPasswordForm(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	if !s.passwordResetEnabled() {
+		return performStatus(ctx, w, req, http.StatusNotFound)
+	}
+	token := req.FormValue("token")
+	req.URL.RawQuery = "token=***" // Avoid spilling the token to log
+	a, err := s.resetLinkAuthor(w, req, ctx)
+	if a == nil {
+		return err
+	}
+	return s.renderResetPassword(w, ctx, token)
+}
+
+// resetPassword sets the password a reset link was followed for, and logs
+// everyone out.
+func (s *server) resetPassword(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	if !s.passwordResetEnabled() {
+		return performStatus(ctx, w, req, http.StatusNotFound)
+	}
+	a, err := s.resetLinkAuthor(w, req, ctx)
+	if a == nil {
+		return err
+	}
+	token := req.FormValue("token")
+	passwd := req.FormValue("password")
+	passwd2 := req.FormValue("confirm_password")
+	req.Form["password"] = []string{"***"}         // Avoid spilling password to log
+	req.Form["confirm_password"] = []string{"***"} // Avoid spilling password to log
+	if passwd != passwd2 {
+		ctx.Session.AddFlash(L10n("Passwords should match."))
+		return s.renderResetPassword(w, ctx, token)
+	}
+	if err := checkPasswd(passwd, a.UserName); err != nil {
+		ctx.Session.AddFlash(err.Error())
+		return s.renderResetPassword(w, ctx, token)
+	}
+	a.Passwd, err = encryptBcrypt([]byte(passwd))
+	if err != nil {
+		return err
+	}
+	err = withTransaction(ctx.Db, func(db Data) error {
+		return db.updateAuthor(a)
+	})
+	if err != nil {
+		return err
+	}
+	if err := renewSession(ctx.Session); err != nil {
+		return err
+	}
+	if err := ctx.Db.deleteSessions(""); err != nil {
+		return err
+	}
+	ip := s.clientIP(req)
+	s.throttle.succeed(ip, a.UserName)
+	ctx.Log.Info("Password reset, all sessions revoked", slog.String("username", a.UserName),
+		slog.String("ip", ip))
+	ctx.Session.AddFlash(L10n("The password is changed, log in with the new one."))
+	http.Redirect(w, req, "/login", http.StatusSeeOther)
+	return nil
+}
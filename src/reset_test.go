@@ -0,0 +1,210 @@
+package rtfblog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var resetLink = regexp.MustCompile(`(http\S+/reset_password)\?token=(\S+)`)
+
+type sentMail struct {
+	to, subj, body string
+}
+
+// newResetClient is a totpClient whose blog sends reset links, to the
+// returned list instead of Gmail.
+func newResetClient(t *testing.T) (*totpClient, func() []sentMail) {
+	var mu sync.Mutex
+	var mails []sentMail
+	c := newTOTPClient(t, Author{Email: "joe@example.com"}, func(s *server) {
+		s.sendMail = func(conf *Notifications, to, subj, body string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			mails = append(mails, sentMail{to, subj, body})
+			return nil
+		}
+	})
+	conf := *c.s.config()
+	conf.Notifications.SendEmail = true
+	conf.Server.BaseURL = c.ts.URL + "/"
+	c.s.setConfig(conf)
+	sent := func() []sentMail {
+		c.s.notifs.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]sentMail(nil), mails...)
+	}
+	return c, sent
+}
+
+func TestPasswordResetDisabled(t *testing.T) {
+	c := newTOTPClient(t, Author{Email: "joe@example.com"})
+	_, page := c.get("/login")
+	require.NotContains(t, page, "forgot-password")
+	for _, path := range []string{"/forgot_password", "/reset_password?token=x"} {
+		status, _ := c.get(path)
+		require.Equal(t, http.StatusNotFound, status, path)
+	}
+	status, _ := c.post("/forgot_password", url.Values{"uname": {"joe"}})
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestPasswordReset(t *testing.T) {
+	c, sent := newResetClient(t)
+	_, page := c.get("/login")
+	require.Contains(t, page, "forgot-password")
+	laptop := c.c
+	status, _ := c.post("/login", url.Values{"uname": {"joe"}, "passwd": {"testpasswd"}})
+	require.Equal(t, http.StatusSeeOther, status)
+
+	// Nobody tells a stranger from the author:
+	c.c = newBrowser(t)
+	status, _ = c.post("/forgot_password", url.Values{"uname": {"bob"}})
+	require.Equal(t, http.StatusSeeOther, status)
+	_, stranger := c.get("/login")
+	require.Empty(t, sent())
+	c.c = newBrowser(t)
+	status, _ = c.post("/forgot_password", url.Values{"uname": {"JOE@example.com"}})
+	require.Equal(t, http.StatusSeeOther, status)
+	_, page = c.get("/login")
+	require.Equal(t, stranger, page)
+	require.Contains(t, page, "a reset link is on its way")
+	mails := sent()
+	require.Len(t, mails, 1)
+	require.Equal(t, "joe@example.com", mails[0].to)
+	m := resetLink.FindStringSubmatch(mails[0].body)
+	require.NotNil(t, m, mails[0].body)
+	require.Equal(t, c.ts.URL+"/reset_password", m[1])
+	token, err := url.QueryUnescape(m[2])
+	require.NoError(t, err)
+
+	// Not another mail so soon:
+	status, _ = c.post("/forgot_password", url.Values{"uname": {"joe"}})
+	require.Equal(t, http.StatusSeeOther, status)
+	require.Len(t, sent(), 1)
+
+	status, page = c.get("/reset_password?token=" + m[2])
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, page, `name="confirm_password"`)
+	status, page = c.post("/reset_password", url.Values{
+		"token":            {token},
+		"password":         {"new-passwd-2024"},
+		"confirm_password": {"other-passwd-2024"},
+	})
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, page, "Passwords should match.")
+	status, _ = c.post("/reset_password", url.Values{
+		"token":            {token},
+		"password":         {"new-passwd-2024"},
+		"confirm_password": {"new-passwd-2024"},
+	})
+	require.Equal(t, http.StatusSeeOther, status)
+	require.NoError(t, BcryptHelper{}.Decrypt([]byte(c.author().Passwd), []byte("new-passwd-2024")))
+
+	// Everyone is logged out, and the link is spent:
+	status, _ = c.get("/admin")
+	require.Equal(t, http.StatusForbidden, status)
+	c.c = laptop
+	status, _ = c.get("/admin")
+	require.Equal(t, http.StatusForbidden, status)
+	status, page = c.get("/reset_password?token=" + m[2])
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, page, "The reset link is wrong, used or expired.")
+	require.NotContains(t, page, `name="confirm_password"`)
+	status, _ = c.post("/reset_password", url.Values{
+		"token":            {token},
+		"password":         {"evil-passwd-2024"},
+		"confirm_password": {"evil-passwd-2024"},
+	})
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, BcryptHelper{}.Decrypt([]byte(c.author().Passwd), []byte("new-passwd-2024")))
+
+	status, _ = c.post("/login", url.Values{"uname": {"joe"}, "passwd": {"new-passwd-2024"}})
+	require.Equal(t, http.StatusSeeOther, status)
+	status, _ = c.get("/admin")
+	require.Equal(t, http.StatusOK, status)
+}
+
+func TestResetToken(t *testing.T) {
+	c, _ := newResetClient(t)
+	a := c.author()
+	token, err := c.s.newResetToken(a)
+	require.NoError(t, err)
+	require.True(t, c.s.checkResetToken(a, token))
+	require.False(t, c.s.checkResetToken(a, strings.ToUpper(token)))
+	require.False(t, c.s.checkResetToken(a, ""))
+
+	// A session cookie is signed by the same keys, but is no reset link:
+	store := c.s.gctx.Store.(*dbStore)
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, err := store.New(req, passwordResetName)
+	require.NoError(t, err)
+	sess.Values["adminlogin"] = "yes"
+	w := httptest.NewRecorder()
+	require.NoError(t, store.Save(req, w, sess))
+	require.False(t, c.s.checkResetToken(a, w.Result().Cookies()[0].Value))
+
+	// Nor is a link for an older password:
+	other := *a
+	other.Passwd += "x"
+	token, err = c.s.newResetToken(&other)
+	require.NoError(t, err)
+	require.False(t, c.s.checkResetToken(a, token))
+}
+
+func TestForgotPasswordThrottle(t *testing.T) {
+	c, sent := newResetClient(t)
+	for range loginFreeAttempts {
+		status, _ := c.post("/forgot_password", url.Values{"uname": {"nobody"}})
+		require.Equal(t, http.StatusSeeOther, status)
+	}
+	resp, err := c.c.PostForm(c.ts.URL+"/forgot_password", url.Values{"uname": {"joe"}})
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("Retry-After"))
+	require.Empty(t, sent())
+}
+
+func TestResetMailPerIP(t *testing.T) {
+	c, sent := newResetClient(t)
+	conf := *c.s.config()
+	conf.Server.TrustedProxies = []string{"127.0.0.1", "::1"}
+	c.s.setConfig(conf)
+	forgot := func(ip string) {
+		req, err := http.NewRequest("POST", c.ts.URL+"/forgot_password",
+			strings.NewReader(url.Values{"uname": {"joe"}}.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", ip)
+		status, _ := c.do(c.c.Do(req))
+		require.Equal(t, http.StatusSeeOther, status)
+	}
+	forgot("6.6.6.6")
+	forgot("6.6.6.6")
+	require.Len(t, sent(), 1)
+	// The stranger's turn is not the author's:
+	forgot("5.6.7.8")
+	require.Len(t, sent(), 2)
+}
+
+func TestResetMailsReserve(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	r := newResetMails()
+	r.now = func() time.Time { return now }
+	require.True(t, r.reserve("1.2.3.4", "joe@example.com"))
+	require.False(t, r.reserve("1.2.3.4", "JOE@example.com"))
+	require.True(t, r.reserve("5.6.7.8", "joe@example.com"))
+	require.True(t, r.reserve("1.2.3.4", "bob@example.com"))
+	now = now.Add(passwordResetMailInterval)
+	require.True(t, r.reserve("1.2.3.4", "joe@example.com"))
+	require.Len(t, r.sent, 1, "the old turns are forgotten")
+}
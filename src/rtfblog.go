@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -12,17 +13,18 @@ import (
 	"math/rand"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	textTemplate "text/template"
 	"time"
 
 	"github.com/docopt/docopt-go"
 	"github.com/gorilla/feeds"
 	"github.com/gorilla/pat"
-	"github.com/jinzhu/gorm"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -37,8 +39,20 @@ const (
 	usage = `rtfblog. A standalone personal blog server.
 
 Usage:
-  rtfblog
+  rtfblog [--migrate]
+  rtfblog --migrate-status
+  rtfblog --migrate-down <n>
   rtfblog --adduser <username> <email> <web> <display name>
+  rtfblog --reset-2fa
+  rtfblog --gen-cookie-key
+  rtfblog --export <dir> [--base-url=<url>]
+  rtfblog --import-wxr <file> [--redirect-map=<map>]
+  rtfblog --import-md <dir>
+  rtfblog --export-md <dir> [--with-comments]
+  rtfblog --backup <archive>
+  rtfblog --restore <archive> [--force]
+  rtfblog --copy-db <from> <to> [--force]
+  rtfblog --hot-backup <file>
   rtfblog -h | --help
   rtfblog --version
 
@@ -46,7 +60,42 @@ Options:
   With no arguments it simply runs the server (with either hardcoded config or
   a config it finds in one of locations described in README).
   -h --help     Show this screen.
-  --version     Show version.`
+  --version     Show version.
+  --migrate     Upgrade the database schema before starting the server. The
+                server refuses to start on an outdated schema without it.
+  --migrate-status  Show the schema version and the migrations applied.
+  --migrate-down  Revert the <n> latest schema migrations.
+  --reset-2fa   Turn off the two-factor authentication of the author, when
+                both the authenticator and the recovery codes are lost.
+  --gen-cookie-key  Print a new pair of keys to sign and encrypt the session
+                cookie with, for cookie_keys.
+  --export      Render the public part of the blog as a static site to <dir>.
+                Re-exporting to the same directory only rewrites the files
+                that have changed.
+  --base-url=<url>  The URL the exported site will be published at. Only used
+                for absolute links in the feed. Defaults to base_url.
+  --import-wxr  Import posts, tags and comments from a WordPress export file.
+                Importing the same file again updates the posts in place.
+  --redirect-map=<map>  Where to write the map of old permalinks to the new
+                ones, in nginx map format [default: redirects.map].
+  --import-md   Import posts from Markdown files with YAML front matter
+                (title, slug, date, tags, hidden) found in <dir>.
+  --export-md   Export all posts to Markdown files with front matter.
+  --with-comments  Also export comments, to a <slug>.comments.json file next
+                to each post. --import-md picks them up too.
+  --backup      Write all tables and uploaded files to a .tar.gz <archive>.
+  --restore     Replace the contents of the configured database with the
+                ones from <archive>. The database may be of a different
+                kind than the one the backup was made from, and the backup
+                of an older version, it's migrated up as it's restored.
+  --copy-db     Copy all tables from one database to another, e.g. from
+                SQLite to Postgres. <from> and <to> are connection strings:
+                postgres:// URLs or key=value lists for Postgres, mysql://
+                URLs or user:passwd@tcp(host)/db DSNs for MySQL, file paths
+                for SQLite. <to> gets migrated if needed.
+  --force       Restore or copy even if the database is not empty.
+  --hot-backup  Copy an SQLite database to <file> while the server keeps
+                running.`
 	defaultCookieSecret = "dont-forget-to-change-me"
 )
 
@@ -66,10 +115,9 @@ func listOfPages(numPosts, currPage int) template.HTML {
 	return template.HTML(list)
 }
 
-func (s *server) produceFeedXML(w http.ResponseWriter, req *http.Request, posts []*Entry, ctx *Context) {
-	url := httputil.AddProtocol(httputil.GetHost(req), "http")
-	blogTitle := s.conf.Interface.BlogTitle
-	descr := s.conf.Interface.BlogDescr
+func (s *server) produceFeedXML(w http.ResponseWriter, url string, posts []*Entry, ctx *Context) {
+	blogTitle := s.config().Interface.BlogTitle
+	descr := s.config().Interface.BlogDescr
 	author, err := ctx.Db.author()
 	if err != nil {
 		s.gctx.Log.Error("DB.author", E(err))
@@ -105,18 +153,19 @@ func (s *server) produceFeedXML(w http.ResponseWriter, req *http.Request, posts
 func (s *server) home(w http.ResponseWriter, req *http.Request, ctx *Context) error {
 	if req.URL.Path == "/" {
 		_, err := ctx.Db.author() // Pick default author
-		if err == gorm.ErrRecordNotFound {
-			// Author was not configured yet, so pretend this is an admin
-			// session and show the Edit Author form:
-			ctx.Session.Values["adminlogin"] = "yes"
-			return s.editAuthorForm(w, req, ctx)
+		if errors.Is(err, ErrNotFound) && s.setup.pending() {
+			http.Redirect(w, req, "/setup", http.StatusSeeOther)
+			return nil
 		}
-		return tmpl(ctx, "main.html").Execute(w, MkBasicData(ctx, 0, 0, s.conf))
+		return tmpl(ctx, "main.html").Execute(w, MkBasicData(ctx, 0, 0, *s.config()))
 	}
 	post, err := ctx.Db.post(req.URL.Path[1:], ctx.AdminLogin)
-	if err == nil && post != nil {
+	if err != nil {
+		return err
+	}
+	if post != nil {
 		ctx.Captcha.SetNextTask(-1)
-		tmplData := MkBasicData(ctx, 0, 0, s.conf)
+		tmplData := MkBasicData(ctx, 0, 0, *s.config())
 		tmplData["PageTitle"] = post.Title
 		tmplData["entry"] = post
 		task := *ctx.Captcha.NextTask()
@@ -136,22 +185,25 @@ func (s *server) pageNum(w http.ResponseWriter, req *http.Request, ctx *Context)
 	}
 	pgNo--
 	offset := pgNo * PostsPerPage
-	return tmpl(ctx, "main.html").Execute(w, MkBasicData(ctx, pgNo, offset, s.conf))
+	return tmpl(ctx, "main.html").Execute(w, MkBasicData(ctx, pgNo, offset, *s.config()))
 }
 
 func (s *server) admin(w http.ResponseWriter, req *http.Request, ctx *Context) error {
-	if s.conf.Server.CookieSecret == defaultCookieSecret {
-		ctx.Session.AddFlash(L10n("You are using default cookie secret, consider changing."))
+	if usesDefaultCookieSecret(&s.config().Server) {
+		ctx.Session.AddFlash(L10n("You are using the default cookie secret, generate cookie_keys with rtfblog --gen-cookie-key."))
 	}
-	return tmpl(ctx, "admin.html").Execute(w, MkBasicData(ctx, 0, 0, s.conf))
+	return tmpl(ctx, "admin.html").Execute(w, MkBasicData(ctx, 0, 0, *s.config()))
 }
 
 func (s *server) loginForm(w http.ResponseWriter, req *http.Request, ctx *Context) error {
-	return tmpl(ctx, "login.html").Execute(w, MkBasicData(ctx, 0, 0, s.conf))
+	tmplData := MkBasicData(ctx, 0, 0, *s.config())
+	tmplData["PasswordReset"] = s.passwordResetEnabled()
+	return tmpl(ctx, "login.html").Execute(w, tmplData)
 }
 
 func logout(w http.ResponseWriter, req *http.Request, ctx *Context) error {
-	delete(ctx.Session.Values, "adminlogin")
+	// Deletes the session on save:
+	ctx.Session.Options.MaxAge = -1
 	http.Redirect(w, req, ctx.routeByName("home_page"), http.StatusSeeOther)
 	return nil
 }
@@ -159,7 +211,7 @@ func logout(w http.ResponseWriter, req *http.Request, ctx *Context) error {
 func (s *server) postsWithTag(w http.ResponseWriter, req *http.Request, ctx *Context) error {
 	tag := req.URL.Query().Get(":tag")
 	heading := fmt.Sprintf(L10n("Posts tagged '%s'"), tag)
-	tmplData := MkBasicData(ctx, 0, 0, s.conf)
+	tmplData := MkBasicData(ctx, 0, 0, *s.config())
 	tmplData["PageTitle"] = heading
 	tmplData["HeadingText"] = heading + ":"
 	titles, err := ctx.Db.titlesByTag(tag, ctx.AdminLogin)
@@ -171,7 +223,7 @@ func (s *server) postsWithTag(w http.ResponseWriter, req *http.Request, ctx *Con
 }
 
 func (s *server) archive(w http.ResponseWriter, req *http.Request, ctx *Context) error {
-	tmplData := MkBasicData(ctx, 0, 0, s.conf)
+	tmplData := MkBasicData(ctx, 0, 0, *s.config())
 	tmplData["PageTitle"] = L10n("Archive")
 	tmplData["HeadingText"] = L10n("All posts:")
 	titles, err := ctx.Db.titles(-1, ctx.AdminLogin)
@@ -183,7 +235,7 @@ func (s *server) archive(w http.ResponseWriter, req *http.Request, ctx *Context)
 }
 
 func (s *server) allComments(w http.ResponseWriter, req *http.Request, ctx *Context) error {
-	tmplData := MkBasicData(ctx, 0, 0, s.conf)
+	tmplData := MkBasicData(ctx, 0, 0, *s.config())
 	comm, err := ctx.Db.allComments()
 	if err != nil {
 		return err
@@ -201,7 +253,7 @@ func makeTagList(tags []*Tag) []string {
 }
 
 func (s *server) editPost(w http.ResponseWriter, req *http.Request, ctx *Context) error {
-	tmplData := MkBasicData(ctx, 0, 0, s.conf)
+	tmplData := MkBasicData(ctx, 0, 0, *s.config())
 	tmplData["PageTitle"] = L10n("Edit Post")
 	tmplData["IsHidden"] = true // Assume hidden for a new post
 	tags, err := ctx.Db.queryAllTags()
@@ -240,39 +292,135 @@ func (s *server) rssFeed(w http.ResponseWriter, req *http.Request, ctx *Context)
 	if err != nil {
 		return fmt.Errorf("rssFeed load posts: %w", err)
 	}
-	s.produceFeedXML(w, req, posts, ctx)
+	s.produceFeedXML(w, s.baseURL(req), posts, ctx)
 	return nil
 }
 
 func (s *server) login(w http.ResponseWriter, req *http.Request, ctx *Context) error {
 	// TODO: should not be already logged in, add check
+	uname := req.FormValue("uname")
+	passwd := req.FormValue("passwd")
+	req.Form["passwd"] = []string{"***"} // Avoid spilling password to log
+	at := s.newLoginAttempt(req, uname, "password")
+	if wait := s.beginLogin(at); wait > 0 {
+		return s.loginRefused(w, req, ctx, at, wait, s.loginForm)
+	}
 	a, err := ctx.Db.author() // Pick default author
-	if err == gorm.ErrRecordNotFound {
-		ctx.Session.AddFlash(L10n("Login failed."))
-		return s.loginForm(w, req, ctx)
+	if errors.Is(err, ErrNotFound) {
+		return s.loginFailed(w, req, ctx, at, s.loginForm)
 	}
 	if err != nil {
 		return fmt.Errorf("login default author: %w", err)
 	}
-	uname := req.FormValue("uname")
 	if uname != a.UserName {
-		ctx.Session.AddFlash(L10n("Login failed."))
-		return s.loginForm(w, req, ctx)
+		return s.loginFailed(w, req, ctx, at, s.loginForm)
 	}
-	passwd := req.FormValue("passwd")
-	req.Form["passwd"] = []string{"***"} // Avoid spilling password to log
 	err = s.cryptoHelper.Decrypt([]byte(a.Passwd), []byte(passwd))
-	if err == nil {
-		ctx.Session.Values["adminlogin"] = "yes"
-		redir := req.FormValue("redirect_to")
-		if redir == "login" {
-			redir = ""
+	if err != nil {
+		return s.loginFailed(w, req, ctx, at, s.loginForm)
+	}
+	redir := req.FormValue("redirect_to")
+	if redir == "login" {
+		redir = ""
+	}
+	if a.TOTPSecret != "" {
+		// The attempt stays counted until the code is in too.
+		ctx.Session.Values[totpSessUser] = uname
+		ctx.Session.Values[totpSessTime] = time.Now().Unix()
+		ctx.Session.Values[totpSessRedirect] = redir
+		return s.loginTOTPForm(w, req, ctx)
+	}
+	return s.loggedIn(w, req, ctx, at, redir)
+}
+
+// loginAttempt is what the login steps throttle and log an attempt by.
+type loginAttempt struct {
+	uname string
+	ip    string
+	attrs []any
+}
+
+func (s *server) newLoginAttempt(req *http.Request, uname, step string) loginAttempt {
+	ip := s.clientIP(req)
+	return loginAttempt{
+		uname: uname,
+		ip:    ip,
+		attrs: []any{
+			slog.String("username", uname),
+			slog.String("ip", ip),
+			slog.String("user_agent", req.UserAgent()),
+			slog.String("step", step),
+		},
+	}
+}
+
+// beginLogin tells how long the attempt has to wait, or counts it as failed
+// until loggedIn says otherwise.
+func (s *server) beginLogin(at loginAttempt) time.Duration {
+	conf := s.config()
+	return s.throttle.begin(at.ip, at.uname, conf.Server.LoginMaxFailures, conf.Server.LoginLockout)
+}
+
+// loginFailed logs the failure that beginLogin has counted, and shows the
+// form again.
+func (s *server) loginFailed(w http.ResponseWriter, req *http.Request, ctx *Context, at loginAttempt, form handlerFunc) error {
+	s.mets.numFailedLogins.Inc()
+	wait := s.throttle.wait(at.ip, at.uname)
+	ctx.Log.Warn("Login failed", at.attrs...)
+	if wait > 0 {
+		return s.loginThrottled(w, req, ctx, wait, form)
+	}
+	ctx.Session.AddFlash(L10n("Login failed."))
+	return form(w, req, ctx)
+}
+
+// loginRefused turns away an attempt that came before its wait was over.
+func (s *server) loginRefused(w http.ResponseWriter, req *http.Request, ctx *Context, at loginAttempt, wait time.Duration, form handlerFunc) error {
+	s.mets.numThrottledLogins.Inc()
+	ctx.Log.Warn("Login throttled", append(at.attrs, slog.Duration("wait", wait))...)
+	return s.loginThrottled(w, req, ctx, wait, form)
+}
+
+// loginThrottled tells to come back once wait is over.
+func (s *server) loginThrottled(w http.ResponseWriter, req *http.Request, ctx *Context, wait time.Duration, form handlerFunc) error {
+	secs := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	w.WriteHeader(http.StatusTooManyRequests)
+	ctx.Session.AddFlash(fmt.Sprintf(L10n("Too many failed logins, try again in %d seconds."), secs))
+	return form(w, req, ctx)
+}
+
+// checkPassword checks the password of the author before a change that takes
+// it. It's throttled and counted the same way the logins are, so that a
+// stolen session is no way to guess the password. Unless it's right, it
+// shows the author form again and tells false.
+func (s *server) checkPassword(w http.ResponseWriter, req *http.Request, ctx *Context, a *Author, passwd, step string) (bool, error) {
+	at := s.newLoginAttempt(req, a.UserName, step)
+	if wait := s.beginLogin(at); wait > 0 {
+		return false, s.loginRefused(w, req, ctx, at, wait, s.editAuthorForm)
+	}
+	if s.cryptoHelper.Decrypt([]byte(a.Passwd), []byte(passwd)) != nil {
+		s.mets.numFailedLogins.Inc()
+		ctx.Log.Warn("Incorrect password", at.attrs...)
+		if wait := s.throttle.wait(at.ip, at.uname); wait > 0 {
+			return false, s.loginThrottled(w, req, ctx, wait, s.editAuthorForm)
 		}
-		http.Redirect(w, req, "/"+redir, http.StatusSeeOther)
-	} else {
-		ctx.Session.AddFlash(L10n("Login failed."))
-		return s.loginForm(w, req, ctx)
+		ctx.Session.AddFlash(L10n("Incorrect password."))
+		return false, s.editAuthorForm(w, req, ctx)
+	}
+	s.throttle.succeed(at.ip, at.uname)
+	return true, nil
+}
+
+func (s *server) loggedIn(w http.ResponseWriter, req *http.Request, ctx *Context, at loginAttempt, redir string) error {
+	s.throttle.succeed(at.ip, at.uname)
+	ctx.Log.Info("Logged in", at.attrs...)
+	if err := renewSession(ctx.Session); err != nil {
+		return err
 	}
+	ctx.Session.Values["adminlogin"] = "yes"
+	ctx.Session.Values[csrfSessKey] = newCSRFToken()
+	http.Redirect(w, req, "/"+redir, http.StatusSeeOther)
 	return nil
 }
 
@@ -285,17 +433,50 @@ func deleteComment(w http.ResponseWriter, req *http.Request, ctx *Context) error
 		if err != nil {
 			return fmt.Errorf("DeleteComment id=%s: %w", id, err)
 		}
+		ctx.pages.invalidate()
 	}
 	http.Redirect(w, req, "/"+redir, http.StatusSeeOther)
 	return nil
 }
 
+// confirmDelete asks whether to go on with deleting, it's where the links
+// to the delete actions lead when scripts don't post them right away.
+func (s *server) confirmDelete(w http.ResponseWriter, ctx *Context, question, action, cancelURL string, fields map[string]string) error {
+	tmplData := MkBasicData(ctx, 0, 0, *s.config())
+	tmplData["PageTitle"] = L10n("Delete")
+	tmplData["Question"] = question
+	tmplData["Action"] = action
+	tmplData["Fields"] = fields
+	tmplData["CancelURL"] = cancelURL
+	return tmpl(ctx, "confirm_delete.html").Execute(w, tmplData)
+}
+
+func (s *server) confirmDeleteComment(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	redir := req.FormValue("redirect_to")
+	return s.confirmDelete(w, ctx,
+		L10n("You are about to delete this comment!\nThis cannot be undone!"),
+		ctx.routeByName("delete_comment"), "/"+redir, map[string]string{
+			"id":          req.FormValue("id"),
+			"action":      "delete",
+			"redirect_to": redir,
+		})
+}
+
+func (s *server) confirmDeletePost(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	id := req.FormValue("id")
+	return s.confirmDelete(w, ctx,
+		L10n("You are about to delete this post!\nThis cannot be undone!"),
+		ctx.routeByName("delete_post"), ctx.routeByName("edit_post")+"?post="+url.QueryEscape(id),
+		map[string]string{"id": id})
+}
+
 func deletePost(w http.ResponseWriter, req *http.Request, ctx *Context) error {
 	id := req.FormValue("id")
 	err := ctx.Db.deletePost(id)
 	if err != nil {
 		return fmt.Errorf("DeletePost id=%s: %w", id, err)
 	}
+	ctx.pages.invalidate()
 	http.Redirect(w, req, ctx.routeByName("admin"), http.StatusSeeOther)
 	return nil
 }
@@ -309,6 +490,7 @@ func moderateComment(w http.ResponseWriter, req *http.Request, ctx *Context) err
 		if err != nil {
 			return fmt.Errorf("ModerateComment: can't updateComment for id=%s: %w", id, err)
 		}
+		ctx.pages.invalidate()
 	}
 	redir := req.FormValue("redirect_to")
 	http.Redirect(w, req, fmt.Sprintf("/%s#comment-%s", redir, id), http.StatusSeeOther)
@@ -332,6 +514,7 @@ func submitPost(w http.ResponseWriter, req *http.Request, ctx *Context) error {
 		return db.updateTags(explodeTags(req.FormValue("tags")), postID)
 	})
 	if err == nil {
+		ctx.pages.invalidate()
 		http.Redirect(w, req, "/"+url, http.StatusSeeOther)
 	}
 	return err
@@ -391,12 +574,12 @@ func (s *server) handleUpload(r *http.Request, p *multipart.Part, root string) {
 	log.Info("handleUpload ok, done", slog.Int64("num bytes written", nwritten))
 }
 
-func prepareCommenter(req *http.Request) *Commenter {
+func (s *server) prepareCommenter(req *http.Request) *Commenter {
 	return &Commenter{
 		Name:    req.FormValue("name"),
 		Email:   req.FormValue("email"),
 		Website: httputil.AddProtocol(req.FormValue("website"), "http"),
-		IP:      httputil.GetIPAddress(req),
+		IP:      s.clientIP(req),
 	}
 }
 
@@ -426,15 +609,15 @@ func (s *server) commentHandler(w http.ResponseWriter, req *http.Request, ctx *C
 	if err != nil {
 		return fmt.Errorf("commentHandler postID for url=%s: %w", refURL, err)
 	}
-	commenter := prepareCommenter(req)
+	commenter := s.prepareCommenter(req)
 	body := req.FormValue("text")
 	commenterID, err := ctx.Db.commenterID(commenter)
 	commentURL := ""
-	switch err {
-	case nil:
+	switch {
+	case err == nil:
 		// This is a returning commenter, pass his comment through:
 		commentURL, err = PublishComment(ctx.Db, postID, commenterID, body)
-	case gorm.ErrRecordNotFound:
+	case errors.Is(err, ErrNotFound):
 		if !captchaNewCommenter(w, req, ctx) {
 			return nil
 		}
@@ -452,20 +635,21 @@ func (s *server) commentHandler(w http.ResponseWriter, req *http.Request, ctx *C
 	if err != nil {
 		return err
 	}
+	ctx.pages.invalidate()
 	redir := "/" + refURL + commentURL
 	s.sendNewCommentNotif(req, redir, commenter)
 	return RightCaptchaReply(w, redir, s.gctx.Log)
 }
 
 func (s *server) sendNewCommentNotif(req *http.Request, redir string, commenter *Commenter) {
-	if !s.conf.Notifications.SendEmail {
+	if !s.config().Notifications.SendEmail {
 		return
 	}
 	refURL := httputil.ExtractReferer(req)
-	url := httputil.GetHost(req) + redir
+	url := s.baseURL(req) + redir
 	text := req.FormValue("text")
 	subj, body := mkCommentNotifEmail(commenter, text, url, refURL)
-	go s.sendEmail(subj, body, s.gctx.Log)
+	s.notify(s.config().Notifications.AdminEmail, subj, body)
 }
 
 func mkCommentNotifEmail(commenter *Commenter, rawBody, url, postTitle string) (subj, body string) {
@@ -493,30 +677,22 @@ URL: {{.URL}}
 	return subj, buff.String()
 }
 
-func (s *server) sendEmail(subj, body string, log *slog.Logger) {
-	gmailSenderAcct := s.conf.Notifications.SenderAcct
-	gmailSenderPasswd := s.conf.Notifications.SenderPasswd
-	notifee := s.conf.Notifications.AdminEmail
-	err := email.InitGmail(gmailSenderAcct, gmailSenderPasswd)
+// sendGmail sends an email to to, from the Gmail account of conf.
+func sendGmail(conf *Notifications, to, subj, body string) error {
+	err := email.InitGmail(conf.SenderAcct, conf.SenderPasswd)
 	if err != nil {
-		log.Error("sendEmail init gmail", E(err))
-		return
-	}
-	mess := email.NewBriefMessageFrom(subj, body, gmailSenderAcct, notifee)
-	err = mess.Send()
-	if err != nil {
-		log.Error("sendEmail send message", E(err))
-		return
+		return fmt.Errorf("init gmail: %w", err)
 	}
+	return email.NewBriefMessageFrom(subj, body, conf.SenderAcct, to).Send()
 }
 
 func (s *server) editAuthorForm(w http.ResponseWriter, req *http.Request, ctx *Context) error {
-	tmplData := MkBasicData(ctx, 0, 0, s.conf)
+	tmplData := MkBasicData(ctx, 0, 0, *s.config())
 	author, err := ctx.Db.author()
-	if err != nil && err != gorm.ErrRecordNotFound {
+	if err != nil && !errors.Is(err, ErrNotFound) {
 		return err
 	}
-	if err == gorm.ErrRecordNotFound {
+	if errors.Is(err, ErrNotFound) {
 		author.UserName = req.FormValue("username")
 		author.FullName = req.FormValue("display_name")
 		author.Email = req.FormValue("email")
@@ -524,7 +700,9 @@ func (s *server) editAuthorForm(w http.ResponseWriter, req *http.Request, ctx *C
 	}
 	tmplData["PageTitle"] = L10n("Edit Author")
 	tmplData["author"] = author
-	tmplData["EditExistingAuthor"] = err != gorm.ErrRecordNotFound
+	tmplData["EditExistingAuthor"] = !errors.Is(err, ErrNotFound)
+	tmplData["TOTPEnabled"] = author.TOTPSecret != ""
+	tmplData["RecoveryCodesLeft"] = len(strings.Fields(author.RecoveryCodes))
 	return tmpl(ctx, "edit_author.html").Execute(w, tmplData)
 }
 
@@ -534,16 +712,14 @@ func (s *server) submitAuthor(w http.ResponseWriter, req *http.Request, ctx *Con
 	email := req.FormValue("email")
 	www := req.FormValue("www")
 	a, err := ctx.Db.author()
-	if err != nil && err != gorm.ErrRecordNotFound {
+	if err != nil && !errors.Is(err, ErrNotFound) {
 		return err
 	}
-	if err != gorm.ErrRecordNotFound {
+	if !errors.Is(err, ErrNotFound) {
 		oldPasswd := req.FormValue("old_password")
 		req.Form["old_password"] = []string{"***"} // Avoid spilling password to log
-		err = s.cryptoHelper.Decrypt([]byte(a.Passwd), []byte(oldPasswd))
-		if err != nil {
-			ctx.Session.AddFlash(L10n("Incorrect password."))
-			return s.editAuthorForm(w, req, ctx)
+		if ok, err := s.checkPassword(w, req, ctx, a, oldPasswd, "edit_author"); !ok {
+			return err
 		}
 	}
 	passwd := req.FormValue("password")
@@ -554,24 +730,44 @@ func (s *server) submitAuthor(w http.ResponseWriter, req *http.Request, ctx *Con
 		ctx.Session.AddFlash(L10n("Passwords should match."))
 		return s.editAuthorForm(w, req, ctx)
 	}
+	if err := checkPasswd(passwd, username); err != nil {
+		ctx.Session.AddFlash(err.Error())
+		return s.editAuthorForm(w, req, ctx)
+	}
+	passwdChanged := s.cryptoHelper.Decrypt([]byte(a.Passwd), []byte(passwd)) != nil
 	crypt, err := encryptBcrypt([]byte(passwd))
 	if err != nil {
 		return err
 	}
 	err = withTransaction(ctx.Db, func(db Data) error {
 		_, err := InsertOrUpdateAuthor(db, &Author{
-			UserName: username,
-			FullName: displayname,
-			Email:    email,
-			Www:      www,
-			Passwd:   crypt,
+			UserName:      username,
+			FullName:      displayname,
+			Email:         email,
+			Www:           www,
+			Passwd:        crypt,
+			TOTPSecret:    a.TOTPSecret,
+			RecoveryCodes: a.RecoveryCodes,
 		})
 		return err
 	})
-	if err == nil {
-		http.Redirect(w, req, "/", http.StatusSeeOther)
+	if err != nil {
+		return err
 	}
-	return err
+	if passwdChanged {
+		// Whoever knew the old password may be logged in, log them all out,
+		// and keep this session under a new ID:
+		if err := renewSession(ctx.Session); err != nil {
+			return err
+		}
+		if err := ctx.Db.deleteSessions(""); err != nil {
+			return err
+		}
+		ctx.Log.Info("Password changed, all sessions revoked", slog.String("username", username))
+	}
+	ctx.pages.invalidate()
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+	return nil
 }
 
 func (s *server) initRoutes(logger *slog.Logger) *pat.Router {
@@ -602,6 +798,12 @@ func (s *server) initRoutes(logger *slog.Logger) *pat.Router {
 					performStatus(ctx, w, req, http.StatusForbidden)
 					return nil
 				}
+				if !safeMethod(req.Method) && !ctx.validCSRF(req) {
+					s.mets.numForbiddenResponses.Inc()
+					ctx.Log.Warn("Bad CSRF token", slog.String("path", req.URL.Path))
+					performStatus(ctx, w, req, http.StatusForbidden)
+					return nil
+				}
 				return f(w, req, ctx)
 			},
 			c:     &s.gctx,
@@ -618,35 +820,53 @@ func (s *server) initRoutes(logger *slog.Logger) *pat.Router {
 		mets:  s.mets,
 	}
 
-	r.Add(G, "/static/", http.FileServer(s.gctx.assets)).Name("static")
+	r.Add(G, "/static/", s.assetURLs.serve(precompressedFileServer(
+		s.gctx.assets, http.FileServer(s.gctx.assets),
+	))).Name("static")
+	// Before /login, which would match them as a prefix:
+	r.Add(G, "/login_totp", mkHandler(s.loginTOTPForm))
+	r.Add(P, "/login_totp", mkHandler(s.loginTOTP)).Name("login_totp")
 	r.Add(G, "/login", mkHandler(s.loginForm)).Name("login")
 	r.Add(P, "/login", mkHandler(s.login))
 	r.Add(G, "/logout", mkHandler(logout)).Name("logout")
 	r.Add(G, "/admin", mkAdminHandler(s.admin)).Name("admin")
-	r.Add(G, "/page/{pageNo:.*}", mkHandler(s.pageNum))
-	r.Add(G, "/tag/{tag:.+}", mkHandler(s.postsWithTag))
-	r.Add(G, "/archive", mkHandler(s.archive)).Name("archive")
+	r.Add(G, "/page/{pageNo:.*}", mkHandler(cached(s.pageNum)))
+	r.Add(G, "/tag/{tag:.+}", mkHandler(cached(s.postsWithTag)))
+	r.Add(G, "/archive", mkHandler(cached(s.archive))).Name("archive")
 	r.Add(G, "/all_comments", mkAdminHandler(s.allComments)).Name("all_comments")
 	r.Add(G, "/edit_post", mkAdminHandler(s.editPost)).Name("edit_post")
 	r.Add(G, "/load_comments", mkAdminHandler(loadComments)).Name("load_comments")
 	r.Add(G, "/feeds/rss.xml", mkHandler(s.rssFeed)).Name("rss_feed")
 	r.Add(G, "/favicon.ico", &faviconHangler).Name("favicon")
 	r.Add(G, "/comment_submit", mkHandler(s.commentHandler)).Name("comment")
-	r.Add(G, "/delete_comment", mkAdminHandler(deleteComment)).Name("delete_comment")
-	r.Add(G, "/delete_post", mkAdminHandler(deletePost)).Name("delete_post")
+	r.Add(G, "/delete_comment", mkAdminHandler(s.confirmDeleteComment))
+	r.Add(G, "/delete_post", mkAdminHandler(s.confirmDeletePost))
 	r.Add(G, "/robots.txt", mkHandler(s.serveRobots))
 	r.Add(G, "/edit_author", mkAdminHandler(s.editAuthorForm)).Name("edit_author")
+	r.Add(G, "/setup", mkHandler(s.setupForm)).Name("setup")
+	r.Add(G, "/totp_enroll", mkAdminHandler(s.totpEnrollForm)).Name("totp_enroll")
+	r.Add(G, "/sessions", mkAdminHandler(s.listSessions)).Name("sessions")
+	r.Add(G, "/forgot_password", mkHandler(s.forgotPasswordForm)).Name("forgot_password")
+	r.Add(G, "/reset_password", mkHandler(s.resetPasswordForm)).Name("reset_password")
 
+	r.Add(P, "/delete_comment", mkAdminHandler(deleteComment)).Name("delete_comment")
+	r.Add(P, "/delete_post", mkAdminHandler(deletePost)).Name("delete_post")
 	r.Add(P, "/moderate_comment", mkAdminHandler(moderateComment)).Name("moderate_comment")
 	r.Add(P, "/submit_post", mkAdminHandler(submitPost)).Name("submit_post")
 	r.Add(P, "/submit_author", mkAdminHandler(s.submitAuthor)).Name("submit_author")
 	r.Add(P, "/upload_images", mkAdminHandler(s.uploadImage)).Name("upload_image")
+	r.Add(P, "/setup", mkHandler(s.submitSetup))
+	r.Add(P, "/totp_enroll", mkAdminHandler(s.totpEnroll))
+	r.Add(P, "/totp", mkAdminHandler(s.manageTOTP)).Name("totp")
+	r.Add(P, "/revoke_session", mkAdminHandler(revokeSession)).Name("revoke_session")
+	r.Add(P, "/forgot_password", mkHandler(s.forgotPassword))
+	r.Add(P, "/reset_password", mkHandler(s.resetPassword))
 
 	r.Add(G, "/metrics", promhttp.HandlerFor(
 		s.mets.registry, promhttp.HandlerOpts{Registry: s.mets.registry},
 	))
 
-	r.Add(G, "/", mkHandler(s.home)).Name("home_page")
+	r.Add(G, "/", mkHandler(cached(s.home))).Name("home_page")
 	return r
 }
 
@@ -658,28 +878,14 @@ func versionString() string {
 	return strings.TrimSpace(string(ver))
 }
 
-func serveAndLogTLS(addr, cert, key string, h http.Handler, log *slog.Logger) {
-	err := http.ListenAndServeTLS(addr, cert, key, h)
-	if err != nil {
-		log.Error("ListenAndServeTLS failed", E(err))
-	}
-}
-
-func (s *server) runForever(handlers *pat.Router) {
-	s.gctx.Log.Info("The server is listening...")
-	host := os.Getenv("HOST")
-	addr := httputil.JoinHostAndPort(host, s.conf.Server.Port)
-	tlsPort := s.conf.Server.TLSPort
-	cert := s.conf.Server.TLSCert
-	key := s.conf.Server.TLSKey
-	if tlsPort != "" && assets.FileExistsNoErr(cert) && assets.FileExistsNoErr(key) {
-		tlsAddr := httputil.JoinHostAndPort(host, tlsPort)
-		go serveAndLogTLS(tlsAddr, cert, key, handlers, s.gctx.Log)
-	}
-	err := http.ListenAndServe(addr, handlers)
-	if err != nil {
-		s.gctx.Log.Error("ListenAndServe failed", E(err))
-	}
+// rootHandler wraps the routes with the middleware that applies to all of
+// them.
+func (s *server) rootHandler(logger *slog.Logger) http.Handler {
+	var h http.Handler = s.initRoutes(logger)
+	if s.config().Server.Compress {
+		h = newCompressingHandler(h, s.config().Server.CompressMinSize, s.config().Server.CompressTypes)
+	}
+	return h
 }
 
 func promptPasswd(username string) (string, error) {
@@ -696,13 +902,16 @@ func promptPasswd(username string) (string, error) {
 	if string(passwd2) != string(passwd) {
 		return "", fmt.Errorf("passwords do not match")
 	}
+	if err := checkPasswd(string(passwd), username); err != nil {
+		return "", err
+	}
 	crypt, err := encryptBcrypt(passwd)
 	return string(crypt), err
 }
 
-func insertUser(db *DbData, args map[string]interface{}) {
+func insertUser(db Data, args map[string]interface{}) {
 	_, err := db.author()
-	if err != gorm.ErrRecordNotFound {
+	if !errors.Is(err, ErrNotFound) {
 		fmt.Println(L10n("Author already added, can't add another, exiting"))
 		return
 	}
@@ -727,6 +936,221 @@ func insertUser(db *DbData, args map[string]interface{}) {
 	return
 }
 
+// resetTOTP is the way back in for an author locked out by the second login
+// step.
+func resetTOTP(db Data) {
+	err := withTransaction(db, func(db Data) error {
+		a, err := db.author()
+		if err != nil {
+			return err
+		}
+		a.TOTPSecret, a.RecoveryCodes = "", ""
+		return db.updateAuthor(a)
+	})
+	if err != nil {
+		fmt.Printf(L10n("Resetting two-factor authentication failed: %s\n"), err)
+		os.Exit(1)
+	}
+	fmt.Println(L10n("Two-factor authentication is off, log in with the password and enroll again."))
+}
+
+func exportSite(s *server, args map[string]interface{}) {
+	dir := args["<dir>"].(string)
+	baseURL, _ := args["--base-url"].(string)
+	if baseURL == "" {
+		baseURL = s.config().Server.BaseURL
+	}
+	stats, err := s.exportSite(dir, baseURL)
+	if err != nil {
+		fmt.Printf(L10n("Export failed: %s\n"), err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf(L10n("Exported to %s: %d files written, %d unchanged, %d removed\n"),
+		dir, stats.written, stats.unchanged, stats.removed)
+}
+
+func importWXRFile(db Data, args map[string]interface{}) {
+	f, err := os.Open(args["<file>"].(string))
+	if err != nil {
+		fmt.Printf(L10n("Import failed: %s\n"), err.Error())
+		os.Exit(1)
+	}
+	defer f.Close()
+	stats, err := importWXR(db, f)
+	if err != nil {
+		fmt.Printf(L10n("Import failed: %s\n"), err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf(L10n("Imported %d posts and %d comments\n"), stats.posts, stats.comments)
+	for _, r := range stats.renamed {
+		fmt.Printf(L10n("The URL %s is taken, imported the post as %s\n"), r.from, r.to)
+	}
+	if len(stats.redirects) == 0 {
+		return
+	}
+	mapFile := args["--redirect-map"].(string)
+	var buf bytes.Buffer
+	writeRedirectMap(&buf, stats.redirects)
+	if err := os.WriteFile(mapFile, buf.Bytes(), 0644); err != nil {
+		fmt.Printf(L10n("Import failed: %s\n"), err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf(L10n("Wrote %d redirects to %s\n"), len(stats.redirects), mapFile)
+}
+
+func importMarkdownDir(db Data, args map[string]interface{}) {
+	stats, err := importMarkdown(db, args["<dir>"].(string))
+	if err != nil {
+		fmt.Printf(L10n("Import failed: %s\n"), err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf(L10n("Imported %d posts and %d comments\n"), stats.posts, stats.comments)
+}
+
+func exportMarkdownDir(db Data, args map[string]interface{}) {
+	dir := args["<dir>"].(string)
+	n, err := exportMarkdown(db, dir, args["--with-comments"].(bool))
+	if err != nil {
+		fmt.Printf(L10n("Export failed: %s\n"), err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf(L10n("Exported %d posts to %s\n"), n, dir)
+}
+
+func backupToFile(s *server, args map[string]interface{}) {
+	fileName := args["<archive>"].(string)
+	m, err := writeBackupFile(fileName, s.gctx.Db, s.gctx.assets.WriteRoot())
+	if err != nil {
+		fmt.Printf(L10n("Backup failed: %s\n"), err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf(L10n("Backed up %d posts, %d comments and %d uploaded files to %s\n"),
+		m.Rows["post"], m.Rows["comment"], m.Uploads, fileName)
+}
+
+func restoreFromFile(s *server, args map[string]interface{}) {
+	fileName := args["<archive>"].(string)
+	f, err := os.Open(fileName)
+	if err != nil {
+		fmt.Printf(L10n("Restore failed: %s\n"), err.Error())
+		os.Exit(1)
+	}
+	defer f.Close()
+	m, err := restoreBackup(f, s.gctx.Db, s.gctx.assets.WriteRoot(), args["--force"].(bool))
+	if err != nil {
+		fmt.Printf(L10n("Restore failed: %s\n"), err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf(L10n("Restored %d posts, %d comments and %d uploaded files from %s\n"),
+		m.Rows["post"], m.Rows["comment"], m.Uploads, fileName)
+}
+
+// requireSQL exits unless db is an SQL database, for the commands that only
+// make sense with one.
+func requireSQL(db Data) *DbData {
+	dd, ok := db.(*DbData)
+	if !ok {
+		fmt.Println(L10n("This only works with an SQL database, not an in-memory one"))
+		os.Exit(1)
+	}
+	return dd
+}
+
+func newDbMigrator(db *DbData) *migrator {
+	m, err := newMigrator(db.db)
+	if err != nil {
+		fmt.Printf(L10n("Migration failed: %s\n"), err.Error())
+		os.Exit(1)
+	}
+	return m
+}
+
+func checkSchema(db *DbData, migrate bool) {
+	from, to, err := newDbMigrator(db).checkSchema(migrate)
+	if err != nil {
+		fmt.Printf(L10n("Can't use the database: %s\n"), err.Error())
+		os.Exit(1)
+	}
+	if from != to {
+		db.log.Info("Migrated database schema", slog.Int("from", from), slog.Int("to", to))
+	}
+}
+
+func migrateStatus(db *DbData) {
+	m := newDbMigrator(db)
+	version, err := m.version()
+	if err != nil {
+		fmt.Printf(L10n("Migration failed: %s\n"), err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf(L10n("Schema version: %d, latest known: %d\n"), version, m.latest())
+	for _, mig := range m.migrations {
+		mark := " "
+		if mig.version <= version {
+			mark = "x"
+		}
+		fmt.Printf("[%s] %03d_%s\n", mark, mig.version, mig.name)
+	}
+}
+
+func migrateDown(db *DbData, args map[string]interface{}) {
+	n, err := strconv.Atoi(args["<n>"].(string))
+	if err == nil && n < 1 {
+		err = fmt.Errorf("%d is not a positive number", n)
+	}
+	if err == nil {
+		var from, to int
+		from, to, err = newDbMigrator(db).down(n)
+		if from != to {
+			fmt.Printf(L10n("Migrated database schema from version %d to %d\n"), from, to)
+		}
+	}
+	if err != nil {
+		fmt.Printf(L10n("Migration failed: %s\n"), err.Error())
+		os.Exit(1)
+	}
+}
+
+func hotBackup(db *DbData, args map[string]interface{}) {
+	fileName := args["<file>"].(string)
+	if err := db.hotBackup(fileName); err != nil {
+		fmt.Printf(L10n("Backup failed: %s\n"), err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf(L10n("Copied the database to %s\n"), fileName)
+}
+
+func copyDatabase(args map[string]interface{}, log *slog.Logger) {
+	from, to := args["<from>"].(string), args["<to>"].(string)
+	stats, err := copyDatabaseConns(from, to, args["--force"].(bool), log)
+	if err != nil {
+		fmt.Printf(L10n("Copy failed: %s\n"), err.Error())
+		os.Exit(1)
+	}
+	if stats.orphans > 0 {
+		fmt.Printf(L10n("Skipped %d rows that refer to deleted posts, tags or commenters\n"), stats.orphans)
+	}
+	fmt.Printf(L10n("Copied %d posts and %d comments, row counts and checksums match\n"),
+		stats.rows["post"], stats.rows["comment"])
+}
+
+func copyDatabaseConns(from, to string, force bool, log *slog.Logger) (copyStats, error) {
+	if dialectOf(from) == "sqlite3" && !assets.FileExistsNoErr(from) {
+		return copyStats{}, fmt.Errorf("%s does not exist", from)
+	}
+	src, err := openCopyDB(from, log)
+	if err != nil {
+		return copyStats{}, err
+	}
+	defer src.db.Close()
+	dst, err := openCopyDB(to, log)
+	if err != nil {
+		return copyStats{}, err
+	}
+	defer dst.db.Close()
+	return copyDB(src, dst, force)
+}
+
 // E is a syntax sugar helper to append an error to a log statement.
 func E(err error) slog.Attr {
 	return slog.Attr{
@@ -735,12 +1159,12 @@ func E(err error) slog.Attr {
 	}
 }
 
-func newMainLogger(filename string) *slog.Logger {
-	logFile, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+func newMainLogger(filename string) (*slog.Logger, *logFile) {
+	logFile, err := openLogFile(filename)
 	if err != nil {
 		panic("os.OpenFile: " + err.Error())
 	}
-	return slog.New(slog.NewJSONHandler(logFile, nil))
+	return slog.New(slog.NewJSONHandler(logFile, nil)), logFile
 }
 
 func Main() {
@@ -750,19 +1174,121 @@ func Main() {
 	}
 	rand.Seed(time.Now().UnixNano())
 	conf := readConfigs()
-	slogger := newMainLogger(conf.Server.Log)
+	slogger, logFile := newMainLogger(conf.Server.Log)
 	assets, err := assets.NewBin(bindir(), conf.Server.UploadsRoot, slogger)
 	if err != nil {
 		panic(err)
 	}
 	InitL10n(assets, conf.Interface.Language)
+	if args["--gen-cookie-key"].(bool) {
+		genCookieKey()
+		return
+	}
+	cookieKeys, err := cookieKeyPairs(&conf.Server)
+	if err != nil {
+		fmt.Printf(L10n("Bad cookie keys: %s\n"), err)
+		os.Exit(1)
+	}
+	if args["--copy-db"].(bool) {
+		copyDatabase(args, slogger)
+		return
+	}
 	db := InitDB(conf, bindir(), slogger)
-	defer db.db.Close()
-	gctx := newGlobalContext(db, assets, conf.Server.CookieSecret, slogger)
+	sqlDB, isSQL := db.(*DbData)
+	if isSQL {
+		defer sqlDB.close()
+	}
+	if args["--migrate-status"].(bool) {
+		migrateStatus(requireSQL(db))
+		return
+	}
+	if args["--migrate-down"].(bool) {
+		migrateDown(requireSQL(db), args)
+		return
+	}
+	if args["--hot-backup"].(bool) {
+		hotBackup(requireSQL(db), args)
+		return
+	}
+	if isSQL {
+		checkSchema(sqlDB, args["--migrate"].(bool))
+	}
+	gctx := newGlobalContext(db, assets, cookieKeys, slogger)
 	s := newServer(new(BcryptHelper), gctx, conf)
+	s.logFile = logFile
 	if args["--adduser"].(bool) {
 		insertUser(db, args)
 		return
 	}
-	s.runForever(s.initRoutes(slogger))
+	if args["--reset-2fa"].(bool) {
+		resetTOTP(db)
+		return
+	}
+	if args["--import-wxr"].(bool) {
+		importWXRFile(db, args)
+		return
+	}
+	if args["--import-md"].(bool) {
+		importMarkdownDir(db, args)
+		return
+	}
+	if args["--export-md"].(bool) {
+		exportMarkdownDir(db, args)
+		return
+	}
+	if args["--export"].(bool) {
+		exportSite(&s, args)
+		return
+	}
+	if args["--backup"].(bool) {
+		backupToFile(&s, args)
+		return
+	}
+	if args["--restore"].(bool) {
+		restoreFromFile(&s, args)
+		return
+	}
+	if path := conf.Server.LoginThrottleFile; path != "" {
+		if err := s.throttle.load(path); err != nil {
+			slogger.Error("Loading the login throttle failed", E(err))
+		}
+	}
+	if err := checkProduction(&conf.Server); err != nil {
+		fmt.Printf(L10n("Refusing to start: %s\n"), err)
+		os.Exit(1)
+	}
+	if err := s.startSetup(); err != nil {
+		fmt.Printf(L10n("Setup failed: %s\n"), err)
+		os.Exit(1)
+	}
+	// The background jobs use the DB, so they are stopped and waited for
+	// before the deferred sqlDB.close():
+	stop := make(chan struct{})
+	var jobs sync.WaitGroup
+	background := func(job func()) {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			job()
+		}()
+	}
+	if isSQL && sqlDB.dialect() == "sqlite3" && conf.Server.SQLiteMaintenanceInterval > 0 {
+		background(func() { sqlDB.maintainSQLite(conf.Server.SQLiteMaintenanceInterval, stop) })
+	}
+	if conf.Server.BackupDir != "" && conf.Server.BackupInterval > 0 {
+		background(func() { s.backupOnSchedule(stop) })
+	}
+	if store, ok := gctx.Store.(*dbStore); ok {
+		background(func() { store.purgeSessions(slogger, stop) })
+	}
+	err = s.run(s.rootHandler(slogger))
+	close(stop)
+	jobs.Wait()
+	if err != nil {
+		fmt.Printf(L10n("Serving failed: %s\n"), err)
+		if isSQL {
+			sqlDB.close()
+		}
+		os.Exit(1)
+	}
 }
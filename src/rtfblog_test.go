@@ -115,18 +115,40 @@ func forgeTestUser(s server, uname, passwd string) {
 
 var tserver htmltest.HT
 
-func initTests(uploadsDir string) server {
+// tserverAssets fingerprints the assets of tserver. The asset template func
+// is global, so initTests keeps it pointing here for the servers it makes
+// later.
+var tserverAssets *fingerprinter
+
+// initTests makes a server over testData, its config adjusted by opts.
+func initTests(uploadsDir string, opts ...func(conf *Config)) server {
 	conf := readConfigs()
 	conf.Server.StaticDir = "static"
+	// Most tests swap testPosts and testAuthor between requests, so they need
+	// every page rendered anew:
+	conf.Server.PageCacheSize = 0
+	for _, opt := range opts {
+		opt(&conf)
+	}
 	if uploadsDir == "" {
 		uploadsDir = conf.Server.UploadsRoot
 	}
-	slogger := newMainLogger("tests.log")
+	slogger, _ := newMainLogger("tests.log")
 	assets, err := assets.NewBin(buildRoot, uploadsDir, slogger)
 	if err != nil {
 		panic(err)
 	}
 	InitL10n(assets, "en-US")
+	gctx := newGlobalContext(&testData, assets, [][]byte{[]byte("aaabbbcccddd")}, slogger)
+	s := newServer(&TestCryptoHelper{}, gctx, conf)
+	if tserverAssets != nil {
+		addTemplateFunc("asset", tserverAssets.url)
+	}
+	forgeTestUser(s, "testuser", "testpasswd")
+	return s
+}
+
+func init() {
 	for i := 1; i <= 11; i++ {
 		testPosts = append(testPosts, mkTestEntry(i, false))
 	}
@@ -134,15 +156,9 @@ func initTests(uploadsDir string) server {
 		testPosts = append(testPosts, mkTestEntry(i+1000, true))
 	}
 	langDetector = TestLangDetector{}
-	testData = TestData{}
-	gctx := newGlobalContext(&testData, assets, "aaabbbcccddd", slogger)
-	s := newServer(&TestCryptoHelper{}, gctx, conf)
-	forgeTestUser(s, "testuser", "testpasswd")
-	return s
-}
-
-func init() {
+	testData = TestData{sessions: newMemData()}
 	s := initTests("")
+	tserverAssets = s.assetURLs
 	tserver = htmltest.New(s.initRoutes(slog.Default()))
 }
 
@@ -484,6 +500,7 @@ func TestUploadImage(t *testing.T) {
 	}
 	request, err := mkFakeFileUploadRequest(tserver, "upload_images", extraParams, "file", "testupload.md", testContent)
 	require.NoError(t, err)
+	request.Header.Set(csrfHeader, csrfToken(&tserver))
 	resp, err := tserver.Client().Do(request)
 	require.NoError(t, err)
 	body := &bytes.Buffer{}
@@ -614,15 +631,75 @@ func TestTitleByTagGetsCalled(t *testing.T) {
 }
 
 func TestDeletePostCallsDbFunc(t *testing.T) {
-	defer testData.reset()
-	tserver.Curl("delete_post?id=hello1001")
-	testData.expect(t, (*TestData).deletePost, "hello1001")
+	postForm(t, "delete_post", &url.Values{
+		"id": {"hello1001"},
+	}, func(html string) {
+		testData.expect(t, (*TestData).deletePost, "hello1001")
+	})
 }
 
 func TestDeleteCommentCallsDbFunc(t *testing.T) {
+	postForm(t, "delete_comment", &url.Values{
+		"id":     {"1"},
+		"action": {"delete"},
+	}, func(html string) {
+		testData.expect(t, (*TestData).deleteComment, "1")
+	})
+}
+
+func TestDeleteByLinkAsksFirst(t *testing.T) {
 	defer testData.reset()
-	tserver.Curl("delete_comment?id=1&action=delete")
-	testData.expect(t, (*TestData).deleteComment, "1")
+	ensureLogin()
+	html := tserver.Curl("delete_post?id=hello1001")
+	mustContain(t, html, `action="/delete_post"`)
+	mustContain(t, html, `name="id" value="hello1001"`)
+	mustContain(t, html, `name="csrf_token" value="`+csrfToken(&tserver)+`"`)
+	html = tserver.Curl("delete_comment?id=1&redirect_to=hello1")
+	mustContain(t, html, `action="/delete_comment"`)
+	mustContain(t, html, `name="redirect_to" value="hello1"`)
+	mustNotContain(t, testData.calls(), "delete")
+}
+
+func TestAdminPostsNeedCSRFToken(t *testing.T) {
+	defer testData.reset()
+	ensureLogin()
+	for _, token := range []string{"", "forged"} {
+		for _, path := range []string{"delete_post", "delete_comment", "submit_post", "moderate_comment"} {
+			html, err := tserver.PostForm(path, &url.Values{
+				"id":      {"1"},
+				"action":  {"delete"},
+				csrfField: {token},
+			})
+			require.NoError(t, err)
+			mustContain(t, html, "Verboten")
+		}
+	}
+	for _, f := range []string{"delete", "insert", "update"} {
+		mustNotContain(t, testData.calls(), f)
+	}
+}
+
+func TestSessionCookieFlags(t *testing.T) {
+	resp, err := tserver.Client().PostForm(tserver.PathToURL("login"), url.Values{
+		"uname":  {"testuser"},
+		"passwd": {"testpasswd"},
+	})
+	require.NoError(t, err)
+	resp.Body.Close()
+	var cookie *http.Cookie
+	for _, c := range resp.Request.Response.Cookies() {
+		if c.Name == "rtfblog" {
+			cookie = c
+		}
+	}
+	require.NotNil(t, cookie)
+	require.True(t, cookie.HttpOnly)
+	require.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+	require.False(t, cookie.Secure)
+	conf := hardcodedConf()
+	require.False(t, secureCookies(&conf))
+	conf.Server.BaseURL = "https://blog.com"
+	require.True(t, secureCookies(&conf))
 }
 
 func TestShowCaptcha(t *testing.T) {
@@ -809,14 +886,14 @@ func TestAdminPageHasEditAuthorButton(t *testing.T) {
 	mustContain(t, tserver.Curl("/admin"), "Edit Author Profile")
 }
 
-func TestMainPageShowsCreateAuthorPage(t *testing.T) {
+func TestMainPageDoesNotGrantAdmin(t *testing.T) {
+	doLogout()
 	tmp := testAuthor
 	testAuthor = nil
+	defer func() { testAuthor = tmp }()
 	html := tserver.Curl("/")
-	mustContain(t, html, "New Password")
-	mustContain(t, html, "Confirm Password")
-	mustNotContain(t, html, "Old Password")
-	testAuthor = tmp
+	mustNotContain(t, html, "New Password")
+	mustContain(t, tserver.Curl("/edit_author"), "Verboten")
 }
 
 func TestEditAuthor(t *testing.T) {
@@ -826,3 +903,18 @@ func TestEditAuthor(t *testing.T) {
 	mustContain(t, html, "Confirm Password")
 	mustContain(t, html, "Old Password")
 }
+
+func TestHandlerErrorStatus(t *testing.T) {
+	defer testData.reset()
+	get := func(path string) int {
+		resp, err := tserver.Client().Get(tserver.PathToURL(path))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusNotFound, get("no-such-post"))
+	testData.pPostID = func(url string) (int64, error) {
+		return -1, fmt.Errorf("postID: %w", ErrTimeout)
+	}
+	require.Equal(t, http.StatusServiceUnavailable, get("comment_submit?name=joe"))
+}
@@ -3,6 +3,9 @@ package rtfblog
 import (
 	"net/http"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,8 +13,30 @@ import (
 type server struct {
 	cryptoHelper CryptoHelper
 	gctx         globalContext
-	conf         Config
-	mets         metrics
+	// conf gets replaced on SIGHUP, read it with config(). proxies are
+	// parsed from it.
+	conf      *atomic.Pointer[Config]
+	proxies   *atomic.Pointer[trustedProxies]
+	mets      metrics
+	assetURLs *fingerprinter
+	// notifs tracks the notifications being sent, so that shutting down
+	// does not cut them off.
+	notifs *sync.WaitGroup
+	// sendMail sends the emails, it's sendGmail unless a test swaps it out.
+	sendMail func(conf *Notifications, to, subj, body string) error
+	// logFile is reopened on SIGHUP. Nil when the log is not a file of ours.
+	logFile *logFile
+	setup   *firstRun
+	// throttle slows down password guessing on login.
+	throttle *loginThrottle
+	// totpStep is the time step of the last TOTP code that was let in,
+	// recoveryMu lets in one recovery code at a time.
+	totpStep   *atomic.Int64
+	recoveryMu *sync.Mutex
+	// resetThrottle slows down asking for password reset links,
+	// resetMails limits how often they are sent.
+	resetThrottle *loginThrottle
+	resetMails    *resetMails
 }
 
 func newServer(
@@ -19,16 +44,60 @@ func newServer(
 	gctx globalContext,
 	conf Config,
 ) server {
-	return server{
+	mets := initMetrics()
+	gctx.pages = newPageCache(conf.Server.PageCacheSize, mets)
+	assetURLs := newFingerprinter(gctx.assets)
+	addTemplateFunc("asset", assetURLs.url)
+	store, _ := gctx.Store.(*dbStore)
+	if store != nil {
+		store.Options.Secure = secureCookies(&conf)
+		store.Options.MaxAge = int(conf.Server.SessionMaxAge / time.Second)
+		store.idleTimeout = conf.Server.SessionIdleTimeout
+		store.maxAge = conf.Server.SessionMaxAge
+	}
+	s := server{
 		cryptoHelper: cryptoHelper,
 		gctx:         gctx,
-		conf:         conf,
-		mets:         initMetrics(),
+		conf:         new(atomic.Pointer[Config]),
+		proxies:      new(atomic.Pointer[trustedProxies]),
+		mets:         mets,
+		assetURLs:    assetURLs,
+		notifs:       new(sync.WaitGroup),
+		sendMail:     sendGmail,
+		setup:        new(firstRun),
+		throttle:     newLoginThrottle(),
+		totpStep:     new(atomic.Int64),
+		recoveryMu:   new(sync.Mutex),
+
+		resetThrottle: newLoginThrottle(),
+		resetMails:    newResetMails(),
+	}
+	s.setConfig(conf)
+	if store != nil {
+		store.clientIP = s.clientIP
 	}
+	return s
+}
+
+func (s *server) setConfig(conf Config) {
+	proxies := parseTrustedProxies(conf.Server.TrustedProxies, s.gctx.Log)
+	s.proxies.Store(&proxies)
+	s.conf.Store(&conf)
+}
+
+// secureCookies tells whether the blog is only reached over HTTPS, so that
+// cookies can be kept off plain HTTP.
+func secureCookies(conf *Config) bool {
+	return strings.HasPrefix(conf.Server.BaseURL, "https://") || conf.Server.RedirectHTTPS
+}
+
+// config returns the current config. It must not be modified.
+func (s *server) config() *Config {
+	return s.conf.Load()
 }
 
 func (s *server) serveStaticFile(w http.ResponseWriter, req *http.Request, ctx *Context, fileName string) error {
-	filePath := filepath.Join(s.conf.Server.StaticDir, fileName)
+	filePath := filepath.Join(s.config().Server.StaticDir, fileName)
 	file, err := ctx.assets.Open(filePath)
 	defer file.Close()
 	if err != nil {
@@ -45,8 +114,8 @@ func (s *server) serveRobots(w http.ResponseWriter, req *http.Request, ctx *Cont
 }
 
 func (s *server) serveFavicon(w http.ResponseWriter, req *http.Request, ctx *Context) error {
-	if s.conf.Server.Favicon == "" {
+	if s.config().Server.Favicon == "" {
 		return performSimpleStatus(w, http.StatusNotFound)
 	}
-	return s.serveStaticFile(w, req, ctx, s.conf.Server.Favicon)
+	return s.serveStaticFile(w, req, ctx, s.config().Server.Favicon)
 }
@@ -0,0 +1,307 @@
+package rtfblog
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// sessionTouchInterval is how stale last_seen of a session may get before a
+// request that changes nothing else writes it anew. Keeps every page view
+// from being a DB write.
+const sessionTouchInterval = time.Minute
+
+// sessionPurgeInterval is how often the expired sessions are deleted.
+const sessionPurgeInterval = time.Hour
+
+// sessionRowKey keeps the row a session was loaded from among its values,
+// to tell on save what has changed. It's never stored.
+type sessionRowKey struct{}
+
+// dbStore keeps sessions in the DB, the cookie only holds a random token
+// that's looked up there. That makes it possible to list the sessions, to
+// expire them on the server and to revoke them.
+type dbStore struct {
+	db Data
+	// codecs sign and encrypt the token, the first one is used for new
+	// cookies. Replaced when the keys are reloaded.
+	codecs  atomic.Pointer[[]securecookie.Codec]
+	Options *sessions.Options
+	// idleTimeout and maxAge expire the sessions not seen for that long, or
+	// created that long ago. Zero means no limit.
+	idleTimeout time.Duration
+	maxAge      time.Duration
+	// clientIP tells the address to show in the list of sessions.
+	clientIP func(req *http.Request) string
+	now      func() time.Time
+}
+
+func newDBStore(db Data, keyPairs ...[]byte) *dbStore {
+	s := &dbStore{
+		db: db,
+		Options: &sessions.Options{
+			Path: "/",
+			// Keep the session away from scripts and from cross-site posts:
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		clientIP: func(req *http.Request) string { return req.RemoteAddr },
+		now:      time.Now,
+	}
+	s.setKeys(keyPairs...)
+	return s
+}
+
+// setKeys switches to the hash and block key pairs, see
+// securecookie.CodecsFromPairs.
+func (s *dbStore) setKeys(keyPairs ...[]byte) {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	s.codecs.Store(&codecs)
+}
+
+// sessionRowID is the ID of the row of the session with token.
+func sessionRowID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newSessionToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *dbStore) Get(req *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(req).Get(s, name)
+}
+
+// New loads the session of the cookie. A missing, forged or expired one
+// gets a fresh session, not an error.
+func (s *dbStore) New(req *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	c, err := req.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var token string
+	if err := securecookie.DecodeMulti(name, c.Value, &token, *s.codecs.Load()...); err != nil {
+		return session, nil
+	}
+	row, err := s.db.session(sessionRowID(token))
+	if errors.Is(err, ErrNotFound) {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+	if s.expired(row) {
+		return session, s.db.deleteSession(row.ID)
+	}
+	data, err := base64.StdEncoding.DecodeString(row.Data)
+	if err != nil {
+		return session, nil
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		return session, nil
+	}
+	session.ID = token
+	session.IsNew = false
+	session.Values[sessionRowKey{}] = row
+	return session, nil
+}
+
+func (s *dbStore) expired(row *SessionTable) bool {
+	now := s.now()
+	if s.idleTimeout > 0 && now.Sub(time.Unix(row.LastSeen, 0)) > s.idleTimeout {
+		return true
+	}
+	return s.maxAge > 0 && now.Sub(time.Unix(row.Created, 0)) > s.maxAge
+}
+
+// Save stores the session and sets the cookie. A negative MaxAge deletes
+// the session instead. A new session with nothing in it is not worth a row,
+// nor a cookie.
+func (s *dbStore) Save(req *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	old, _ := session.Values[sessionRowKey{}].(*SessionTable)
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.db.deleteSession(sessionRowID(session.ID)); err != nil {
+				return err
+			}
+		}
+		delete(session.Values, sessionRowKey{})
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	values := make(map[interface{}]interface{}, len(session.Values))
+	for k, v := range session.Values {
+		if k != (sessionRowKey{}) {
+			values[k] = v
+		}
+	}
+	if session.ID == "" && len(values) == 0 {
+		return nil
+	}
+	data, err := (securecookie.GobEncoder{}).Serialize(values)
+	if err != nil {
+		return err
+	}
+	if session.ID == "" {
+		session.ID = newSessionToken()
+	}
+	now := s.now().Unix()
+	row := &SessionTable{
+		ID:        sessionRowID(session.ID),
+		Data:      base64.StdEncoding.EncodeToString(data),
+		Admin:     values["adminlogin"] == "yes",
+		IP:        s.clientIP(req),
+		UserAgent: req.UserAgent(),
+		Created:   now,
+		LastSeen:  now,
+	}
+	if old != nil && old.ID == row.ID {
+		row.Created = old.Created
+		unchanged := old.Data == row.Data && old.Admin == row.Admin &&
+			old.IP == row.IP && old.UserAgent == row.UserAgent
+		if unchanged && time.Duration(now-old.LastSeen)*time.Second < sessionTouchInterval {
+			row = old
+		}
+	}
+	switch {
+	case old == nil || old.ID != row.ID:
+		err = s.db.insertSession(row)
+	case row != old:
+		err = s.db.updateSession(row)
+	}
+	if errors.Is(err, ErrNotFound) {
+		// Revoked while this request was being served:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	session.Values[sessionRowKey{}] = row
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, *s.codecs.Load()...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// renewSession gives the session a new ID, dropping the old one, so that a
+// token that was known before logging in is good for nothing after.
+func renewSession(session *sessions.Session) error {
+	s, ok := session.Store().(*dbStore)
+	if !ok || session.ID == "" {
+		return nil
+	}
+	if err := s.db.deleteSession(sessionRowID(session.ID)); err != nil {
+		return err
+	}
+	delete(session.Values, sessionRowKey{})
+	session.ID = ""
+	return nil
+}
+
+// isCurrentSession tells whether row is the session of the request.
+func isCurrentSession(session *sessions.Session, row *SessionTable) bool {
+	return session.ID != "" && sessionRowID(session.ID) == row.ID
+}
+
+// purgeSessions deletes the expired sessions every sessionPurgeInterval,
+// until stop is closed.
+func (s *dbStore) purgeSessions(log *slog.Logger, stop <-chan struct{}) {
+	for sleep(sessionPurgeInterval, stop) {
+		if err := s.purge(); err != nil {
+			log.Error("Purging expired sessions failed", E(err))
+		}
+	}
+}
+
+func (s *dbStore) purge() error {
+	var seenBefore, createdBefore int64
+	now := s.now()
+	if s.idleTimeout > 0 {
+		seenBefore = now.Add(-s.idleTimeout).Unix()
+	}
+	if s.maxAge > 0 {
+		createdBefore = now.Add(-s.maxAge).Unix()
+	}
+	return s.db.deleteStaleSessions(seenBefore, createdBefore)
+}
+
+// sessionView is a session as listed on the sessions page.
+type sessionView struct {
+	ID        string
+	IP        string
+	UserAgent string
+	Created   string
+	LastSeen  string
+	Current   bool
+}
+
+func (s *server) listSessions(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	rows, err := ctx.Db.adminSessions()
+	if err != nil {
+		return err
+	}
+	var list []sessionView
+	for i := range rows {
+		list = append(list, sessionView{
+			ID:        rows[i].ID,
+			IP:        rows[i].IP,
+			UserAgent: rows[i].UserAgent,
+			Created:   time.Unix(rows[i].Created, 0).Format("2006-01-02 15:04"),
+			LastSeen:  time.Unix(rows[i].LastSeen, 0).Format("2006-01-02 15:04"),
+			Current:   isCurrentSession(ctx.Session, &rows[i]),
+		})
+	}
+	tmplData := MkBasicData(ctx, 0, 0, *s.config())
+	tmplData["PageTitle"] = L10n("Sessions")
+	tmplData["Sessions"] = list
+	return tmpl(ctx, "sessions.html").Execute(w, tmplData)
+}
+
+// revokeSession logs out the session with the id, or every other session
+// but this one.
+func revokeSession(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	var err error
+	id := req.FormValue("id")
+	current := ""
+	if ctx.Session.ID != "" {
+		current = sessionRowID(ctx.Session.ID)
+	}
+	switch {
+	case req.FormValue("action") == "others":
+		err = ctx.Db.deleteSessions(current)
+		ctx.Log.Info("Other sessions revoked")
+	case id == current:
+		// Deletes the session on save:
+		ctx.Session.Options.MaxAge = -1
+		http.Redirect(w, req, ctx.routeByName("home_page"), http.StatusSeeOther)
+		return nil
+	default:
+		err = ctx.Db.deleteSession(id)
+		ctx.Log.Info("Session revoked", slog.String("id", id))
+	}
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, req, "/sessions", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,177 @@
+package rtfblog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDBStore(t *testing.T) {
+	db := newMemData()
+	store := newDBStore(db, []byte("secret"))
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	store.idleTimeout = time.Hour
+	store.maxAge = 24 * time.Hour
+	// request makes a request with the cookie, letting change the session
+	// values, and returns the cookie it's answered with.
+	request := func(cookie *http.Cookie, change func(values map[interface{}]interface{})) *http.Cookie {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("User-Agent", "test")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		sess, err := store.Get(req, "rtfblog")
+		require.NoError(t, err)
+		if change != nil {
+			change(sess.Values)
+		}
+		w := httptest.NewRecorder()
+		require.NoError(t, store.Save(req, w, sess))
+		cookies := w.Result().Cookies()
+		if len(cookies) == 0 {
+			return nil
+		}
+		return cookies[0]
+	}
+	get := func(cookie *http.Cookie, key string) interface{} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(cookie)
+		sess, err := store.New(req, "rtfblog")
+		require.NoError(t, err)
+		return sess.Values[key]
+	}
+
+	require.Nil(t, request(nil, nil), "nothing to keep, no cookie")
+	cookie := request(nil, func(v map[interface{}]interface{}) {
+		v["adminlogin"] = "yes"
+	})
+	require.NotNil(t, cookie)
+	require.True(t, cookie.HttpOnly)
+	require.Equal(t, "yes", get(cookie, "adminlogin"))
+	admins, err := db.adminSessions()
+	require.NoError(t, err)
+	require.Len(t, admins, 1)
+	require.Equal(t, "test", admins[0].UserAgent)
+	require.NotContains(t, cookie.Value, admins[0].ID)
+
+	// Forged, or signed by another secret:
+	forged := *cookie
+	forged.Value = strings.ToUpper(cookie.Value)
+	require.Nil(t, get(&forged, "adminlogin"))
+	other := newDBStore(db, []byte("other"))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	sess, err := other.New(req, "rtfblog")
+	require.NoError(t, err)
+	require.True(t, sess.IsNew)
+
+	// Seen often enough, it lasts until maxAge:
+	for range 23 {
+		now = now.Add(50 * time.Minute)
+		require.NotNil(t, request(cookie, nil))
+	}
+	require.Equal(t, "yes", get(cookie, "adminlogin"))
+	now = now.Add(2 * time.Hour)
+	require.Nil(t, get(cookie, "adminlogin"), "too old")
+	_, err = db.session(admins[0].ID)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	cookie = request(nil, func(v map[interface{}]interface{}) {
+		v["adminlogin"] = "yes"
+	})
+	now = now.Add(time.Hour + time.Second)
+	require.Nil(t, get(cookie, "adminlogin"), "idle")
+}
+
+var thisSession = regexp.MustCompile(`value="([0-9a-f]{64})" />\s*<input type="submit" value="Logout" />`)
+
+func TestSessionRevocation(t *testing.T) {
+	c := newTOTPClient(t, Author{})
+	login := func(b *http.Client) {
+		c.c = b
+		status, _ := c.post("/login", url.Values{"uname": {"joe"}, "passwd": {"testpasswd"}})
+		require.Equal(t, http.StatusSeeOther, status)
+	}
+	laptop, phone, tablet := newBrowser(t), newBrowser(t), newBrowser(t)
+	login(laptop)
+	login(phone)
+	login(tablet)
+	status, page := c.get("/sessions")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, 3, strings.Count(page, `name="id"`))
+	require.Equal(t, 1, strings.Count(page, "this session"))
+
+	// The tablet revokes the phone:
+	c.c = phone
+	_, page = c.get("/sessions")
+	phoneID := thisSession.FindStringSubmatch(page)
+	require.NotNil(t, phoneID)
+	c.c = tablet
+	status, _ = c.postAdmin("/revoke_session", url.Values{"id": {phoneID[1]}})
+	require.Equal(t, http.StatusSeeOther, status)
+	c.c = phone
+	status, _ = c.get("/admin")
+	require.Equal(t, http.StatusForbidden, status)
+	c.c = laptop
+	status, _ = c.get("/admin")
+	require.Equal(t, http.StatusOK, status)
+
+	// Changing the password logs out everyone else:
+	login(phone)
+	c.c = laptop
+	status, _ = c.postAdmin("/submit_author", url.Values{
+		"username":         {"joe"},
+		"display_name":     {"Joe"},
+		"old_password":     {"testpasswd"},
+		"password":         {"testpasswd-2024"},
+		"confirm_password": {"testpasswd-2024"},
+	})
+	require.Equal(t, http.StatusSeeOther, status)
+	status, _ = c.get("/admin")
+	require.Equal(t, http.StatusOK, status)
+	for _, b := range []*http.Client{phone, tablet} {
+		c.c = b
+		status, _ = c.get("/admin")
+		require.Equal(t, http.StatusForbidden, status)
+	}
+	sessions, err := c.s.gctx.Db.adminSessions()
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+
+	// Logging out deletes the session:
+	c.c = laptop
+	c.get("/logout")
+	sessions, err = c.s.gctx.Db.adminSessions()
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+}
+
+func TestLoginRenewsSession(t *testing.T) {
+	c := newTOTPClient(t, Author{TOTPSecret: rfcSecret})
+	// The password step leaves a session from before logging in:
+	status, _ := c.post("/login", url.Values{"uname": {"joe"}, "passwd": {"testpasswd"}})
+	require.Equal(t, http.StatusOK, status)
+	u, err := url.Parse(c.ts.URL)
+	require.NoError(t, err)
+	before := c.c.Jar.Cookies(u)
+	require.Len(t, before, 1)
+	status, _ = c.post("/login_totp", url.Values{"code": {currentTOTP(t, rfcSecret)}})
+	require.Equal(t, http.StatusSeeOther, status)
+	require.NotEqual(t, before[0].Value, c.c.Jar.Cookies(u)[0].Value)
+	status, _ = c.get("/admin")
+	require.Equal(t, http.StatusOK, status)
+
+	// Whoever knew the session before, like an attacker who planted it,
+	// is not logged in:
+	c.c = newBrowser(t)
+	c.c.Jar.SetCookies(u, before)
+	status, _ = c.get("/admin")
+	require.Equal(t, http.StatusForbidden, status)
+}
@@ -0,0 +1,167 @@
+package rtfblog
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	minPasswdLen      = 10
+	minPasswdDistinct = 5
+)
+
+// firstRun guards the setup page that creates the first author. Until that's
+// done, the page wants the token printed on startup, so that the first
+// visitor of a fresh blog can't claim it.
+type firstRun struct {
+	mu sync.Mutex
+	// token is empty when there's nothing to set up, or when it's done.
+	token string
+}
+
+func (f *firstRun) pending() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.token != ""
+}
+
+// startSetup makes a setup token if the blog has no author yet. The token is
+// printed and logged, whoever started the server can go pick it up.
+func (s *server) startSetup() error {
+	_, err := s.gctx.Db.author()
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	tok := newCSRFToken()
+	s.setup.mu.Lock()
+	s.setup.token = tok
+	s.setup.mu.Unlock()
+	fmt.Printf(L10n("No author yet. Create one at %s/setup with the setup token %s\n"),
+		strings.TrimRight(s.config().Server.BaseURL, "/"), tok)
+	s.gctx.Log.Warn("No author yet, waiting for the setup",
+		slog.String("path", "/setup"), slog.String("token", tok))
+	return nil
+}
+
+// checkPasswd tells what's wrong with passwd, if anything.
+func checkPasswd(passwd, username string) error {
+	if utf8.RuneCountInString(passwd) < minPasswdLen {
+		return fmt.Errorf(L10n("Password should be at least %d characters long."), minPasswdLen)
+	}
+	if username != "" && strings.Contains(strings.ToLower(passwd), strings.ToLower(username)) {
+		return errors.New(L10n("Password should not contain the user name."))
+	}
+	distinct := map[rune]bool{}
+	for _, r := range passwd {
+		distinct[r] = true
+	}
+	if len(distinct) < minPasswdDistinct {
+		return errors.New(L10n("Password is too easy to guess."))
+	}
+	return nil
+}
+
+// setupForm shows the empty form. The token is never taken from the URL,
+// where it would end up in the logs and in the Referer header.
+func (s *server) setupForm(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	if !s.setup.pending() {
+		return performStatus(ctx, w, req, http.StatusNotFound)
+	}
+	return s.renderSetup(w, req, ctx, "")
+}
+
+// renderSetup shows the author form in setup mode, filled in with what was
+// submitted so far.
+func (s *server) renderSetup(w http.ResponseWriter, req *http.Request, ctx *Context, tok string) error {
+	tmplData := MkBasicData(ctx, 0, 0, *s.config())
+	tmplData["PageTitle"] = L10n("Set Up the Blog")
+	tmplData["Setup"] = true
+	tmplData["SetupToken"] = tok
+	tmplData["author"] = Author{
+		UserName: req.FormValue("username"),
+		FullName: req.FormValue("display_name"),
+		Email:    req.FormValue("email"),
+		Www:      req.FormValue("www"),
+	}
+	return tmpl(ctx, "edit_author.html").Execute(w, tmplData)
+}
+
+// submitSetup creates the first author and logs them in. The setup token is
+// gone after that, the page stays closed for good.
+func (s *server) submitSetup(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	s.setup.mu.Lock()
+	defer s.setup.mu.Unlock()
+	if s.setup.token == "" {
+		return performStatus(ctx, w, req, http.StatusNotFound)
+	}
+	username := req.FormValue("username")
+	passwd := req.FormValue("password")
+	passwd2 := req.FormValue("confirm_password")
+	req.Form["password"] = []string{"***"}         // Avoid spilling password to log
+	req.Form["confirm_password"] = []string{"***"} // Avoid spilling password to log
+	req.Form["setup_token"] = []string{"***"}      // Nor the token
+	// Only from the body, see setupForm:
+	tok := req.PostFormValue("setup_token")
+	if subtle.ConstantTimeCompare([]byte(tok), []byte(s.setup.token)) != 1 {
+		s.mets.numForbiddenResponses.Inc()
+		ctx.Log.Warn("Bad setup token")
+		ctx.Session.AddFlash(L10n("Wrong setup token."))
+		return s.renderSetup(w, req, ctx, "")
+	}
+	if username == "" {
+		ctx.Session.AddFlash(L10n("User name is mandatory."))
+		return s.renderSetup(w, req, ctx, tok)
+	}
+	if passwd != passwd2 {
+		ctx.Session.AddFlash(L10n("Passwords should match."))
+		return s.renderSetup(w, req, ctx, tok)
+	}
+	if err := checkPasswd(passwd, username); err != nil {
+		ctx.Session.AddFlash(err.Error())
+		return s.renderSetup(w, req, ctx, tok)
+	}
+	crypt, err := encryptBcrypt([]byte(passwd))
+	if err != nil {
+		return err
+	}
+	err = withTransaction(ctx.Db, func(db Data) error {
+		if _, err := db.author(); !errors.Is(err, ErrNotFound) {
+			if err == nil {
+				err = ErrConflict
+			}
+			return err
+		}
+		_, err := db.insertAuthor(&Author{
+			UserName: username,
+			FullName: req.FormValue("display_name"),
+			Email:    req.FormValue("email"),
+			Www:      req.FormValue("www"),
+			Passwd:   crypt,
+		})
+		return err
+	})
+	if errors.Is(err, ErrConflict) {
+		// Someone added the author behind our back, e.g. with --adduser.
+		s.setup.token = ""
+		return performStatus(ctx, w, req, http.StatusNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	s.setup.token = ""
+	ctx.Log.Info("Setup done, the author is created", slog.String("username", username))
+	if err := renewSession(ctx.Session); err != nil {
+		return err
+	}
+	ctx.Session.Values["adminlogin"] = "yes"
+	ctx.Session.Values[csrfSessKey] = newCSRFToken()
+	ctx.pages.invalidate()
+	http.Redirect(w, req, "/admin", http.StatusSeeOther)
+	return nil
+}
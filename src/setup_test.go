@@ -0,0 +1,112 @@
+package rtfblog
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPasswd(t *testing.T) {
+	require.ErrorContains(t, checkPasswd("short", "joe"), "at least 10")
+	require.ErrorContains(t, checkPasswd("xJOE-the-admin", "joe"), "user name")
+	require.ErrorContains(t, checkPasswd("abababababab", "joe"), "easy to guess")
+	require.NoError(t, checkPasswd("correct horse battery", "joe"))
+}
+
+func TestSetup(t *testing.T) {
+	s := newLifecycleServer(t, slog.Default())
+	ts := httptest.NewServer(s.rootHandler(slog.Default()))
+	defer ts.Close()
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(path string) (*http.Response, string) {
+		resp, err := client.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+	postTo := func(path string, values url.Values) (*http.Response, string) {
+		resp, err := client.PostForm(ts.URL+path, values)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+	post := func(values url.Values) (*http.Response, string) {
+		return postTo("/setup", values)
+	}
+
+	// Not started, nothing to set up:
+	resp, _ := get("/setup")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	require.NoError(t, s.startSetup())
+	tok := s.setup.token
+	require.NotEmpty(t, tok)
+	resp, _ = get("/")
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, "/setup", resp.Header.Get("Location"))
+	resp, _ = get("/admin")
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, body := get("/setup?setup_token=" + tok)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, body, `name="setup_token"`)
+	require.NotContains(t, body, tok, "the token is not taken from the URL")
+
+	form := url.Values{
+		"setup_token":      {"guess"},
+		"username":         {"joe"},
+		"display_name":     {"Joe"},
+		"password":         {"correct horse battery"},
+		"confirm_password": {"correct horse battery"},
+	}
+	_, body = post(form)
+	require.Contains(t, body, "Wrong setup token.")
+	_, body = postTo("/setup?setup_token="+tok, form)
+	require.Contains(t, body, "Wrong setup token.", "nor from the URL of a post")
+	form.Set("setup_token", tok)
+	form.Set("confirm_password", "correct horse")
+	_, body = post(form)
+	require.Contains(t, body, "Passwords should match.")
+	form.Set("password", "joejoejoe12")
+	form.Set("confirm_password", "joejoejoe12")
+	_, body = post(form)
+	require.Contains(t, body, "Password should not contain the user name.")
+	_, err = s.gctx.Db.author()
+	require.ErrorIs(t, err, ErrNotFound)
+
+	form.Set("password", "correct horse battery")
+	form.Set("confirm_password", "correct horse battery")
+	resp, _ = post(form)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, "/admin", resp.Header.Get("Location"))
+	a, err := s.gctx.Db.author()
+	require.NoError(t, err)
+	require.Equal(t, "joe", a.UserName)
+	require.Equal(t, "Joe", a.FullName)
+	resp, _ = get("/admin")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Done for good, even with the right token:
+	resp, _ = post(form)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = get("/setup")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.NoError(t, s.startSetup())
+	require.False(t, s.setup.pending())
+}
@@ -0,0 +1,68 @@
+package rtfblog
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteConn(t *testing.T) {
+	conf := Server{SQLiteJournalMode: "wal", SQLiteBusyTimeout: 2 * time.Second}
+	require.Equal(t, "blog.db?_txlock=immediate&_journal_mode=wal&_busy_timeout=2000",
+		sqliteConn("blog.db", conf, "_txlock=immediate"))
+	require.Equal(t, "blog.db?cache=shared&_journal_mode=wal&_busy_timeout=2000",
+		sqliteConn("blog.db?cache=shared", conf))
+	require.Equal(t, "blog.db", sqliteConn("blog.db", Server{}))
+}
+
+func TestSQLiteProductionMode(t *testing.T) {
+	conf := hardcodedConf()
+	db, err := openDbData("sqlite3", copyDefaultDB(t), conf, slog.Default())
+	require.NoError(t, err)
+	defer db.close()
+	var mode string
+	require.NoError(t, db.db.Raw("pragma journal_mode").Row().Scan(&mode))
+	require.Equal(t, "wal", mode)
+	require.Equal(t, 1, db.writer.DB().Stats().MaxOpenConnections)
+	fillTestDB(t, db)
+
+	// Concurrent writers wait for their turn instead of failing:
+	const numWriters = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, numWriters)
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			commenter := &Commenter{Name: fmt.Sprintf("Commenter %d", i)}
+			_, err := PublishCommentAndCommenter(db, 2, commenter, "Concurrent")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	comments, err := db.allComments()
+	require.NoError(t, err)
+	require.Len(t, comments, numWriters+1)
+
+	require.NoError(t, db.optimize())
+	backup := filepath.Join(t.TempDir(), "hot.db")
+	require.NoError(t, db.hotBackup(backup))
+	require.Error(t, db.hotBackup(backup))
+	copied, err := openDbData("sqlite3", backup, conf, slog.Default())
+	require.NoError(t, err)
+	defer copied.close()
+	want, err := db.dump()
+	require.NoError(t, err)
+	got, err := copied.dump()
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
@@ -0,0 +1,164 @@
+package rtfblog
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rtfb/httputil"
+)
+
+// sdListenFDsStart is the first file descriptor systemd passes sockets in.
+const sdListenFDsStart = 3
+
+// listen opens addr, which is either a TCP port, or a unix socket given as
+// unix:/path/to.sock. The socket gets mode for its permissions.
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(addr, "unix:")
+	if !isUnix {
+		return net.Listen("tcp", httputil.JoinHostAndPort(os.Getenv("HOST"), addr))
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// Left behind by a server that didn't exit cleanly, unless there's
+		// one still listening:
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// systemdListeners takes the sockets systemd passed on socket activation,
+// see sd_listen_fds(3). They are keyed by their FileDescriptorName, "http"
+// or "https"; unnamed ones are taken in that order. It's nil when the
+// server wasn't socket activated.
+func systemdListeners() (map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	return activatedListeners(os.Getenv, sdListenFDsStart)
+}
+
+func activatedListeners(getenv func(string) string, firstFD int) (map[string]net.Listener, error) {
+	if pid, err := strconv.Atoi(getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	names := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	positional := []string{"http", "https"}
+	lns := map[string]net.Listener{}
+	for i := range n {
+		fd := firstFD + i
+		syscall.CloseOnExec(fd)
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		if name != "http" && name != "https" && i < len(positional) {
+			name = positional[i]
+		}
+		if _, dup := lns[name]; dup || (name != "http" && name != "https") {
+			err = fmt.Errorf("unexpected socket %d from systemd", fd)
+			break
+		}
+		f := os.NewFile(uintptr(fd), name)
+		lns[name], err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			delete(lns, name)
+			err = fmt.Errorf("socket %d from systemd: %w", fd, err)
+			break
+		}
+	}
+	if err != nil {
+		for _, l := range lns {
+			l.Close()
+		}
+		return nil, err
+	}
+	return lns, nil
+}
+
+// sdNotify tells systemd about the state of the service, see sd_notify(3).
+// It does nothing when the service manager isn't listening.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval is how often systemd wants to hear from us, or zero if
+// it doesn't.
+func watchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("bad WATCHDOG_USEC: " + usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+func (s *server) sdNotify(state string) {
+	if err := sdNotify(state); err != nil {
+		s.gctx.Log.Error("sd_notify failed", E(err))
+	}
+}
+
+// watchdog pings systemd twice per its watchdog interval, until stop gets
+// closed.
+func (s *server) watchdog(stop <-chan struct{}) {
+	interval, err := watchdogInterval()
+	if err != nil {
+		s.gctx.Log.Error("Not pinging the watchdog", E(err))
+	}
+	if interval == 0 {
+		return
+	}
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.sdNotify("WATCHDOG=1")
+		case <-stop:
+			return
+		}
+	}
+}
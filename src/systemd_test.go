@@ -0,0 +1,191 @@
+//go:build linux
+
+package rtfblog
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenUnix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "blog.sock")
+	l, err := listen("unix:"+sock, 0600)
+	require.NoError(t, err)
+	fi, err := os.Stat(sock)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	_, err = listen("unix:"+sock, 0600)
+	require.ErrorContains(t, err, "in use")
+	// A socket left behind gets replaced:
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = listen("unix:"+sock, 0660)
+	require.NoError(t, err)
+	defer l.Close()
+
+	s := newProxiedServer(t, "")
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(s.baseURL(r) + " " + s.clientIP(r)))
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	}}
+	req, err := http.NewRequest("GET", "http://internal/", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "blog.com")
+	req.Header.Set("X-Forwarded-For", "5.6.7.8")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "https://blog.com 5.6.7.8", string(body))
+}
+
+// passFDs puts the listeners at consecutive file descriptors starting with
+// first, the way systemd passes them.
+func passFDs(t *testing.T, first int, lns ...net.Listener) {
+	for i, l := range lns {
+		f, err := l.(*net.TCPListener).File()
+		require.NoError(t, err)
+		require.NoError(t, syscall.Dup3(int(f.Fd()), first+i, 0))
+		f.Close()
+		l.Close()
+	}
+}
+
+func TestActivatedListeners(t *testing.T) {
+	const first = 200
+	env := map[string]string{
+		"LISTEN_PID":     strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS":     "2",
+		"LISTEN_FDNAMES": "https:http",
+	}
+	activate := func(lns ...net.Listener) (map[string]net.Listener, error) {
+		passFDs(t, first, lns...)
+		return activatedListeners(func(k string) string { return env[k] }, first)
+	}
+	newListener := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		return l
+	}
+
+	a, b := newListener(), newListener()
+	httpsAddr, httpAddr := a.Addr().String(), b.Addr().String()
+	lns, err := activate(a, b)
+	require.NoError(t, err)
+	require.Equal(t, httpAddr, lns["http"].Addr().String())
+	require.Equal(t, httpsAddr, lns["https"].Addr().String())
+	for _, l := range lns {
+		l.Close()
+	}
+
+	env["LISTEN_FDS"], env["LISTEN_FDNAMES"] = "1", ""
+	a = newListener()
+	httpAddr = a.Addr().String()
+	lns, err = activate(a)
+	require.NoError(t, err)
+	require.Len(t, lns, 1)
+	require.Equal(t, httpAddr, lns["http"].Addr().String())
+	lns["http"].Close()
+
+	env["LISTEN_FDS"], env["LISTEN_FDNAMES"] = "2", "http:http"
+	_, err = activate(newListener(), newListener())
+	require.ErrorContains(t, err, "unexpected socket 201")
+
+	env["LISTEN_PID"] = "1"
+	lns, err = activatedListeners(func(k string) string { return env[k] }, first)
+	require.NoError(t, err)
+	require.Nil(t, lns)
+}
+
+// notifySocket listens where sdNotify sends to.
+func notifySocket(t *testing.T) *net.UnixConn {
+	sock := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", sock)
+	return conn
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 256)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	require.NoError(t, sdNotify("READY=1"))
+	conn := notifySocket(t)
+	require.NoError(t, sdNotify("READY=1"))
+	require.Equal(t, "READY=1", readNotification(t, conn))
+}
+
+func TestWatchdog(t *testing.T) {
+	conn := notifySocket(t)
+	s := newLifecycleServer(t, slog.Default())
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.watchdog(stop)
+		close(done)
+	}()
+	require.Equal(t, "WATCHDOG=1", readNotification(t, conn))
+	require.Equal(t, "WATCHDOG=1", readNotification(t, conn))
+	close(stop)
+	<-done
+
+	t.Setenv("WATCHDOG_PID", "1")
+	interval, err := watchdogInterval()
+	require.NoError(t, err)
+	require.Zero(t, interval)
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "soon")
+	_, err = watchdogInterval()
+	require.Error(t, err)
+}
+
+func TestServeNotifiesSystemd(t *testing.T) {
+	conn := notifySocket(t)
+	s := newLifecycleServer(t, slog.Default())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	eps := []endpoint{{
+		srv:   &http.Server{Handler: http.NotFoundHandler()},
+		serve: func(srv *http.Server) error { return srv.Serve(l) },
+	}}
+	sigs := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serve(eps, sigs)
+	}()
+	sigs <- syscall.SIGHUP
+	require.Equal(t, "RELOADING=1", readNotification(t, conn))
+	require.Equal(t, "READY=1", readNotification(t, conn))
+	sigs <- syscall.SIGTERM
+	require.Equal(t, "STOPPING=1", readNotification(t, conn))
+	require.NoError(t, <-served)
+}
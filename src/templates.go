@@ -17,7 +17,8 @@ var (
 	cachedTemplates = map[string]*template.Template{}
 	cachedMutex     sync.Mutex
 	funcs           = template.FuncMap{
-		"dict": dict,
+		"dict":      dict,
+		"csrfField": csrfFormField,
 	}
 )
 
@@ -61,3 +62,10 @@ func tmpl(c *Context, name string) *template.Template {
 	cachedTemplates[name] = t
 	return t
 }
+
+// resetTemplates drops the parsed templates, so that they get loaded anew.
+func resetTemplates() {
+	cachedMutex.Lock()
+	defer cachedMutex.Unlock()
+	cachedTemplates = map[string]*template.Template{}
+}
@@ -0,0 +1,205 @@
+package rtfblog
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// loginFreeAttempts is how many failed logins go without any delay,
+	// after that each one doubles the wait, starting at loginBackoff.
+	loginFreeAttempts = 3
+	loginBackoff      = time.Second
+	// loginForgetAfter is how long the failures are remembered for.
+	loginForgetAfter = 24 * time.Hour
+	// loginMaxUserNames is how many user names the failures are kept for,
+	// so that guessing random ones does not grow the map without end.
+	loginMaxUserNames = 1000
+)
+
+// loginAttempts are the recent failed logins from an IP address, or for a
+// user name.
+type loginAttempts struct {
+	Failures int       `json:"failures"`
+	Last     time.Time `json:"last"`
+	// Until is when the next attempt is let through.
+	Until time.Time `json:"until"`
+}
+
+// loginThrottle slows down password guessing. An attempt waits for its IP
+// address, and, once that address has failed too, for the user name, so that
+// spreading the guesses over many user names does not help, and spreading
+// them over many addresses only gets the free attempts of each. The user
+// name alone never holds up an address that hasn't failed, or anyone could
+// lock the author out.
+type loginThrottle struct {
+	mu       sync.Mutex
+	attempts map[string]*loginAttempts
+	now      func() time.Time
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{
+		attempts: map[string]*loginAttempts{},
+		now:      time.Now,
+	}
+}
+
+func throttleKeys(ip, username string) []string {
+	keys := []string{"ip:" + ip}
+	if username != "" {
+		keys = append(keys, "user:"+strings.ToLower(username))
+	}
+	return keys
+}
+
+// wait tells how long a login attempt has to wait, zero lets it through.
+func (t *loginThrottle) wait(ip, username string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.waitLocked(ip, username, t.now())
+}
+
+func (t *loginThrottle) waitLocked(ip, username string, now time.Time) time.Duration {
+	keys := throttleKeys(ip, username)
+	if t.attempts[keys[0]] == nil {
+		keys = keys[:1]
+	}
+	var wait time.Duration
+	for _, k := range keys {
+		if a := t.attempts[k]; a != nil {
+			wait = max(wait, a.Until.Sub(now))
+		}
+	}
+	return wait
+}
+
+// begin counts a login attempt as failed before the password is checked, so
+// that guesses sent all at once can't get in before the first one fails. It
+// tells how long the attempt has to wait instead, and then does not count
+// it. succeed takes the failures back.
+//
+// Every maxFailures failures lock the login out for lockout, zero
+// maxFailures leaves it at the backoff, which never gets longer than
+// lockout.
+func (t *loginThrottle) begin(ip, username string, maxFailures int, lockout time.Duration) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if wait := t.waitLocked(ip, username, now); wait > 0 {
+		return wait
+	}
+	t.forget(now)
+	for _, k := range throttleKeys(ip, username) {
+		a := t.attempts[k]
+		if a == nil {
+			if strings.HasPrefix(k, "user:") {
+				t.makeRoomForUserName()
+			}
+			a = &loginAttempts{}
+			t.attempts[k] = a
+		}
+		a.Failures++
+		a.Last = now
+		a.Until = now.Add(loginDelay(a.Failures, maxFailures, lockout))
+	}
+	return 0
+}
+
+// loginDelay is how long to wait after the given number of failures.
+func loginDelay(failures, maxFailures int, lockout time.Duration) time.Duration {
+	switch {
+	case maxFailures > 0 && failures%maxFailures == 0:
+		return lockout
+	case failures >= loginFreeAttempts:
+		return min(loginBackoff<<min(failures-loginFreeAttempts, 20), lockout)
+	}
+	return 0
+}
+
+// makeRoomForUserName forgets the user name that failed the longest ago,
+// once there are loginMaxUserNames of them.
+func (t *loginThrottle) makeRoomForUserName() {
+	var oldest string
+	n := 0
+	for k, a := range t.attempts {
+		if !strings.HasPrefix(k, "user:") {
+			continue
+		}
+		n++
+		if oldest == "" || a.Last.Before(t.attempts[oldest].Last) {
+			oldest = k
+		}
+	}
+	if n >= loginMaxUserNames {
+		delete(t.attempts, oldest)
+	}
+}
+
+// succeed forgets the failures once the right password is in.
+func (t *loginThrottle) succeed(ip, username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, k := range throttleKeys(ip, username) {
+		delete(t.attempts, k)
+	}
+}
+
+func (t *loginThrottle) forget(now time.Time) {
+	for k, a := range t.attempts {
+		if now.Sub(a.Last) > loginForgetAfter && now.After(a.Until) {
+			delete(t.attempts, k)
+		}
+	}
+}
+
+// load reads the attempts that save has written. A missing file is fine.
+func (t *loginThrottle) load(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	attempts := map[string]*loginAttempts{}
+	if err := json.Unmarshal(b, &attempts); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attempts = attempts
+	t.forget(t.now())
+	return nil
+}
+
+// save writes the attempts to path, so that restarting the server does not
+// start the guessing over.
+func (t *loginThrottle) save(path string) error {
+	t.mu.Lock()
+	t.forget(t.now())
+	b, err := json.Marshal(t.attempts)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
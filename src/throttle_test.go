@@ -0,0 +1,179 @@
+package rtfblog
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestThrottle() (*loginThrottle, *time.Time) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t := newLoginThrottle()
+	t.now = func() time.Time { return now }
+	return t, &now
+}
+
+func TestLoginThrottle(t *testing.T) {
+	th, now := newTestThrottle()
+	begin := func(ip, user string) time.Duration {
+		return th.begin(ip, user, 6, time.Hour)
+	}
+	for range loginFreeAttempts {
+		require.Zero(t, begin("1.2.3.4", "joe"))
+	}
+	require.Equal(t, time.Second, th.wait("1.2.3.4", "joe"))
+	require.Equal(t, time.Second, begin("1.2.3.4", "joe"), "neither let through, nor counted")
+	require.Equal(t, time.Second, th.wait("1.2.3.4", "Bob"))
+	// Another address waits for the user name only once it has failed too:
+	require.Zero(t, th.wait("5.6.7.8", "joe"))
+	require.Zero(t, begin("5.6.7.8", "joe"))
+	require.Equal(t, 2*time.Second, th.wait("5.6.7.8", "joe"))
+	require.Zero(t, th.wait("5.6.7.8", "bob"))
+	*now = now.Add(2 * time.Second)
+	require.Zero(t, begin("1.2.3.4", "joe"))
+	require.Equal(t, 4*time.Second, th.wait("1.2.3.4", "joe"))
+	*now = now.Add(4 * time.Second)
+	require.Zero(t, begin("1.2.3.4", "joe"))
+	require.Equal(t, time.Hour, th.wait("1.2.3.4", "joe"))
+	require.Equal(t, 4*time.Second, th.wait("1.2.3.4", ""))
+	// Nobody else gets locked out:
+	require.Zero(t, th.wait("9.9.9.9", "joe"))
+
+	th.succeed("1.2.3.4", "joe")
+	require.Zero(t, th.wait("1.2.3.4", "joe"))
+
+	// The backoff never gets longer than the lockout:
+	for range 40 {
+		*now = now.Add(th.wait("5.6.7.8", ""))
+		require.Zero(t, th.begin("5.6.7.8", "", 0, time.Hour))
+	}
+	require.Equal(t, time.Hour, th.wait("5.6.7.8", ""))
+	*now = now.Add(loginForgetAfter + time.Hour)
+	begin("9.9.9.9", "")
+	require.Len(t, th.attempts, 1)
+}
+
+func TestLoginThrottleUserNames(t *testing.T) {
+	th, now := newTestThrottle()
+	for i := range loginMaxUserNames + 10 {
+		*now = now.Add(time.Second)
+		th.begin(fmt.Sprintf("10.0.%d.%d", i/256, i%256), fmt.Sprintf("user%d", i), 0, time.Hour)
+	}
+	users := 0
+	for k := range th.attempts {
+		if strings.HasPrefix(k, "user:") {
+			users++
+		}
+	}
+	require.Equal(t, loginMaxUserNames, users)
+	require.Nil(t, th.attempts["user:user0"], "the oldest is forgotten")
+	require.NotNil(t, th.attempts[fmt.Sprintf("user:user%d", loginMaxUserNames+9)])
+}
+
+func TestLoginThrottlePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "throttle.json")
+	th, now := newTestThrottle()
+	require.NoError(t, th.load(path))
+	for range 5 {
+		*now = now.Add(th.wait("1.2.3.4", "joe"))
+		require.Zero(t, th.begin("1.2.3.4", "joe", 10, time.Hour))
+	}
+	require.NoError(t, th.save(path))
+	loaded := newLoginThrottle()
+	loaded.now = th.now
+	require.NoError(t, loaded.load(path))
+	require.Equal(t, th.wait("1.2.3.4", "joe"), loaded.wait("1.2.3.4", "joe"))
+	require.Equal(t, 5, loaded.attempts["user:joe"].Failures)
+	*now = now.Add(2 * loginForgetAfter)
+	require.NoError(t, loaded.load(path))
+	require.Empty(t, loaded.attempts)
+}
+
+func TestLoginIsThrottled(t *testing.T) {
+	s := newLifecycleServer(t, slog.Default())
+	require.NoError(t, withTransaction(s.gctx.Db, func(db Data) error {
+		_, err := db.insertAuthor(&Author{UserName: "joe"})
+		return err
+	}))
+	conf := *s.config()
+	conf.Server.LoginMaxFailures = loginFreeAttempts
+	s.setConfig(conf)
+	ts := httptest.NewServer(s.rootHandler(slog.Default()))
+	defer ts.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	login := func(passwd string) *http.Response {
+		resp, err := client.PostForm(ts.URL+"/login", url.Values{
+			"uname":  {"joe"},
+			"passwd": {passwd},
+		})
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	for range loginFreeAttempts - 1 {
+		require.Equal(t, http.StatusOK, login("guess").StatusCode)
+	}
+	resp := login("guess")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "900", resp.Header.Get("Retry-After"))
+	// Even the right password has to wait:
+	require.Equal(t, http.StatusTooManyRequests, login("testpasswd").StatusCode)
+	require.Equal(t, float64(loginFreeAttempts), testutil.ToFloat64(s.mets.numFailedLogins))
+	require.Equal(t, 1.0, testutil.ToFloat64(s.mets.numThrottledLogins))
+
+	s.throttle.succeed("127.0.0.1", "joe")
+	require.Equal(t, http.StatusSeeOther, login("testpasswd").StatusCode)
+}
+
+// slowCrypto takes its time over the passwords, counting them.
+type slowCrypto struct {
+	TestCryptoHelper
+	decrypts atomic.Int32
+}
+
+func (c *slowCrypto) Decrypt(hash, passwd []byte) error {
+	c.decrypts.Add(1)
+	time.Sleep(50 * time.Millisecond)
+	return c.TestCryptoHelper.Decrypt(hash, passwd)
+}
+
+func TestLoginBurstIsThrottled(t *testing.T) {
+	s := newLifecycleServer(t, slog.Default())
+	crypto := &slowCrypto{}
+	s.cryptoHelper = crypto
+	require.NoError(t, withTransaction(s.gctx.Db, func(db Data) error {
+		_, err := db.insertAuthor(&Author{UserName: "joe"})
+		return err
+	}))
+	ts := httptest.NewServer(s.rootHandler(slog.Default()))
+	defer ts.Close()
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.PostForm(ts.URL+"/login", url.Values{
+				"uname":  {"joe"},
+				"passwd": {"guess"},
+			})
+			require.NoError(t, err)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(loginFreeAttempts), crypto.decrypts.Load())
+}
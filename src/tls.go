@@ -0,0 +1,169 @@
+package rtfblog
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig makes the TLS config of the HTTPS server, with the certificate
+// reloaded whenever it changes on disk.
+func tlsConfig(conf *Server, log *slog.Logger) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[conf.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported tls_min_version %q", conf.TLSMinVersion)
+	}
+	ciphers, err := cipherSuites(conf.TLSCiphers)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := newCertReloader(conf.TLSCert, conf.TLSKey, log)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   ciphers,
+		GetCertificate: certs.getCertificate,
+	}, nil
+}
+
+// cipherSuites looks up the suites by name. Only the ones Go considers
+// secure are allowed. No names means Go's defaults.
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := map[string]uint16{}
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+	var ids []uint16
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// certReloader keeps the certificate for the TLS server, loading it anew
+// when the files get replaced, e.g. by certbot.
+type certReloader struct {
+	certFile, keyFile string
+	log               *slog.Logger
+
+	mu              sync.Mutex
+	cert            *tls.Certificate
+	certMod, keyMod time.Time
+}
+
+func newCertReloader(certFile, keyFile string, log *slog.Logger) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, log: log}
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(certMod, keyMod); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) modTimes() (certMod, keyMod time.Time, err error) {
+	ci, err := os.Stat(r.certFile)
+	if err != nil {
+		return
+	}
+	ki, err := os.Stat(r.keyFile)
+	if err != nil {
+		return
+	}
+	return ci.ModTime(), ki.ModTime(), nil
+}
+
+func (r *certReloader) load(certMod, keyMod time.Time) error {
+	// Remember the times even if loading fails, the half-written pair will
+	// be tried again when the other file changes too:
+	r.certMod, r.keyMod = certMod, keyMod
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		r.log.Error("Checking the TLS certificate failed", E(err))
+		return r.cert, nil
+	}
+	if certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return r.cert, nil
+	}
+	if err := r.load(certMod, keyMod); err != nil {
+		r.log.Error("Reloading the TLS certificate failed, keeping the old one", E(err))
+		return r.cert, nil
+	}
+	r.log.Info("Reloaded the TLS certificate")
+	return r.cert, nil
+}
+
+// redirectToHTTPS sends every request over to the same URL on tlsPort, or
+// under base_url if that is HTTPS. Requests that came in over HTTPS to a
+// trusted proxy go through to h.
+func (s *server) redirectToHTTPS(h http.Handler, tlsPort string) http.Handler {
+	port := tlsPort[strings.LastIndex(tlsPort, ":")+1:]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.scheme(r) == "https" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		if base := s.config().Server.BaseURL; strings.HasPrefix(base, "https://") {
+			http.Redirect(w, r, strings.TrimRight(base, "/")+r.URL.RequestURI(), status)
+			return
+		}
+		host := r.Host
+		if hostOnly, _, err := net.SplitHostPort(host); err == nil {
+			host = hostOnly
+		}
+		if port != "443" {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+		} else if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+			host = "[" + host + "]"
+		}
+		url := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, url, status)
+	})
+}
+
+// withHSTS tells the browsers to only come back over HTTPS for maxAge.
+func withHSTS(h http.Handler, maxAge time.Duration) http.Handler {
+	value := "max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,135 @@
+package rtfblog
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeCert(t *testing.T, certFile, keyFile, cn string, mod time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0600))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	require.NoError(t, os.Chtimes(certFile, mod, mod))
+	require.NoError(t, os.Chtimes(keyFile, mod, mod))
+}
+
+func certCN(t *testing.T, r *certReloader) string {
+	cert, err := r.getCertificate(nil)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	writeCert(t, certFile, keyFile, "old", now.Add(-time.Minute))
+	r, err := newCertReloader(certFile, keyFile, slog.Default())
+	require.NoError(t, err)
+	require.Equal(t, "old", certCN(t, r))
+	writeCert(t, certFile, keyFile, "new", now)
+	require.Equal(t, "new", certCN(t, r))
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0600))
+	require.NoError(t, os.Chtimes(keyFile, now.Add(time.Minute), now.Add(time.Minute)))
+	require.Equal(t, "new", certCN(t, r))
+	_, err = newCertReloader(certFile, keyFile, slog.Default())
+	require.Error(t, err)
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	conf := hardcodedConf().Server
+	conf.TLSCert, conf.TLSKey = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, conf.TLSCert, conf.TLSKey, "blog", time.Now())
+	tc, err := tlsConfig(&conf, slog.Default())
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS12), tc.MinVersion)
+	require.Nil(t, tc.CipherSuites)
+	conf.TLSMinVersion = "1.3"
+	conf.TLSCiphers = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+	tc, err = tlsConfig(&conf, slog.Default())
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS13), tc.MinVersion)
+	require.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, tc.CipherSuites)
+	conf.TLSMinVersion = "1.0"
+	_, err = tlsConfig(&conf, slog.Default())
+	require.ErrorContains(t, err, "tls_min_version")
+	conf.TLSMinVersion = "1.2"
+	conf.TLSCiphers = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+	_, err = tlsConfig(&conf, slog.Default())
+	require.ErrorContains(t, err, "TLS_RSA_WITH_RC4_128_SHA")
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	s := newLifecycleServer(t, slog.Default())
+	var tests = []struct {
+		method  string
+		host    string
+		tlsPort string
+		status  int
+		url     string
+	}{
+		{"GET", "blog.com", ":8081", 301, "https://blog.com:8081/a?b=c"},
+		{"GET", "blog.com:8080", ":443", 301, "https://blog.com/a?b=c"},
+		{"HEAD", "[::1]:8080", ":8081", 301, "https://[::1]:8081/a?b=c"},
+		{"GET", "[::1]:8080", ":443", 301, "https://[::1]/a?b=c"},
+		{"POST", "blog.com", ":443", 308, "https://blog.com/a?b=c"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/a?b=c", nil)
+		req.Host = test.host
+		w := httptest.NewRecorder()
+		s.redirectToHTTPS(http.NotFoundHandler(), test.tlsPort).ServeHTTP(w, req)
+		require.Equal(t, test.status, w.Code, test.host)
+		require.Equal(t, test.url, w.Header().Get("Location"), test.host)
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	h := withHSTS(http.NotFoundHandler(), 365*24*time.Hour)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, "max-age=31536000", w.Header().Get("Strict-Transport-Security"))
+}
+
+func TestHTTPServerLimits(t *testing.T) {
+	s := newLifecycleServer(t, slog.Default())
+	srv := s.httpServer(http.NotFoundHandler())
+	conf := s.config().Server
+	require.Equal(t, conf.ReadHeaderTimeout, srv.ReadHeaderTimeout)
+	require.Equal(t, conf.ReadTimeout, srv.ReadTimeout)
+	require.Equal(t, conf.WriteTimeout, srv.WriteTimeout)
+	require.Equal(t, conf.IdleTimeout, srv.IdleTimeout)
+	require.Equal(t, conf.MaxHeaderBytes, srv.MaxHeaderBytes)
+	require.NotZero(t, srv.ReadHeaderTimeout)
+}
@@ -0,0 +1,376 @@
+package rtfblog
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/skip2/go-qrcode"
+)
+
+// TOTP as in RFC 6238, with the parameters every authenticator app knows.
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// totpSkew is how many periods the clocks may be apart either way.
+	totpSkew = 1
+
+	numRecoveryCodes = 10
+
+	// totpLoginTimeout is how long the second login step waits for the code
+	// after the password was right.
+	totpLoginTimeout = 5 * time.Minute
+)
+
+// Session keys of the second login step: who got the password right, when,
+// and where to go after.
+const (
+	totpSessUser     = "totp_user"
+	totpSessTime     = "totp_time"
+	totpSessRedirect = "totp_redirect"
+)
+
+// totpSessEnroll is the session key of the secret being enrolled. It's kept
+// on the server, so that the enrolling can't be handed some other secret.
+const totpSessEnroll = "totp_enroll_secret"
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpSecretLen is the length of a secret in bytes, 160 bits, as RFC 4226
+// recommends.
+const totpSecretLen = 20
+
+func newTOTPSecret() string {
+	b := make([]byte, totpSecretLen)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand: " + err.Error())
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+// validTOTPSecret tells whether secret is one that newTOTPSecret makes.
+func validTOTPSecret(secret string) bool {
+	key, err := totpEncoding.DecodeString(secret)
+	return err == nil && len(key) == totpSecretLen
+}
+
+// hotp is the code for counter, see RFC 4226.
+func hotp(key []byte, counter uint64) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// checkTOTP tells whether code is right for secret at the time now. The
+// step it's right for is returned too, so that it can't be used twice.
+func checkTOTP(secret, code string, now time.Time) (step int64, ok bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	cur := now.Unix() / int64(totpPeriod/time.Second)
+	for step := cur - totpSkew; step <= cur+totpSkew; step++ {
+		if hmac.Equal([]byte(hotp(key, uint64(step))), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the provisioning URI that authenticator apps take, see
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format.
+func totpURI(secret, issuer, account string) string {
+	q := url.Values{
+		"secret": {secret},
+		"issuer": {issuer},
+		"digits": {fmt.Sprint(totpDigits)},
+		"period": {fmt.Sprint(int(totpPeriod / time.Second))},
+	}
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// qrCode renders uri as a PNG data URL, for scanning it off the screen.
+func qrCode(uri string) (template.URL, error) {
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)), nil
+}
+
+// newRecoveryCodes makes the codes to log in with when the authenticator is
+// lost, like "k7pq-3xr2".
+func newRecoveryCodes() []string {
+	codes := make([]string, numRecoveryCodes)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			panic("crypto/rand: " + err.Error())
+		}
+		c := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = c[:4] + "-" + c[4:]
+	}
+	return codes
+}
+
+// normalizeCode forgives the spaces and dashes typed along with a code, and
+// the case of a recovery code.
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// hashRecoveryCodes hashes the codes the same way passwords are, for
+// Author.RecoveryCodes.
+func (s *server) hashRecoveryCodes(codes []string) (string, error) {
+	hashes := make([]string, len(codes))
+	for i, c := range codes {
+		h, err := s.cryptoHelper.Encrypt(normalizeCode(c))
+		if err != nil {
+			return "", err
+		}
+		hashes[i] = h
+	}
+	return strings.Join(hashes, " "), nil
+}
+
+// useRecoveryCode looks for code among the recovery codes of a, taking it
+// out of there if found.
+func (s *server) useRecoveryCode(a *Author, code string) bool {
+	hashes := strings.Fields(a.RecoveryCodes)
+	for i, h := range hashes {
+		if s.cryptoHelper.Decrypt([]byte(h), []byte(normalizeCode(code))) == nil {
+			a.RecoveryCodes = strings.Join(append(hashes[:i], hashes[i+1:]...), " ")
+			return true
+		}
+	}
+	return false
+}
+
+// checkSecondFactor takes either a TOTP code, or a recovery code, which gets
+// used up. A TOTP code is good only once, the server remembers the last one.
+func (s *server) checkSecondFactor(db Data, a *Author, code string) (bool, error) {
+	code = normalizeCode(code)
+	if step, ok := checkTOTP(a.TOTPSecret, code, time.Now()); ok {
+		for {
+			last := s.totpStep.Load()
+			if step <= last {
+				return false, nil
+			}
+			if s.totpStep.CompareAndSwap(last, step) {
+				return true, nil
+			}
+		}
+	}
+	// One at a time, and by the latest codes, so that each works only once:
+	s.recoveryMu.Lock()
+	defer s.recoveryMu.Unlock()
+	used := false
+	err := withTransaction(db, func(db Data) error {
+		a, err := db.author()
+		if err != nil {
+			return err
+		}
+		if !s.useRecoveryCode(a, code) {
+			return nil
+		}
+		used = true
+		return db.updateAuthor(a)
+	})
+	return used && err == nil, err
+}
+
+// pendingTOTP tells who got the password right and has yet to pass the
+// second login step, if they did it recently enough.
+func pendingTOTP(sess *sessions.Session) (string, bool) {
+	uname, _ := sess.Values[totpSessUser].(string)
+	since, _ := sess.Values[totpSessTime].(int64)
+	if uname == "" || time.Since(time.Unix(since, 0)) > totpLoginTimeout {
+		return "", false
+	}
+	return uname, true
+}
+
+func clearPendingTOTP(sess *sessions.Session) {
+	delete(sess.Values, totpSessUser)
+	delete(sess.Values, totpSessTime)
+	delete(sess.Values, totpSessRedirect)
+}
+
+func (s *server) loginTOTPForm(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	if _, ok := pendingTOTP(ctx.Session); !ok {
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return nil
+	}
+	tmplData := MkBasicData(ctx, 0, 0, *s.config())
+	tmplData["PageTitle"] = L10n("Login")
+	return tmpl(ctx, "login_totp.html").Execute(w, tmplData)
+}
+
+// loginTOTP is the second login step, for the authors that have enrolled.
+func (s *server) loginTOTP(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	uname, ok := pendingTOTP(ctx.Session)
+	if !ok {
+		clearPendingTOTP(ctx.Session)
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return nil
+	}
+	code := req.FormValue("code")
+	req.Form["code"] = []string{"***"} // Avoid spilling the code to log
+	at := s.newLoginAttempt(req, uname, "totp")
+	if wait := s.beginLogin(at); wait > 0 {
+		return s.loginRefused(w, req, ctx, at, wait, s.loginTOTPForm)
+	}
+	a, err := ctx.Db.author()
+	if err != nil {
+		return fmt.Errorf("login default author: %w", err)
+	}
+	if a.UserName != uname || a.TOTPSecret == "" {
+		// The author has changed since the password was checked:
+		clearPendingTOTP(ctx.Session)
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return nil
+	}
+	ok, err = s.checkSecondFactor(ctx.Db, a, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return s.loginFailed(w, req, ctx, at, s.loginTOTPForm)
+	}
+	redir, _ := ctx.Session.Values[totpSessRedirect].(string)
+	clearPendingTOTP(ctx.Session)
+	return s.loggedIn(w, req, ctx, at, redir)
+}
+
+func (s *server) totpEnrollForm(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	a, err := ctx.Db.author()
+	if err != nil {
+		return err
+	}
+	if a.TOTPSecret != "" {
+		http.Redirect(w, req, "/edit_author", http.StatusSeeOther)
+		return nil
+	}
+	secret := newTOTPSecret()
+	ctx.Session.Values[totpSessEnroll] = secret
+	return s.renderTOTPEnroll(w, ctx, a, secret)
+}
+
+func (s *server) renderTOTPEnroll(w http.ResponseWriter, ctx *Context, a *Author, secret string) error {
+	uri := totpURI(secret, s.config().Interface.BlogTitle, a.UserName)
+	qr, err := qrCode(uri)
+	if err != nil {
+		return err
+	}
+	tmplData := MkBasicData(ctx, 0, 0, *s.config())
+	tmplData["PageTitle"] = L10n("Two-Factor Authentication")
+	tmplData["Secret"] = secret
+	tmplData["URI"] = uri
+	tmplData["QRCode"] = qr
+	return tmpl(ctx, "totp.html").Execute(w, tmplData)
+}
+
+func (s *server) renderRecoveryCodes(w http.ResponseWriter, ctx *Context, codes []string) error {
+	tmplData := MkBasicData(ctx, 0, 0, *s.config())
+	tmplData["PageTitle"] = L10n("Two-Factor Authentication")
+	tmplData["RecoveryCodes"] = codes
+	return tmpl(ctx, "totp.html").Execute(w, tmplData)
+}
+
+// totpEnroll turns the second login step on, once the authenticator has
+// shown it knows the secret that totpEnrollForm showed. It does not replace
+// a secret that's already on, that takes disabling it first, which takes the
+// password.
+func (s *server) totpEnroll(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	a, err := ctx.Db.author()
+	if err != nil {
+		return err
+	}
+	if a.TOTPSecret != "" {
+		delete(ctx.Session.Values, totpSessEnroll)
+		ctx.Log.Warn("Two-factor authentication is already on, not enrolling")
+		http.Redirect(w, req, "/edit_author", http.StatusSeeOther)
+		return nil
+	}
+	secret, _ := ctx.Session.Values[totpSessEnroll].(string)
+	if !validTOTPSecret(secret) {
+		ctx.Session.AddFlash(L10n("Start over with this new key."))
+		http.Redirect(w, req, "/totp_enroll", http.StatusSeeOther)
+		return nil
+	}
+	if _, ok := checkTOTP(secret, normalizeCode(req.FormValue("code")), time.Now()); !ok {
+		ctx.Session.AddFlash(L10n("Wrong code, try again."))
+		return s.renderTOTPEnroll(w, ctx, a, secret)
+	}
+	codes := newRecoveryCodes()
+	a.TOTPSecret = secret
+	a.RecoveryCodes, err = s.hashRecoveryCodes(codes)
+	if err != nil {
+		return err
+	}
+	err = withTransaction(ctx.Db, func(db Data) error {
+		return db.updateAuthor(a)
+	})
+	if err != nil {
+		return err
+	}
+	delete(ctx.Session.Values, totpSessEnroll)
+	ctx.Log.Info("Two-factor authentication enabled", slog.String("username", a.UserName))
+	return s.renderRecoveryCodes(w, ctx, codes)
+}
+
+// manageTOTP disables the second login step, or replaces the recovery codes.
+// Either takes the password.
+func (s *server) manageTOTP(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	a, err := ctx.Db.author()
+	if err != nil {
+		return err
+	}
+	passwd := req.FormValue("password")
+	req.Form["password"] = []string{"***"} // Avoid spilling password to log
+	if ok, err := s.checkPassword(w, req, ctx, a, passwd, "manage_totp"); !ok {
+		return err
+	}
+	var codes []string
+	switch action := req.FormValue("action"); {
+	case action == "disable":
+		a.TOTPSecret, a.RecoveryCodes = "", ""
+	case action == "recovery_codes" && a.TOTPSecret != "":
+		codes = newRecoveryCodes()
+		a.RecoveryCodes, err = s.hashRecoveryCodes(codes)
+		if err != nil {
+			return err
+		}
+	default:
+		http.Redirect(w, req, "/edit_author", http.StatusSeeOther)
+		return nil
+	}
+	err = withTransaction(ctx.Db, func(db Data) error {
+		return db.updateAuthor(a)
+	})
+	if err != nil {
+		return err
+	}
+	if codes != nil {
+		ctx.Log.Info("New recovery codes", slog.String("username", a.UserName))
+		return s.renderRecoveryCodes(w, ctx, codes)
+	}
+	ctx.Log.Info("Two-factor authentication disabled", slog.String("username", a.UserName))
+	http.Redirect(w, req, "/edit_author", http.StatusSeeOther)
+	return nil
+}
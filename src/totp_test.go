@@ -0,0 +1,342 @@
+package rtfblog
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// The secret of the test vectors in RFC 4226 and RFC 6238.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestHOTP(t *testing.T) {
+	want := []string{"755224", "287082", "359152", "969429", "338314"}
+	for i, code := range want {
+		require.Equal(t, code, hotp([]byte("12345678901234567890"), uint64(i)))
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	at := time.Unix(59, 0)
+	step, ok := checkTOTP(rfcSecret, "287082", at)
+	require.True(t, ok)
+	require.Equal(t, int64(1), step)
+	_, ok = checkTOTP(strings.ToLower(rfcSecret), "287082", at.Add(totpPeriod))
+	require.True(t, ok, "a step of clock skew")
+	_, ok = checkTOTP(rfcSecret, "287082", at.Add(3*totpPeriod))
+	require.False(t, ok)
+	_, ok = checkTOTP(rfcSecret, "28708", at)
+	require.False(t, ok)
+	_, ok = checkTOTP("not base32!", "287082", at)
+	require.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(totpURI(rfcSecret, "My Blog", "joe"))
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", u.Scheme)
+	require.Equal(t, "totp", u.Host)
+	require.Equal(t, "/My Blog:joe", u.Path)
+	require.Equal(t, rfcSecret, u.Query().Get("secret"))
+	require.Equal(t, "My Blog", u.Query().Get("issuer"))
+	qr, err := qrCode(u.String())
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(qr), "data:image/png;base64,"))
+}
+
+func currentTOTP(t *testing.T, secret string) string {
+	key, err := totpEncoding.DecodeString(secret)
+	require.NoError(t, err)
+	return hotp(key, uint64(time.Now().Unix()/int64(totpPeriod/time.Second)))
+}
+
+// totpClient is a browser of a blog whose author is joe, with the password
+// "testpasswd". The setup funcs get to change the server before it's served.
+type totpClient struct {
+	t  *testing.T
+	s  server
+	ts *httptest.Server
+	c  *http.Client
+}
+
+func newTOTPClient(t *testing.T, a Author, setup ...func(s *server)) *totpClient {
+	s := newLifecycleServer(t, slog.Default())
+	s.cryptoHelper = new(BcryptHelper)
+	var err error
+	a.UserName = "joe"
+	a.Passwd, err = encryptBcrypt([]byte("testpasswd"))
+	require.NoError(t, err)
+	require.NoError(t, withTransaction(s.gctx.Db, func(db Data) error {
+		_, err := db.insertAuthor(&a)
+		return err
+	}))
+	for _, f := range setup {
+		f(&s)
+	}
+	ts := httptest.NewServer(s.rootHandler(slog.Default()))
+	t.Cleanup(ts.Close)
+	return &totpClient{t: t, s: s, ts: ts, c: newBrowser(t)}
+}
+
+func newBrowser(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (c *totpClient) do(resp *http.Response, err error) (int, string) {
+	require.NoError(c.t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(c.t, err)
+	return resp.StatusCode, string(body)
+}
+
+func (c *totpClient) get(path string) (int, string) {
+	return c.do(c.c.Get(c.ts.URL + path))
+}
+
+func (c *totpClient) post(path string, values url.Values) (int, string) {
+	return c.do(c.c.PostForm(c.ts.URL+path, values))
+}
+
+var metaCSRF = regexp.MustCompile(`<meta name="csrf-token" content="([^"]+)">`)
+
+// postAdmin posts with the CSRF token of the session.
+func (c *totpClient) postAdmin(path string, values url.Values) (int, string) {
+	_, page := c.get("/admin")
+	m := metaCSRF.FindStringSubmatch(page)
+	require.NotNil(c.t, m, "no CSRF token")
+	values.Set(csrfField, m[1])
+	return c.post(path, values)
+}
+
+func (c *totpClient) author() *Author {
+	a, err := c.s.gctx.Db.author()
+	require.NoError(c.t, err)
+	return a
+}
+
+func TestTOTPEnroll(t *testing.T) {
+	c := newTOTPClient(t, Author{})
+	status, _ := c.post("/login", url.Values{"uname": {"joe"}, "passwd": {"testpasswd"}})
+	require.Equal(t, http.StatusSeeOther, status)
+	_, page := c.get("/edit_author")
+	require.Contains(t, page, `id="totp-enable"`)
+
+	status, page = c.get("/totp_enroll")
+	require.Equal(t, http.StatusOK, status)
+	secret := regexp.MustCompile(`id="totp-secret">([A-Z2-7]+)<`).FindStringSubmatch(page)
+	require.NotNil(t, secret)
+	require.Contains(t, page, `src="data:image/png;base64,`)
+	require.Contains(t, page, "otpauth://totp/")
+
+	_, page = c.postAdmin("/totp_enroll", url.Values{"code": {"000000"}})
+	require.Contains(t, page, "Wrong code, try again.")
+	require.Empty(t, c.author().TOTPSecret)
+	// The secret is the one the session was shown, not one from the form:
+	own := newTOTPSecret()
+	_, page = c.postAdmin("/totp_enroll", url.Values{"secret": {own}, "code": {currentTOTP(t, own)}})
+	require.Contains(t, page, "Wrong code, try again.")
+	require.Empty(t, c.author().TOTPSecret)
+	_, page = c.postAdmin("/totp_enroll", url.Values{"code": {currentTOTP(t, secret[1])}})
+	list := regexp.MustCompile(`(?s)<pre id="recovery-codes">(.*?)</pre>`).FindStringSubmatch(page)
+	require.NotNil(t, list)
+	codes := strings.Fields(list[1])
+	require.Len(t, codes, numRecoveryCodes)
+	a := c.author()
+	require.Equal(t, secret[1], a.TOTPSecret)
+	require.Len(t, strings.Fields(a.RecoveryCodes), numRecoveryCodes)
+	require.NotContains(t, a.RecoveryCodes, codes[0])
+	_, page = c.get("/edit_author")
+	require.Contains(t, page, "On, with 10 recovery codes left.")
+
+	// Editing the author keeps the second step:
+	status, _ = c.postAdmin("/submit_author", url.Values{
+		"username":         {"joe"},
+		"display_name":     {"Joe"},
+		"old_password":     {"testpasswd"},
+		"password":         {"testpasswd-2024"},
+		"confirm_password": {"testpasswd-2024"},
+	})
+	require.Equal(t, http.StatusSeeOther, status)
+	require.Equal(t, secret[1], c.author().TOTPSecret)
+
+	_, page = c.postAdmin("/totp", url.Values{"password": {"wrong"}, "action": {"disable"}})
+	require.Contains(t, page, "Incorrect password.")
+	require.NotEmpty(t, c.author().TOTPSecret)
+	status, _ = c.postAdmin("/totp", url.Values{"password": {"testpasswd-2024"}, "action": {"disable"}})
+	require.Equal(t, http.StatusSeeOther, status)
+	require.Empty(t, c.author().TOTPSecret)
+	require.Empty(t, c.author().RecoveryCodes)
+}
+
+func TestTOTPEnrollKeepsSecret(t *testing.T) {
+	c := newTOTPClient(t, Author{})
+	laptop, phone := newBrowser(t), newBrowser(t)
+	for _, b := range []*http.Client{laptop, phone} {
+		c.c = b
+		status, _ := c.post("/login", url.Values{"uname": {"joe"}, "passwd": {"testpasswd"}})
+		require.Equal(t, http.StatusSeeOther, status)
+	}
+	// Nothing to enroll without the form:
+	status, _ := c.postAdmin("/totp_enroll", url.Values{"code": {"000000"}})
+	require.Equal(t, http.StatusSeeOther, status)
+	require.Empty(t, c.author().TOTPSecret)
+
+	secretOf := regexp.MustCompile(`id="totp-secret">([A-Z2-7]+)<`)
+	c.c = laptop
+	_, page := c.get("/totp_enroll")
+	stale := secretOf.FindStringSubmatch(page)
+	require.NotNil(t, stale)
+	c.c = phone
+	_, page = c.get("/totp_enroll")
+	require.Contains(t, page, "Start over with this new key.")
+	secret := secretOf.FindStringSubmatch(page)
+	require.NotNil(t, secret)
+	c.postAdmin("/totp_enroll", url.Values{"code": {currentTOTP(t, secret[1])}})
+	require.Equal(t, secret[1], c.author().TOTPSecret)
+
+	// An admin session can't swap the secret without the password:
+	c.c = laptop
+	status, _ = c.postAdmin("/totp_enroll", url.Values{"code": {currentTOTP(t, stale[1])}})
+	require.Equal(t, http.StatusSeeOther, status)
+	require.Equal(t, secret[1], c.author().TOTPSecret)
+}
+
+func TestValidTOTPSecret(t *testing.T) {
+	require.True(t, validTOTPSecret(newTOTPSecret()))
+	require.True(t, validTOTPSecret(rfcSecret))
+	require.False(t, validTOTPSecret(""))
+	require.False(t, validTOTPSecret("not base32!"))
+	require.False(t, validTOTPSecret("MFRGG"))
+}
+
+func TestTOTPLogin(t *testing.T) {
+	s := newLifecycleServer(t, slog.Default())
+	s.cryptoHelper = new(BcryptHelper)
+	codes := []string{"abcd-efgh", "ijkl-mnop"}
+	hashes, err := s.hashRecoveryCodes(codes)
+	require.NoError(t, err)
+	c := newTOTPClient(t, Author{TOTPSecret: rfcSecret, RecoveryCodes: hashes})
+	login := func() {
+		c.c = newBrowser(t)
+		status, page := c.post("/login", url.Values{"uname": {"joe"}, "passwd": {"testpasswd"}})
+		require.Equal(t, http.StatusOK, status)
+		require.Contains(t, page, `action="login_totp"`)
+		status, _ = c.get("/admin")
+		require.Equal(t, http.StatusForbidden, status)
+	}
+
+	login()
+	_, page := c.post("/login_totp", url.Values{"code": {"123456"}})
+	require.Contains(t, page, "Login failed.")
+	code := currentTOTP(t, rfcSecret)
+	status, _ := c.post("/login_totp", url.Values{"code": {code[:3] + " " + code[3:]}})
+	require.Equal(t, http.StatusSeeOther, status)
+	status, _ = c.get("/admin")
+	require.Equal(t, http.StatusOK, status)
+
+	// The same code doesn't do twice:
+	login()
+	_, page = c.post("/login_totp", url.Values{"code": {code}})
+	require.Contains(t, page, "Login failed.")
+
+	// A recovery code does, but only once:
+	status, _ = c.post("/login_totp", url.Values{"code": {"ABCD EFGH"}})
+	require.Equal(t, http.StatusSeeOther, status)
+	require.Len(t, strings.Fields(c.author().RecoveryCodes), 1)
+	login()
+	_, page = c.post("/login_totp", url.Values{"code": {"abcd-efgh"}})
+	require.Contains(t, page, "Login failed.")
+
+	// The second step can't be skipped, or taken without the first:
+	c.c = newBrowser(t)
+	status, _ = c.post("/login_totp", url.Values{"code": {"ijkl-mnop"}})
+	require.Equal(t, http.StatusSeeOther, status)
+	status, _ = c.get("/admin")
+	require.Equal(t, http.StatusForbidden, status)
+	require.Len(t, strings.Fields(c.author().RecoveryCodes), 1)
+}
+
+func TestResetTOTP(t *testing.T) {
+	db := newMemData()
+	require.NoError(t, withTransaction(db, func(db Data) error {
+		_, err := db.insertAuthor(&Author{UserName: "joe", TOTPSecret: rfcSecret, RecoveryCodes: "x y"})
+		return err
+	}))
+	resetTOTP(db)
+	a, err := db.author()
+	require.NoError(t, err)
+	require.Equal(t, "joe", a.UserName)
+	require.Empty(t, a.TOTPSecret)
+	require.Empty(t, a.RecoveryCodes)
+}
+
+func TestAuthorPasswordIsThrottled(t *testing.T) {
+	// Locked out rather than backed off, so that slow hashing does not let
+	// the wait run out:
+	c := newTOTPClient(t, Author{TOTPSecret: rfcSecret}, func(s *server) {
+		conf := *s.config()
+		conf.Server.LoginMaxFailures = loginFreeAttempts
+		s.setConfig(conf)
+	})
+	status, _ := c.post("/login", url.Values{"uname": {"joe"}, "passwd": {"testpasswd"}})
+	require.Equal(t, http.StatusOK, status)
+	status, _ = c.post("/login_totp", url.Values{"code": {currentTOTP(t, rfcSecret)}})
+	require.Equal(t, http.StatusSeeOther, status)
+
+	// A stolen session can't guess the password over and over:
+	for range loginFreeAttempts - 1 {
+		_, page := c.postAdmin("/totp", url.Values{"password": {"guess"}, "action": {"disable"}})
+		require.Contains(t, page, "Incorrect password.")
+	}
+	status, _ = c.postAdmin("/submit_author", url.Values{"username": {"joe"}, "old_password": {"guess"}})
+	require.Equal(t, http.StatusTooManyRequests, status)
+	status, _ = c.postAdmin("/totp", url.Values{"password": {"testpasswd"}, "action": {"disable"}})
+	require.Equal(t, http.StatusTooManyRequests, status)
+	require.Equal(t, rfcSecret, c.author().TOTPSecret)
+	require.Equal(t, float64(loginFreeAttempts), testutil.ToFloat64(c.s.mets.numFailedLogins))
+}
+
+func TestRecoveryCodeWorksOnce(t *testing.T) {
+	s := newLifecycleServer(t, slog.Default())
+	s.cryptoHelper = new(BcryptHelper)
+	hashes, err := s.hashRecoveryCodes([]string{"abcd-efgh", "ijkl-mnop"})
+	require.NoError(t, err)
+	c := newTOTPClient(t, Author{TOTPSecret: rfcSecret, RecoveryCodes: hashes})
+	var used atomic.Int32
+	var wg sync.WaitGroup
+	for range 5 {
+		a := c.author()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := c.s.checkSecondFactor(c.s.gctx.Db, a, "abcd-efgh")
+			require.NoError(t, err)
+			if ok {
+				used.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), used.Load())
+	require.Len(t, strings.Fields(c.author().RecoveryCodes), 1)
+}
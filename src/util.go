@@ -3,12 +3,14 @@ package rtfblog
 import (
 	"crypto/md5"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"unicode"
 	"unicode/utf8"
 
+	"github.com/go-sql-driver/mysql"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -46,6 +48,9 @@ func encryptBcrypt(passwd []byte) (hash string, err error) {
 }
 
 func censorPostgresConnStr(conn string) string {
+	if u, err := url.Parse(conn); err == nil && u.Scheme != "" {
+		return u.Redacted()
+	}
 	parts := strings.Split(conn, " ")
 	newParts := []string{}
 	for _, part := range parts {
@@ -57,3 +62,14 @@ func censorPostgresConnStr(conn string) string {
 	}
 	return strings.Join(newParts, " ")
 }
+
+func censorMySQLConnStr(conn string) string {
+	cfg, err := mysql.ParseDSN(strings.TrimPrefix(conn, "mysql://"))
+	if err != nil {
+		return "(unparsable DSN)"
+	}
+	if cfg.Passwd != "" {
+		cfg.Passwd = "xxxxx"
+	}
+	return cfg.FormatDSN()
+}
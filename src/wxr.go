@@ -0,0 +1,245 @@
+package rtfblog
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	wxrTimeLayout = "2006-01-02 15:04:05"
+	wxrZeroTime   = "0000-00-00 00:00:00"
+)
+
+var (
+	nonSlugChars = regexp.MustCompile(`[^\pL\pN]+`)
+)
+
+// wxrChannel is the part of WordPress eXtended RSS export that we care about.
+// Element names are matched without namespaces, since the wp: namespace URL
+// differs between WXR versions. Except for content:encoded, which has to be
+// told from excerpt:encoded.
+type wxrChannel struct {
+	Items []wxrItem `xml:"channel>item"`
+}
+
+type wxrItem struct {
+	Title      string        `xml:"title"`
+	Link       string        `xml:"link"`
+	GUID       string        `xml:"guid"`
+	Content    string        `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PostID     string        `xml:"post_id"`
+	PostName   string        `xml:"post_name"`
+	PostType   string        `xml:"post_type"`
+	Status     string        `xml:"status"`
+	Password   string        `xml:"post_password"`
+	PostDate   string        `xml:"post_date"`
+	PostDateGM string        `xml:"post_date_gmt"`
+	Categories []wxrCategory `xml:"category"`
+	Comments   []wxrComment  `xml:"comment"`
+}
+
+type wxrCategory struct {
+	Domain   string `xml:"domain,attr"`
+	Nicename string `xml:"nicename,attr"`
+	Name     string `xml:",chardata"`
+}
+
+type wxrComment struct {
+	Author      string `xml:"comment_author"`
+	AuthorEmail string `xml:"comment_author_email"`
+	AuthorURL   string `xml:"comment_author_url"`
+	AuthorIP    string `xml:"comment_author_IP"`
+	Date        string `xml:"comment_date"`
+	DateGMT     string `xml:"comment_date_gmt"`
+	Content     string `xml:"comment_content"`
+	Approved    string `xml:"comment_approved"`
+	Type        string `xml:"comment_type"`
+}
+
+func parseWXR(r io.Reader) ([]wxrItem, error) {
+	var ch wxrChannel
+	dec := xml.NewDecoder(r)
+	// WordPress declares UTF-8, but be lenient if it says otherwise:
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if err := dec.Decode(&ch); err != nil {
+		return nil, fmt.Errorf("parse WXR: %w", err)
+	}
+	return ch.Items, nil
+}
+
+// convertWXR turns the WordPress posts into ours. Pages, attachments and the
+// like are skipped, as well as trashed posts, spam and pingbacks.
+func convertWXR(items []wxrItem) ([]importedPost, error) {
+	var posts []importedPost
+	for _, item := range items {
+		if item.PostType != "post" || item.Status == "trash" || item.Status == "auto-draft" {
+			continue
+		}
+		body, err := htmlToMarkdown(item.Content)
+		if err != nil {
+			return nil, fmt.Errorf("convert post %q: %w", item.Title, err)
+		}
+		slug := wxrSlug(item)
+		p := importedPost{
+			post: EntryTable{
+				EntryLink: EntryLink{
+					Title:  item.Title,
+					URL:    slug,
+					Hidden: item.Status != "publish" || item.Password != "",
+				},
+				UnixDate: wxrTime(item.PostDateGM, item.PostDate),
+				RawBody:  body,
+				ImportID: wxrImportID(item),
+			},
+			tags: wxrTags(item.Categories),
+		}
+		if !p.post.Hidden {
+			p.oldPaths = wxrOldPaths(item, slug)
+		}
+		for _, c := range item.Comments {
+			if c.Approved != "1" || (c.Type != "" && c.Type != "comment") {
+				continue
+			}
+			text, err := htmlToMarkdown(c.Content)
+			if err != nil {
+				return nil, fmt.Errorf("convert comment on %q: %w", item.Title, err)
+			}
+			p.comments = append(p.comments, importedComment{
+				commenter: Commenter{
+					Name:    c.Author,
+					Email:   c.AuthorEmail,
+					Website: c.AuthorURL,
+					IP:      c.AuthorIP,
+				},
+				comment: CommentTable{
+					RawBody:   text,
+					Timestamp: wxrTime(c.DateGMT, c.Date),
+				},
+			})
+		}
+		posts = append(posts, p)
+	}
+	return posts, nil
+}
+
+// wxrSlug keeps the original slug, so that the post keeps its name. Drafts
+// may not have one yet, those get one made from the title.
+func wxrSlug(item wxrItem) string {
+	slug, err := url.PathUnescape(item.PostName)
+	if err != nil {
+		slug = item.PostName
+	}
+	if slug == "" {
+		slug = strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(item.Title), "-"), "-")
+	}
+	if slug == "" {
+		slug = "post-" + item.PostID
+	}
+	return slug
+}
+
+// wxrImportID tells the WordPress post apart from the others, and from
+// the posts of the blog's own. The GUID stays the same when the post gets
+// renamed, but may be missing from hand-made files.
+func wxrImportID(item wxrItem) string {
+	if guid := strings.TrimSpace(item.GUID); guid != "" {
+		return "wxr:" + guid
+	}
+	return "wxr:post-" + item.PostID
+}
+
+// wxrTime parses a WordPress timestamp, preferring the UTC one. Unpublished
+// posts have it zeroed. Returns 0 if neither can be parsed, which means 'now'
+// for the DB layer.
+func wxrTime(gmt, local string) int64 {
+	if gmt != "" && gmt != wxrZeroTime {
+		if t, err := time.Parse(wxrTimeLayout, gmt); err == nil {
+			return t.Unix()
+		}
+	}
+	if t, err := time.ParseInLocation(wxrTimeLayout, local, time.Local); err == nil {
+		return t.Unix()
+	}
+	return 0
+}
+
+// wxrTags merges categories and tags, since we only have the latter. The
+// default category of WordPress is dropped, it carries no information.
+func wxrTags(cats []wxrCategory) []*Tag {
+	var tags []*Tag
+	seen := map[string]bool{}
+	for _, c := range cats {
+		if c.Domain != "category" && c.Domain != "post_tag" {
+			continue
+		}
+		if c.Domain == "category" && c.Nicename == "uncategorized" {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(c.Name))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		tags = append(tags, &Tag{Name: name})
+	}
+	return tags
+}
+
+// wxrOldPaths returns the paths the post was reachable at on the old blog,
+// the permalink and the ?p=ID shortlink, unless they match the new one.
+func wxrOldPaths(item wxrItem, slug string) []string {
+	var paths []string
+	for _, link := range []string{item.Link, item.GUID} {
+		u, err := url.Parse(strings.TrimSpace(link))
+		if err != nil || (u.Path == "" && u.RawQuery == "") {
+			continue
+		}
+		old := u.EscapedPath()
+		if old == "" {
+			old = "/"
+		}
+		if u.RawQuery != "" {
+			old += "?" + u.RawQuery
+		}
+		if strings.TrimSuffix(u.Path, "/") == "/"+slug || slices.Contains(paths, old) {
+			continue
+		}
+		paths = append(paths, old)
+	}
+	return paths
+}
+
+// writeRedirectMap writes redirects in the format of nginx map blocks, which
+// is also trivial to turn into anything else.
+func writeRedirectMap(w io.Writer, redirects []redirect) error {
+	for _, r := range redirects {
+		if _, err := fmt.Fprintf(w, "%s %s;\n", r.from, r.to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importWXR imports a WordPress export file.
+func importWXR(db Data, r io.Reader) (importStats, error) {
+	if err := requireAuthor(db); err != nil {
+		return importStats{}, err
+	}
+	items, err := parseWXR(r)
+	if err != nil {
+		return importStats{}, err
+	}
+	posts, err := convertWXR(items)
+	if err != nil {
+		return importStats{}, err
+	}
+	return importPosts(db, posts)
+}
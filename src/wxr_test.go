@@ -0,0 +1,195 @@
+package rtfblog
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// commentRecorder keeps the comments that got inserted, the mock itself
+// forgets them.
+type commentRecorder struct {
+	*TestData
+	comments []*CommentTable
+}
+
+func (r *commentRecorder) insertComment(c *CommentTable) (int64, error) {
+	r.comments = append(r.comments, c)
+	return int64(len(r.comments)), nil
+}
+
+func loadTestWXR(t *testing.T) []importedPost {
+	f, err := os.Open("../testdata/wordpress.wxr")
+	require.NoError(t, err)
+	defer f.Close()
+	items, err := parseWXR(f)
+	require.NoError(t, err)
+	posts, err := convertWXR(items)
+	require.NoError(t, err)
+	return posts
+}
+
+func TestConvertWXR(t *testing.T) {
+	posts := loadTestWXR(t)
+	require.Len(t, posts, 3) // The page is skipped
+
+	hello := posts[0]
+	require.Equal(t, "Hello world!", hello.post.Title)
+	require.Equal(t, "hello-world", hello.post.URL)
+	require.False(t, hello.post.Hidden)
+	require.Equal(t, time.Date(2012, 5, 3, 10, 0, 0, 0, time.UTC).Unix(), hello.post.UnixDate)
+	require.Equal(t, "Welcome to **WordPress**. This is your first post.\n\n"+
+		"Second paragraph  \nwith a line break and a [link](https://wordpress.org/ \"WP\").\n\n"+
+		"- one\n- two", hello.post.RawBody)
+	require.Equal(t, []*Tag{{Name: "travel"}, {Name: "go"}}, hello.tags)
+	require.Equal(t, []string{"/2012/05/03/hello-world/", "/?p=1"}, hello.oldPaths)
+	require.Len(t, hello.comments, 1) // Spam and pingbacks are skipped
+	c := hello.comments[0]
+	require.Equal(t, Commenter{
+		Name:    "A WordPress Commenter",
+		Email:   "wapuu@wordpress.example",
+		Website: "https://wordpress.org/",
+		IP:      "127.0.0.1",
+	}, c.commenter)
+	require.Equal(t, "Hi, this is a *comment*.", c.comment.RawBody)
+	require.Equal(t, time.Date(2012, 5, 4, 10, 30, 0, 0, time.UTC).Unix(), c.comment.Timestamp)
+
+	// Non-ASCII slugs are kept as is, so the permalink does not change:
+	require.Equal(t, "už-kampo", posts[1].post.URL)
+	require.Equal(t, []string{"/?p=2"}, posts[1].oldPaths)
+
+	draft := posts[2]
+	require.True(t, draft.post.Hidden)
+	require.Equal(t, "unfinished-thoughts", draft.post.URL)
+	require.Empty(t, draft.oldPaths)
+	require.NotZero(t, draft.post.UnixDate)
+}
+
+func TestImportWXR(t *testing.T) {
+	defer testData.reset()
+	db := &commentRecorder{TestData: &testData}
+	stats, err := importPosts(db, loadTestWXR(t))
+	require.NoError(t, err)
+	require.Equal(t, 3, stats.posts)
+	require.Equal(t, 1, stats.comments)
+	calls := testData.calls()
+	require.Contains(t, calls, "URL:hello-world")
+	require.Contains(t, calls, "updateTags('0: {ID:0 Name:travel}')")
+	require.Contains(t, calls, "insertCommenter('A WordPress Commenter')")
+	require.Len(t, db.comments, 1)
+	require.Equal(t, "Hi, this is a *comment*.", db.comments[0].RawBody)
+
+	var buf bytes.Buffer
+	require.NoError(t, writeRedirectMap(&buf, stats.redirects))
+	require.Equal(t, "/2012/05/03/hello-world/ /hello-world;\n"+
+		"/?p=1 /hello-world;\n"+
+		"/?p=2 /u%C5%BE-kampo;\n", buf.String())
+}
+
+func TestImportWXRSkipsExistingComments(t *testing.T) {
+	defer testData.reset()
+	db := &commentRecorder{TestData: &testData}
+	existing := testPosts[0]
+	post := importedPost{
+		post: existing.EntryTable,
+		comments: []importedComment{{
+			commenter: testComm[0].Commenter,
+			comment:   testComm[0].CommentTable,
+		}, {
+			commenter: testComm[0].Commenter,
+			comment: CommentTable{
+				RawBody:   "A newer one",
+				Timestamp: testComm[0].Timestamp + 1,
+			},
+		}},
+	}
+	stats, err := importPosts(db, []importedPost{post})
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.comments)
+	require.Len(t, db.comments, 1)
+	require.Equal(t, "A newer one", db.comments[0].RawBody)
+	require.Contains(t, testData.calls(), "updatePost")
+}
+
+func TestImportWXRRequiresAuthor(t *testing.T) {
+	bak := testAuthor
+	defer func() {
+		testAuthor = bak
+	}()
+	testAuthor = nil
+	_, err := importWXR(&testData, strings.NewReader("<rss></rss>"))
+	require.Error(t, err)
+}
+
+func TestImportWXRKeepsOwnPosts(t *testing.T) {
+	db := newMemData()
+	require.NoError(t, withTransaction(db, func(db Data) error {
+		_, err := db.insertAuthor(&Author{UserName: "joe"})
+		return err
+	}))
+	require.NoError(t, withTransaction(db, func(db Data) error {
+		_, err := InsertOrUpdatePost(db, &EntryTable{
+			EntryLink: EntryLink{Title: "Mine", URL: "hello-world"},
+			RawBody:   "My own",
+		})
+		return err
+	}))
+	for range 2 {
+		stats, err := importPosts(db, loadTestWXR(t))
+		require.NoError(t, err)
+		require.Equal(t, []redirect{{from: "hello-world", to: "hello-world-2"}}, stats.renamed)
+		require.Contains(t, stats.redirects, redirect{from: "/?p=1", to: "/hello-world-2"})
+	}
+	mine, err := db.post("hello-world", true)
+	require.NoError(t, err)
+	require.Equal(t, "My own", mine.RawBody)
+	require.Empty(t, mine.ImportID)
+	imported, err := db.post("hello-world-2", true)
+	require.NoError(t, err)
+	require.Equal(t, "Hello world!", imported.Title)
+	require.Len(t, imported.Comments, 1)
+	_, err = db.post("hello-world-3", true)
+	require.ErrorIs(t, err, ErrNotFound)
+	n, err := db.numPosts(true)
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+
+	// Editing the imported post keeps it the imported one:
+	require.NoError(t, withTransaction(db, func(db Data) error {
+		_, err := InsertOrUpdatePost(db, &EntryTable{
+			EntryLink: EntryLink{Title: "Edited", URL: "hello-world-2"},
+		})
+		return err
+	}))
+	_, err = importPosts(db, loadTestWXR(t))
+	require.NoError(t, err)
+	n, err = db.numPosts(true)
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+}
+
+func TestImportWXRCommentsWithoutTime(t *testing.T) {
+	db := newMemData()
+	require.NoError(t, withTransaction(db, func(db Data) error {
+		_, err := db.insertAuthor(&Author{UserName: "joe"})
+		return err
+	}))
+	post := importedPost{
+		post: EntryTable{EntryLink: EntryLink{Title: "Post", URL: "post"}, ImportID: "wxr:1"},
+		comments: []importedComment{{
+			commenter: Commenter{Name: "N", Email: "n@example.com"},
+			comment:   CommentTable{RawBody: "Hi", Timestamp: wxrTime("bad", "worse")},
+		}},
+	}
+	for range 2 {
+		_, err := importPosts(db, []importedPost{post})
+		require.NoError(t, err)
+	}
+	p, err := db.post("post", true)
+	require.NoError(t, err)
+	require.Len(t, p.Comments, 1)
+}